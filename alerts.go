@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/newhook/whoishiring/queries"
+	"github.com/pkg/errors"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SavedSearch is a search evaluated against the comments ingested by each refresh, whose best matches
+// are delivered by a notifier. Comments are notified once.
+type SavedSearch struct {
+	ID string `json:"id"`
+	// Principal owns the saved search, and spends the budget of evaluating it.
+	Principal string `json:"-"`
+	Name      string `json:"name"`
+
+	SearchType    SearchType `json:"search_type"`
+	JobPrompt     string     `json:"job_prompt"`
+	ResumeSummary string     `json:"resume_summary"`
+	Exclusions    []string   `json:"exclusions"`
+	Dislikes      []int      `json:"dislikes"`
+	// MinScore is the fit score a pick needs to be notified, DefaultMinScore if zero. Picks ranked by
+	// vector search only, when the completion budget is exhausted, aren't scored and always are.
+	MinScore int `json:"min_score"`
+
+	// Notifier names one of notifiers, which delivers the alerts to Target.
+	Notifier string `json:"notifier"`
+	Target   string `json:"target"`
+	// Every is how often the search is evaluated, e.g. weekly for a digest, or at each refresh if zero.
+	Every time.Duration `json:"every"`
+
+	// SearchTerms are generated by the first evaluation, and reused with their query embeddings while
+	// the embedding model stays the same.
+	SearchTerms    []string             `json:"search_terms"`
+	EmbeddingModel string               `json:"embedding_model"`
+	Vectors        map[string][]float32 `json:"vectors,omitempty"`
+
+	// LastItemID is the newest comment when the search was last evaluated, only newer ones are.
+	LastItemID int `json:"last_item_id"`
+	// LastRunAt is when the search was last evaluated, and LastError why the evaluations since failed.
+	LastRunAt int64  `json:"last_run_at"`
+	LastError string `json:"last_error,omitempty"`
+	// Notified counts the comments notified.
+	Notified int `json:"notified"`
+
+	CreatedAt int64 `json:"created_at"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+const (
+	// DefaultMinScore is the fit score picks need to be notified by default.
+	DefaultMinScore = 7
+	// alertWindow is how many of the latest posts saved searches search, new comments are in the
+	// current month's post and sometimes in last month's.
+	alertWindow = 2
+)
+
+// ErrSavedSearchNotFound is returned for unknown saved searches, and for those of another principal.
+var ErrSavedSearchNotFound = errors.New("saved search not found")
+
+// ErrEmailRequiresAPIKey is returned for email saved searches of clients without an API key. Whoever has
+// a key is accountable for the addresses they email, anyone else could send digests to any address.
+var ErrEmailRequiresAPIKey = errors.New("email saved searches require an API key")
+
+// NewSavedSearch validates s and saves it as a new saved search, to be notified of the comments
+// ingested from now on.
+func NewSavedSearch(ctx context.Context, q *queries.Queries, s *SavedSearch) error {
+	if _, err := searchClause(s.SearchType); err != nil {
+		return err
+	}
+	if strings.TrimSpace(s.JobPrompt) == "" {
+		return errors.New("a saved search needs a prompt")
+	}
+	notifier, ok := notifiers[s.Notifier]
+	if !ok {
+		var names []string
+		for name := range notifiers {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return errors.Errorf("unknown notifier %q, expected one of %s", s.Notifier, strings.Join(names, ", "))
+	}
+	if err := notifier.Validate(s.Target); err != nil {
+		return err
+	}
+	if s.Notifier == "email" && !authenticated(s.Principal) {
+		return ErrEmailRequiresAPIKey
+	}
+	if s.MinScore == 0 {
+		s.MinScore = DefaultMinScore
+	}
+	if s.MinScore < 1 || s.MinScore > 10 {
+		return errors.Errorf("invalid min score %d, expected 1 to 10", s.MinScore)
+	}
+	if s.Every < 0 {
+		return errors.Errorf("invalid interval %s", s.Every)
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return errors.WithStack(err)
+	}
+	s.ID = hex.EncodeToString(b)
+	last, err := q.GetMaxItemID(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.LastItemID = int(last)
+	s.CreatedAt = time.Now().Unix()
+	s.UpdatedAt = s.CreatedAt
+	state, err := json.Marshal(s)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = q.UpsertSavedSearch(ctx, queries.UpsertSavedSearchParams{
+		ID:        s.ID,
+		Principal: s.Principal,
+		State:     string(state),
+		CreatedAt: int(s.CreatedAt),
+		UpdatedAt: int(s.UpdatedAt),
+	})
+	return errors.WithStack(err)
+}
+
+// NewSavedSearchFromSession returns a saved search of the session's prompt, resume summary, filters and
+// search terms.
+func NewSavedSearchFromSession(session *Session) *SavedSearch {
+	s := &SavedSearch{
+		Principal:     session.Principal,
+		SearchType:    session.SearchType,
+		JobPrompt:     session.JobPrompt,
+		ResumeSummary: session.ResumeSummary,
+		Exclusions:    session.Exclusions,
+		Dislikes:      session.Dislikes,
+		SearchTerms:   session.SearchTerms,
+	}
+	if vectors := session.vectors(); vectors != nil {
+		s.EmbeddingModel = session.EmbeddingModel
+		s.Vectors = vectors
+	}
+	return s
+}
+
+func GetSavedSearch(ctx context.Context, q *queries.Queries, id string, principal string) (*SavedSearch, error) {
+	row, err := q.GetSavedSearch(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSavedSearchNotFound
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if row.Principal != principal {
+		return nil, ErrSavedSearchNotFound
+	}
+	return savedSearchOf(row)
+}
+
+// GetSavedSearches returns the saved searches of principal, or all of them if principal is empty.
+func GetSavedSearches(ctx context.Context, q *queries.Queries, principal string) ([]*SavedSearch, error) {
+	var rows []queries.SavedSearch
+	var err error
+	if principal == "" {
+		rows, err = q.GetSavedSearches(ctx)
+	} else {
+		rows, err = q.GetSavedSearchesByPrincipal(ctx, principal)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	searches := []*SavedSearch{}
+	for _, row := range rows {
+		s, err := savedSearchOf(row)
+		if err != nil {
+			return nil, err
+		}
+		searches = append(searches, s)
+	}
+	return searches, nil
+}
+
+func savedSearchOf(row queries.SavedSearch) (*SavedSearch, error) {
+	s := &SavedSearch{}
+	if err := json.Unmarshal([]byte(row.State), s); err != nil {
+		return nil, errors.Wrapf(err, "saved search %s", row.ID)
+	}
+	s.Principal = row.Principal
+	return s, nil
+}
+
+// SaveSavedSearch saves the state of an existing saved search. It returns ErrSavedSearchNotFound if the
+// search was deleted, e.g. while it was evaluated, rather than saving it again.
+func SaveSavedSearch(ctx context.Context, q *queries.Queries, s *SavedSearch) error {
+	s.UpdatedAt = time.Now().Unix()
+	state, err := json.Marshal(s)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	updated, err := q.UpdateSavedSearch(ctx, queries.UpdateSavedSearchParams{
+		State:     string(state),
+		UpdatedAt: int(s.UpdatedAt),
+		ID:        s.ID,
+		Principal: s.Principal,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if updated == 0 {
+		return ErrSavedSearchNotFound
+	}
+	return nil
+}
+
+// DeleteSavedSearch deletes the saved search id of principal, and the record of its notified comments.
+func DeleteSavedSearch(ctx context.Context, q *queries.Queries, id string, principal string) error {
+	deleted, err := q.DeleteSavedSearch(ctx, queries.DeleteSavedSearchParams{ID: id, Principal: principal})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if deleted == 0 {
+		return ErrSavedSearchNotFound
+	}
+	return errors.WithStack(q.DeleteNotifiedItems(ctx, id))
+}
+
+// Refresh deletes the expired sessions, fetches the new whoishiring posts and comments, embeds them,
+// and evaluates the saved searches against them.
+func Refresh(ctx context.Context, l *slog.Logger, q *queries.Queries) error {
+	if *sessionTTL > 0 {
+		expired, err := DeleteExpiredSessions(ctx, q, *sessionTTL)
+		if err != nil {
+			return err
+		}
+		l.Info("deleted expired sessions", slog.Int64("count", expired))
+	}
+	if err := FetchPosts(ctx, l, q); err != nil {
+		return err
+	}
+	if err := CreateEmbeddings(ctx, l, q, *embeddingModel); err != nil {
+		return err
+	}
+	return EvaluateSavedSearches(ctx, l, q)
+}
+
+// ScheduleRefresh refreshes every interval until ctx is done. Failed refreshes are logged, and retried
+// at the next interval.
+func ScheduleRefresh(ctx context.Context, l *slog.Logger, q *queries.Queries, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			start := time.Now()
+			if err := Refresh(ctx, l, q); err != nil {
+				l.Error("refresh failed", slog.String("error", err.Error()))
+				continue
+			}
+			l.Info("refreshed", slog.Duration("elapsed", time.Since(start)))
+		}
+	}
+}
+
+// EvaluateSavedSearches notifies each saved search of its matches among the comments ingested since it
+// was last evaluated. A search that fails is evaluated against the same comments again next time, its
+// error is recorded and the others are evaluated regardless.
+func EvaluateSavedSearches(ctx context.Context, l *slog.Logger, q *queries.Queries) error {
+	last, err := q.GetMaxItemID(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	searches, err := GetSavedSearches(ctx, q, "")
+	if err != nil {
+		return err
+	}
+	for _, s := range searches {
+		if s.LastItemID >= int(last) || !s.due(time.Now()) {
+			continue
+		}
+		err := evaluateSavedSearch(ctx, l, q, s, int(last))
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		l.Error("saved search failed", slog.String("search", s.ID), slog.String("error", err.Error()))
+		s.LastError = err.Error()
+		err = SaveSavedSearch(ctx, q, s)
+		if errors.Is(err, ErrSavedSearchNotFound) {
+			l.Info("saved search was deleted while it was evaluated", slog.String("search", s.ID))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// due reports whether the search is to be evaluated at now. Searches evaluated every interval are
+// first evaluated an interval after they're created, and retried at each refresh when they fail.
+func (s *SavedSearch) due(now time.Time) bool {
+	if s.Every == 0 || s.LastError != "" {
+		return true
+	}
+	return now.Sub(time.Unix(max(s.LastRunAt, s.CreatedAt), 0)) >= s.Every
+}
+
+// evaluateSavedSearch notifies s of its matches among the comments after s.LastItemID, up to last. The
+// comments it was notified of before are skipped.
+func evaluateSavedSearch(ctx context.Context, l *slog.Logger, q *queries.Queries, s *SavedSearch, last int) error {
+	l = l.With(slog.String("search", s.ID))
+	notifier, ok := notifiers[s.Notifier]
+	if !ok {
+		return errors.Errorf("unknown notifier %q", s.Notifier)
+	}
+	clause, err := searchClause(s.SearchType)
+	if err != nil {
+		return err
+	}
+	termsTask, rankTask := searchTasks(s.SearchType)
+	prompts, err := promptRegistry.Select("")
+	if err != nil {
+		return err
+	}
+	var cache *CompletionCache
+	if *completionCacheTTL > 0 {
+		cache = NewCompletionCache(q, *completionCacheTTL)
+	}
+	meter := NewMeter(q, s.Principal)
+	cr := newCompleter(prompts, cache, meter)
+	// degraded reports whether err is the exhausted completion budget, which falls back to vector search.
+	degraded := func(err error) bool {
+		var budgetErr *BudgetError
+		return errors.As(err, &budgetErr) && budgetErr.Endpoint == CompletionEndpoint
+	}
+
+	search := SearchTerms{SearchType: s.SearchType, Exclusions: s.Exclusions, Dislikes: s.Dislikes}
+	prefs, err := getPreferences(ctx, q, search)
+	if err != nil {
+		return err
+	}
+	terms := s.SearchTerms
+	vectors := map[string][]float32{}
+	if len(terms) == 0 || s.EmbeddingModel != *embeddingModel {
+		terms, err = cr.GetTerms(ctx, termsTask, searchPrompt(s.SearchType, s.JobPrompt), prefs)
+		if degraded(err) {
+			// Search with the prompt itself, the terms are generated next time.
+			terms, err = []string{s.JobPrompt}, nil
+		} else if err == nil {
+			s.SearchTerms = terms
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		maps.Copy(vectors, s.Vectors)
+	}
+
+	var negatives []string
+	for _, exclusion := range s.Exclusions {
+		negatives = append(negatives, negativeTerm(exclusion))
+	}
+	dislikeTerms, err := itemVectors(ctx, q, s.Dislikes, vectors)
+	if err != nil {
+		return err
+	}
+	negatives = append(negatives, dislikeTerms...)
+
+	resp, err := vectorSearch(ctx, l, q, meter, alertWindow, *embeddingModel, clause, terms, negatives, vectors, DefaultCandidates+len(s.Dislikes), s.LastItemID)
+	if err != nil {
+		return err
+	}
+	s.EmbeddingModel = *embeddingModel
+	s.Vectors = map[string][]float32{}
+	for term, v := range resp.Vectors {
+		if !strings.HasPrefix(term, itemTermPrefix) {
+			s.Vectors[term] = v
+		}
+	}
+
+	var ids []int
+	for _, result := range resp.Results {
+		ids = append(ids, result.ID)
+	}
+	notified, err := q.GetNotifiedItems(ctx, queries.GetNotifiedItemsParams{SavedSearchID: s.ID, Ids: ids})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	skip := NewSet(notified...)
+	for _, id := range s.Dislikes {
+		skip.Add(id)
+	}
+	results := slices.DeleteFunc(resp.Results, func(r Result) bool { return skip.Contains(r.ID) })
+	results = results[:min(DefaultCandidates, len(results))]
+
+	var matches []Match
+	if len(results) > 0 {
+		picks, err := rerank(ctx, l, cr, rankTask, searchPrompt(s.SearchType, s.JobPrompt), prefs, results, DefaultTokenBudget, func(Event) {}, nil)
+		if degraded(err) {
+			picks, err = similarityPicks(results), nil
+		}
+		if err != nil {
+			return err
+		}
+		matches, err = alertMatches(ctx, q, s, results, picks)
+		if err != nil {
+			return err
+		}
+	}
+	l.Info("evaluated saved search", slog.Int("results", len(results)), slog.Int("matches", len(matches)))
+
+	if len(matches) > 0 {
+		alert := *s
+		alert.Vectors = nil
+		if err := notifier.Notify(ctx, l, s.Target, Alert{Search: &alert, Matches: matches}); err != nil {
+			return err
+		}
+		now := time.Now().Unix()
+		for _, m := range matches {
+			err := q.InsertNotifiedItem(ctx, queries.InsertNotifiedItemParams{SavedSearchID: s.ID, ItemID: m.ID, CreatedAt: int(now)})
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	s.Notified += len(matches)
+	s.LastItemID = last
+	s.LastRunAt = time.Now().Unix()
+	s.LastError = ""
+	err = SaveSavedSearch(ctx, q, s)
+	if errors.Is(err, ErrSavedSearchNotFound) {
+		// Deleted while it was evaluated: it stays deleted, along with the comments just recorded.
+		l.Info("saved search was deleted while it was evaluated")
+		return errors.WithStack(q.DeleteNotifiedItems(ctx, s.ID))
+	}
+	return err
+}
+
+// alertMatches returns the matches of the picks scoring at least s.MinScore.
+func alertMatches(ctx context.Context, q *queries.Queries, s *SavedSearch, results []Result, picks []Pick) ([]Match, error) {
+	byID := map[int]queries.Item{}
+	similarity := map[int]float32{}
+	parents := NewSet[int]()
+	for _, result := range results {
+		byID[result.ID] = result.Item
+		similarity[result.ID] = result.Similarity
+		parents.Add(result.Item.Parent)
+	}
+	posts, err := q.GetItems(ctx, parents.Values())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	titles := map[int]string{}
+	for _, post := range posts {
+		titles[post.ID] = post.Title
+	}
+
+	var matches []Match
+	for _, pick := range picks {
+		item, ok := byID[pick.ID]
+		// Picks ranked by vector search only aren't scored.
+		if !ok || pick.Score != 0 && pick.Score < s.MinScore {
+			continue
+		}
+		if s.SearchType == SearchType_WhoWantToBeHired {
+			c := parseCandidate(item.Text)
+			pick.Candidate = &c
+		}
+		matches = append(matches, Match{
+			ID:         item.ID,
+			Link:       fmt.Sprintf("https://news.ycombinator.com/item?id=%d", item.ID),
+			Thread:     titles[item.Parent],
+			Text:       item.Text,
+			Time:       item.Time,
+			Similarity: similarity[item.ID],
+			Pick:       pick,
+		})
+	}
+	return matches, nil
+}
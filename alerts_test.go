@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/newhook/whoishiring/queries"
+	"github.com/pkg/errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNotifier records the alerts, or fails with err. notifying is called first, if set.
+type testNotifier struct {
+	alerts    []Alert
+	err       error
+	notifying func()
+}
+
+func (n *testNotifier) Validate(target string) error {
+	return nil
+}
+
+func (n *testNotifier) Notify(ctx context.Context, l *slog.Logger, target string, alert Alert) error {
+	if n.notifying != nil {
+		n.notifying()
+	}
+	if n.err != nil {
+		return n.err
+	}
+	n.alerts = append(n.alerts, alert)
+	return nil
+}
+
+func useTestNotifier(t *testing.T) *testNotifier {
+	t.Helper()
+	n := &testNotifier{}
+	notifiers["test"] = n
+	t.Cleanup(func() { delete(notifiers, "test") })
+	return n
+}
+
+func alertIDs(alert Alert) []int {
+	var ids []int
+	for _, m := range alert.Matches {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestEvaluateSavedSearches(t *testing.T) {
+	useTestModels(t, "remote Go backend engineer, distributed systems and Kubernetes")
+	n := useTestNotifier(t)
+	q := newFixtureDB(t)
+	ctx := context.Background()
+
+	saved := &SavedSearch{
+		Principal:  "key:test",
+		SearchType: SearchType_WhoIsHiring,
+		JobPrompt:  "remote Go backend engineer",
+		MinScore:   9,
+		Notifier:   "test",
+	}
+	if err := NewSavedSearch(ctx, q, saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.LastItemID != 2003 {
+		t.Fatalf("expected the saved search to start after the newest comment, got %d", saved.LastItemID)
+	}
+	// As if the hiring comments after 1003 were ingested after the search was saved.
+	saved.LastItemID = 1003
+	if err := SaveSavedSearch(ctx, q, saved); err != nil {
+		t.Fatal(err)
+	}
+
+	n.err = errors.New("unreachable")
+	if err := EvaluateSavedSearches(ctx, testLogger(), q); err != nil {
+		t.Fatal(err)
+	}
+	failed, err := GetSavedSearch(ctx, q, saved.ID, "key:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed.LastItemID != 1003 || failed.LastError == "" {
+		t.Fatalf("expected a failed notification to be retried, got %+v", failed)
+	}
+
+	n.err = nil
+	if err := EvaluateSavedSearches(ctx, testLogger(), q); err != nil {
+		t.Fatal(err)
+	}
+	if len(n.alerts) != 1 {
+		t.Fatalf("expected an alert, got %d", len(n.alerts))
+	}
+	first := alertIDs(n.alerts[0])
+	// The test model scores its picks 10, 9 and 8.
+	if len(first) != 2 || slices.ContainsFunc(first, func(id int) bool { return id <= 1003 || id > 1006 }) {
+		t.Errorf("expected the two best new hiring comments, got %v", first)
+	}
+	if m := n.alerts[0].Matches[0]; m.Thread != "Ask HN: Who is hiring? (June 2024)" || m.Pick.Rationale == "" {
+		t.Errorf("unexpected match %+v", m)
+	}
+
+	// Nothing was ingested since.
+	if err := EvaluateSavedSearches(ctx, testLogger(), q); err != nil {
+		t.Fatal(err)
+	}
+	if len(n.alerts) != 1 {
+		t.Fatalf("expected no alert without new comments, got %d", len(n.alerts))
+	}
+
+	// Comments aren't notified twice, even when they're evaluated again.
+	evaluated, err := GetSavedSearch(ctx, q, saved.ID, "key:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evaluated.LastItemID != 2003 || evaluated.LastError != "" || evaluated.Notified != 2 || len(evaluated.SearchTerms) == 0 {
+		t.Fatalf("unexpected saved search after evaluation %+v", evaluated)
+	}
+	evaluated.LastItemID = 1003
+	if err := SaveSavedSearch(ctx, q, evaluated); err != nil {
+		t.Fatal(err)
+	}
+	if err := EvaluateSavedSearches(ctx, testLogger(), q); err != nil {
+		t.Fatal(err)
+	}
+	if len(n.alerts) != 2 {
+		t.Fatalf("expected an alert of the comment not notified yet, got %d", len(n.alerts))
+	}
+	if second := alertIDs(n.alerts[1]); len(second) != 1 || slices.Contains(first, second[0]) {
+		t.Errorf("expected only the comment not notified yet, got %v after %v", second, first)
+	}
+}
+
+func TestSavedSearchDeletedWhileEvaluated(t *testing.T) {
+	useTestModels(t, "remote Go backend engineer, distributed systems and Kubernetes")
+	n := useTestNotifier(t)
+	q := newFixtureDB(t)
+	ctx := context.Background()
+
+	for _, err := range []error{nil, errors.New("unreachable")} {
+		saved := &SavedSearch{Principal: "key:test", SearchType: SearchType_WhoIsHiring, JobPrompt: "remote Go backend engineer", Notifier: "test"}
+		if err := NewSavedSearch(ctx, q, saved); err != nil {
+			t.Fatal(err)
+		}
+		saved.LastItemID = 1003
+		if err := SaveSavedSearch(ctx, q, saved); err != nil {
+			t.Fatal(err)
+		}
+		n.err = err
+		n.notifying = func() {
+			if err := DeleteSavedSearch(ctx, q, saved.ID, "key:test"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := EvaluateSavedSearches(ctx, testLogger(), q); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := GetSavedSearch(ctx, q, saved.ID, "key:test"); !errors.Is(err, ErrSavedSearchNotFound) {
+			t.Errorf("expected the deleted search to stay deleted, got %v", err)
+		}
+		notified, err := q.GetNotifiedItems(ctx, queries.GetNotifiedItemsParams{SavedSearchID: saved.ID, Ids: []int{1004, 1005, 1006}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(notified) != 0 {
+			t.Errorf("expected no notified comments of the deleted search, got %v", notified)
+		}
+	}
+	if err := SaveSavedSearch(ctx, q, &SavedSearch{ID: "unknown", Principal: "key:test"}); !errors.Is(err, ErrSavedSearchNotFound) {
+		t.Errorf("expected an unknown search not to be saved, got %v", err)
+	}
+}
+
+func TestNewSavedSearchValidates(t *testing.T) {
+	q := newFixtureDB(t)
+	ctx := context.Background()
+	for _, s := range []SavedSearch{
+		{SearchType: SearchType_WhoIsHiring, JobPrompt: "Go", Notifier: "pager"},
+		{SearchType: SearchType_WhoIsHiring, JobPrompt: "Go", Notifier: "webhook", Target: "ftp://example.com"},
+		{SearchType: SearchType_WhoIsHiring, Notifier: "log"},
+		{SearchType: SearchType_WhoIsHiring, JobPrompt: "Go", Notifier: "log", MinScore: 11},
+	} {
+		if err := NewSavedSearch(ctx, q, &s); err == nil {
+			t.Errorf("expected %+v to be invalid", s)
+		}
+	}
+
+	addr, from := *smtpAddr, *smtpFrom
+	*smtpAddr, *smtpFrom = "localhost:25", "alerts@example.com"
+	t.Cleanup(func() { *smtpAddr, *smtpFrom = addr, from })
+	email := SavedSearch{Principal: "ip:192.0.2.1", SearchType: SearchType_WhoIsHiring, JobPrompt: "Go", Notifier: "email", Target: "ada@example.com"}
+	if err := NewSavedSearch(ctx, q, &email); !errors.Is(err, ErrEmailRequiresAPIKey) {
+		t.Errorf("expected an email search without an API key to be refused, got %v", err)
+	}
+	email.Principal = "key:test"
+	if err := NewSavedSearch(ctx, q, &email); err != nil {
+		t.Errorf("expected an email search with an API key to be saved, got %v", err)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	allowLocalAddresses(t)
+	var received Alert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	alert := Alert{
+		Search:  &SavedSearch{ID: "s1", Name: "Go jobs"},
+		Matches: []Match{{ID: 1001, Link: "https://news.ycombinator.com/item?id=1001", Pick: Pick{ID: 1001, Score: 9}}},
+	}
+	if err := notifiers["webhook"].Notify(context.Background(), testLogger(), server.URL, alert); err != nil {
+		t.Fatal(err)
+	}
+	if received.Search == nil || received.Search.Name != "Go jobs" || len(received.Matches) != 1 || received.Matches[0].Pick.Score != 9 {
+		t.Errorf("unexpected webhook body %+v", received)
+	}
+}
+
+func TestWebhookNotifierRejectsLocalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected the local webhook not to be posted to")
+	}))
+	defer server.Close()
+
+	n := notifiers["webhook"]
+	for _, target := range []string{server.URL, "http://169.254.169.254/latest", "http://[fd00::1]/hook", "ftp://example.com/hook"} {
+		if err := n.Validate(target); err == nil {
+			t.Errorf("expected %s to be rejected", target)
+		}
+	}
+	if err := n.Validate("https://hooks.example.com/alerts"); err != nil {
+		t.Error(err)
+	}
+	// Host names are checked when connecting.
+	target := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	if err := n.Notify(context.Background(), testLogger(), target, Alert{Search: &SavedSearch{ID: "s1"}}); err == nil {
+		t.Errorf("expected %s to be rejected", target)
+	}
+}
+
+func TestSavedSearchDue(t *testing.T) {
+	created := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	weekly := &SavedSearch{Every: 7 * 24 * time.Hour, CreatedAt: created.Unix()}
+	if weekly.due(created.Add(24 * time.Hour)) {
+		t.Error("expected a weekly search not to be due a day after it's created")
+	}
+	if !weekly.due(created.Add(7 * 24 * time.Hour)) {
+		t.Error("expected a weekly search to be due a week after it's created")
+	}
+	weekly.LastRunAt = created.Add(7 * 24 * time.Hour).Unix()
+	if weekly.due(created.Add(8 * 24 * time.Hour)) {
+		t.Error("expected a weekly search not to be due a day after it ran")
+	}
+	weekly.LastError = "unreachable"
+	if !weekly.due(created.Add(8 * 24 * time.Hour)) {
+		t.Error("expected a failed search to be retried at the next refresh")
+	}
+	if !(&SavedSearch{CreatedAt: created.Unix()}).due(created) {
+		t.Error("expected a search without an interval to be due at each refresh")
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/newhook/whoishiring/queries"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit caps the daily spending on an endpoint, in dollars, tokens or both. Zero is unlimited.
+type Limit struct {
+	USD    float64
+	Tokens int
+}
+
+func (l Limit) String() string {
+	var parts []string
+	if l.USD > 0 {
+		parts = append(parts, fmt.Sprintf("$%.2f", l.USD))
+	}
+	if l.Tokens > 0 {
+		parts = append(parts, fmt.Sprintf("%d tokens", l.Tokens))
+	}
+	return strings.Join(parts, " or ")
+}
+
+func (l Limit) exceeded(tokens int64, cost float64) bool {
+	return l.USD > 0 && cost >= l.USD || l.Tokens > 0 && tokens >= int64(l.Tokens)
+}
+
+var budgetEndpoints = []string{CompletionEndpoint, EmbeddingEndpoint, LinkedInEndpoint}
+
+// Budget is the daily limit of each endpoint. Endpoints without a limit are unlimited.
+type Budget map[string]Limit
+
+func (b *Budget) String() string {
+	if b == nil {
+		return ""
+	}
+	var parts []string
+	for _, endpoint := range budgetEndpoints {
+		l := (*b)[endpoint]
+		if l.USD > 0 {
+			parts = append(parts, endpoint+".usd="+strconv.FormatFloat(l.USD, 'g', -1, 64))
+		}
+		if l.Tokens > 0 {
+			parts = append(parts, endpoint+".tokens="+strconv.Itoa(l.Tokens))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set parses a budget formatted as "completion.usd=1,completion.tokens=200000,linkedin.usd=0.5".
+func (b *Budget) Set(s string) error {
+	budget := Budget{}
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return errors.Errorf("invalid budget %q, expected endpoint.usd=value or endpoint.tokens=value", part)
+		}
+		endpoint, unit, _ := strings.Cut(key, ".")
+		if !slices.Contains(budgetEndpoints, endpoint) {
+			return errors.Errorf("unknown endpoint in budget %q, expected %s", part, strings.Join(budgetEndpoints, ", "))
+		}
+		l := budget[endpoint]
+		var err error
+		switch unit {
+		case "usd":
+			l.USD, err = strconv.ParseFloat(value, 64)
+		case "tokens":
+			l.Tokens, err = strconv.Atoi(value)
+		default:
+			return errors.Errorf("unknown unit in budget %q, expected usd or tokens", part)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "invalid budget %q", part)
+		}
+		budget[endpoint] = l
+	}
+	*b = budget
+	return nil
+}
+
+var (
+	// userBudget limits each API key, or address for requests without a key.
+	userBudget = Budget{}
+	// globalBudget limits all calls together, including the server's own, e.g. embedding new posts.
+	globalBudget = Budget{}
+)
+
+// ErrBudgetExceeded is wrapped by BudgetError.
+var ErrBudgetExceeded = errors.New("daily budget exceeded")
+
+// BudgetError is returned instead of making a call when a budget is exhausted.
+type BudgetError struct {
+	// Scope is "user" or "global".
+	Scope    string
+	Endpoint string
+	Limit    Limit
+	// Reset is when the budget starts over, at midnight UTC.
+	Reset time.Time
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("%s %s budget of %s a day is exhausted until %s", e.Scope, e.Endpoint, e.Limit, e.Reset.Format(time.RFC3339))
+}
+
+func (e *BudgetError) Unwrap() error {
+	return ErrBudgetExceeded
+}
+
+// Allow returns a BudgetError when the principal's or the global budget of endpoint is exhausted.
+// The server's own calls, without a principal, are only limited by the global budget. Budgets are
+// checked before each call, so the call that exhausts a budget may overshoot it.
+func (m *Meter) Allow(ctx context.Context, endpoint string) error {
+	if m == nil {
+		return nil
+	}
+	y, mo, d := time.Now().UTC().Date()
+	today := time.Date(y, mo, d, 0, 0, 0, 0, time.UTC)
+	reset := today.AddDate(0, 0, 1)
+
+	if limit, ok := userBudget[endpoint]; ok && m.principal != "" {
+		spent, err := m.q.GetPrincipalSpending(ctx, queries.GetPrincipalSpendingParams{
+			Principal: m.principal,
+			Endpoint:  endpoint,
+			CreatedAt: int(today.Unix()),
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if limit.exceeded(spent.Tokens, spent.Cost) {
+			return &BudgetError{Scope: "user", Endpoint: endpoint, Limit: limit, Reset: reset}
+		}
+	}
+	if limit, ok := globalBudget[endpoint]; ok {
+		spent, err := m.q.GetSpending(ctx, queries.GetSpendingParams{
+			Endpoint:  endpoint,
+			CreatedAt: int(today.Unix()),
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if limit.exceeded(spent.Tokens, spent.Cost) {
+			return &BudgetError{Scope: "global", Endpoint: endpoint, Limit: limit, Reset: reset}
+		}
+	}
+	return nil
+}
+
+// CheckBudget fails a search up front when it can't run at all: the query embeddings are needed even
+// without completions, and so is the LinkedIn profile when one is given.
+func CheckBudget(ctx context.Context, q *queries.Queries, search SearchTerms) error {
+	m := NewMeter(q, search.Principal)
+	if err := m.Allow(ctx, EmbeddingEndpoint); err != nil {
+		return err
+	}
+	if search.LinkedIn != "" {
+		return m.Allow(ctx, LinkedInEndpoint)
+	}
+	return nil
+}
+
+// apiKeys are the hashes of the API keys accepted in the X-API-Key header.
+var apiKeys = Set[string]{}
+
+// SetAPIKeys replaces the accepted API keys with the comma separated keys.
+func SetAPIKeys(keys string) {
+	apiKeys = Set[string]{}
+	for _, key := range strings.Split(keys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			apiKeys.Add(hashAPIKey(key))
+		}
+	}
+}
+
+// hashAPIKey identifies an API key without storing it.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// requireAPIKey rejects requests with an X-API-Key that isn't one of the accepted keys, rather than
+// silently spending the budget of the client's address.
+func requireAPIKey(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if key := c.Request().Header.Get("X-API-Key"); key != "" && !apiKeys.Contains(hashAPIKey(key)) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "unknown API key")
+		}
+		return next(c)
+	}
+}
+
+// principal identifies who a request spends the budget of: an accepted API key in the X-API-Key
+// header, or the client's address as determined by the server's IPExtractor.
+func principal(c echo.Context) string {
+	if key := c.Request().Header.Get("X-API-Key"); key != "" && apiKeys.Contains(hashAPIKey(key)) {
+		return keyPrincipal + hashAPIKey(key)
+	}
+	return "ip:" + c.RealIP()
+}
+
+// keyPrincipal prefixes the principals of accepted API keys.
+const keyPrincipal = "key:"
+
+// authenticated reports whether principal is an accepted API key rather than a client's address.
+func authenticated(principal string) bool {
+	return strings.HasPrefix(principal, keyPrincipal)
+}
+
+// ParseTrustedProxies parses a comma separated list of proxy addresses or CIDR ranges.
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, errors.Errorf("invalid proxy address %q", part)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid proxy range %q", part)
+		}
+		proxies = append(proxies, ipNet)
+	}
+	return proxies, nil
+}
+
+// IPExtractor returns how the client's address is determined. Requests come straight from clients
+// unless proxies are trusted, then X-Forwarded-For is only believed when it's set by one of them.
+func IPExtractor(proxies []*net.IPNet) echo.IPExtractor {
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range proxies {
+		options = append(options, echo.TrustIPRange(proxy))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
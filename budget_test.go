@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"github.com/labstack/echo/v4"
+	"github.com/newhook/whoishiring/queries"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBudgetSet(t *testing.T) {
+	var b Budget
+	if err := b.Set("completion.usd=1.5,completion.tokens=200000,linkedin.usd=0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if b[CompletionEndpoint] != (Limit{USD: 1.5, Tokens: 200000}) || b[LinkedInEndpoint] != (Limit{USD: 0.1}) {
+		t.Errorf("unexpected budget %+v", b)
+	}
+	if got := b.String(); got != "completion.usd=1.5,completion.tokens=200000,linkedin.usd=0.1" {
+		t.Errorf("unexpected string %q", got)
+	}
+	for _, s := range []string{"completion=1", "rerank.usd=1", "completion.dollars=1", "completion.usd=x"} {
+		if err := b.Set(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func useBudgets(t *testing.T, user, global Budget) {
+	t.Helper()
+	previousUser, previousGlobal := userBudget, globalBudget
+	userBudget, globalBudget = user, global
+	t.Cleanup(func() { userBudget, globalBudget = previousUser, previousGlobal })
+}
+
+func TestJobSearchDegradesWhenCompletionBudgetExhausted(t *testing.T) {
+	useTestModels(t, "remote Go backend engineer")
+	// The test model's completions are 110 tokens, a search spends the budget.
+	useBudgets(t, Budget{CompletionEndpoint: {Tokens: 220}}, nil)
+	q := newFixtureDB(t)
+	search := func(principal string, emit func(Event)) JobSearchResponse {
+		t.Helper()
+		resp, err := StreamJobSearch(context.Background(), testLogger(), q, SearchTerms{
+			Months:     1,
+			SearchType: SearchType_WhoIsHiring,
+			JobPrompt:  "remote Go backend engineer",
+			NoCache:    true,
+			Principal:  principal,
+		}, emit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := search("ip:192.0.2.1", nil); resp.Degraded != "" {
+		t.Fatalf("expected the first search within budget, got %q", resp.Degraded)
+	}
+
+	testLLMClient.requests = nil
+	var events []string
+	resp := search("ip:192.0.2.1", func(e Event) { events = append(events, e.Name) })
+	if resp.Degraded == "" || !slices.Contains(events, "degraded") {
+		t.Errorf("expected a degraded search, got %q and events %v", resp.Degraded, events)
+	}
+	if len(testLLMClient.requests) != 0 {
+		t.Errorf("expected no completions, got %d", len(testLLMClient.requests))
+	}
+	if len(resp.OriginalComments) == 0 || resp.OriginalComments[0] != 1001 {
+		t.Errorf("expected the prompt to be the search term, got %v", resp.OriginalComments)
+	}
+	if len(resp.Comments) != picksPerRanking || !slices.Equal(resp.Comments, resp.OriginalComments[:picksPerRanking]) {
+		t.Errorf("expected the most similar results, got %v of %v", resp.Comments, resp.OriginalComments)
+	}
+
+	// Another address still has its budget.
+	if resp := search("ip:192.0.2.2", nil); resp.Degraded != "" {
+		t.Errorf("expected a full search, got %q", resp.Degraded)
+	}
+}
+
+func TestCheckBudget(t *testing.T) {
+	q := newFixtureDB(t)
+	ctx := context.Background()
+	err := q.InsertUsage(ctx, queries.InsertUsageParams{
+		Endpoint:    EmbeddingEndpoint,
+		Provider:    "voyageai",
+		Model:       "voyage-2",
+		Task:        "query",
+		InputTokens: 1000,
+		Cost:        0.0001,
+		CreatedAt:   int(time.Now().Unix()),
+		Principal:   "key:a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	useBudgets(t, Budget{EmbeddingEndpoint: {Tokens: 1000}}, nil)
+	var budgetErr *BudgetError
+	err = CheckBudget(ctx, q, SearchTerms{Principal: "key:a"})
+	if !errors.As(err, &budgetErr) || budgetErr.Scope != "user" || !budgetErr.Reset.After(time.Now()) {
+		t.Errorf("expected the user budget to be exhausted, got %v", err)
+	}
+	if err := CheckBudget(ctx, q, SearchTerms{Principal: "key:b"}); err != nil {
+		t.Errorf("expected another key within budget, got %v", err)
+	}
+
+	useBudgets(t, nil, Budget{EmbeddingEndpoint: {USD: 0.0001}})
+	err = CheckBudget(ctx, q, SearchTerms{Principal: "key:b"})
+	if !errors.As(err, &budgetErr) || budgetErr.Scope != "global" {
+		t.Errorf("expected the global budget to be exhausted, got %v", err)
+	}
+	// The server's own calls count against the global budget.
+	if err := CheckBudget(ctx, q, SearchTerms{}); !errors.As(err, &budgetErr) || budgetErr.Scope != "global" {
+		t.Errorf("expected the global budget to limit the server's own calls, got %v", err)
+	}
+	// But no user budget applies to them.
+	useBudgets(t, Budget{EmbeddingEndpoint: {Tokens: 1}}, nil)
+	if err := CheckBudget(ctx, q, SearchTerms{}); err != nil {
+		t.Errorf("expected no user budget without a principal, got %v", err)
+	}
+}
+
+func TestPrincipal(t *testing.T) {
+	previous := apiKeys
+	SetAPIKeys("secret, other")
+	t.Cleanup(func() { apiKeys = previous })
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.0.2.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name       string
+		proxies    []*net.IPNet
+		remoteAddr string
+		header     http.Header
+		want       string
+		status     int
+	}{
+		{"key", nil, "198.51.100.1:1234", http.Header{"X-Api-Key": {"secret"}}, "key:" + hashAPIKey("secret"), http.StatusOK},
+		{"unknown key", nil, "198.51.100.1:1234", http.Header{"X-Api-Key": {"guess"}}, "", http.StatusUnauthorized},
+		{"address", nil, "198.51.100.1:1234", nil, "ip:198.51.100.1", http.StatusOK},
+		{"spoofed", nil, "198.51.100.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.9"}, "X-Real-Ip": {"203.0.113.9"}}, "ip:198.51.100.1", http.StatusOK},
+		{"loopback", nil, "127.0.0.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.9"}}, "ip:127.0.0.1", http.StatusOK},
+		{"proxy", proxies, "10.1.2.3:1234", http.Header{"X-Forwarded-For": {"203.0.113.9"}}, "ip:203.0.113.9", http.StatusOK},
+		{"proxy address", proxies, "192.0.2.7:1234", http.Header{"X-Forwarded-For": {"198.51.100.5, 203.0.113.9"}}, "ip:203.0.113.9", http.StatusOK},
+		{"untrusted proxy", proxies, "198.51.100.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.9"}}, "ip:198.51.100.1", http.StatusOK},
+	} {
+		e := echo.New()
+		e.IPExtractor = IPExtractor(c.proxies)
+		var got string
+		e.GET("/", func(ctx echo.Context) error {
+			got = principal(ctx)
+			return nil
+		}, requireAPIKey)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = c.remoteAddr
+		for k, v := range c.header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != c.status || got != c.want {
+			t.Errorf("%s: expected %d and %q, got %d and %q", c.name, c.status, c.want, rec.Code, got)
+		}
+	}
+
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("expected an invalid range to be rejected")
+	}
+	if _, err := ParseTrustedProxies("proxy.internal"); err == nil {
+		t.Error("expected a host name to be rejected")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/newhook/whoishiring/llm"
+	"github.com/newhook/whoishiring/queries"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// CompletionCache stores completions in SQLite, so repeating a search doesn't pay for the same
+// completions again.
+type CompletionCache struct {
+	q   *queries.Queries
+	ttl time.Duration
+}
+
+func NewCompletionCache(q *queries.Queries, ttl time.Duration) *CompletionCache {
+	return &CompletionCache{q: q, ttl: ttl}
+}
+
+// completionKey hashes everything that determines a completion: the provider, the model and the
+// request, which holds the prompt version and the rendered prompt.
+func completionKey(provider, model string, req llm.Request) (string, error) {
+	b, err := json.Marshal(struct {
+		Provider string      `json:"provider"`
+		Model    string      `json:"model"`
+		Request  llm.Request `json:"request"`
+	}{provider, model, req})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Get returns the completion stored under key unless it's expired.
+func (c *CompletionCache) Get(ctx context.Context, key string) (llm.Response, bool, error) {
+	cached, err := c.q.GetCachedCompletion(ctx, queries.GetCachedCompletionParams{
+		Key:       key,
+		CreatedAt: int(time.Now().Add(-c.ttl).Unix()),
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return llm.Response{}, false, nil
+	}
+	if err != nil {
+		return llm.Response{}, false, errors.WithStack(err)
+	}
+	var resp llm.Response
+	if err := json.Unmarshal([]byte(cached.Response), &resp); err != nil {
+		return llm.Response{}, false, errors.WithStack(err)
+	}
+	resp.Cached = true
+	return resp, true, nil
+}
+
+func (c *CompletionCache) Put(ctx context.Context, key, provider, model string, req llm.Request, resp llm.Response) error {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(c.q.UpsertCachedCompletion(ctx, queries.UpsertCachedCompletionParams{
+		Key:           key,
+		Provider:      provider,
+		Model:         model,
+		PromptVersion: req.PromptVersion,
+		Response:      string(b),
+		CreatedAt:     int(time.Now().Unix()),
+	}))
+}
+
+// DeleteExpired deletes the completions older than the TTL, returning how many were deleted.
+func (c *CompletionCache) DeleteExpired(ctx context.Context) (int64, error) {
+	n, err := c.q.DeleteExpiredCompletions(ctx, int(time.Now().Add(-c.ttl).Unix()))
+	return n, errors.WithStack(err)
+}
@@ -0,0 +1,184 @@
+// Package cassette records completions to files and replays them, so tests and demos get the
+// recorded response for each distinct request without calling a provider.
+package cassette
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/newhook/whoishiring/llm"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mode string
+
+const (
+	// Passthrough calls the provider without recording.
+	Passthrough Mode = "passthrough"
+	// Record calls the provider and records each interaction, replacing an earlier recording of the
+	// same request.
+	Record Mode = "record"
+	// Replay answers from the recordings only, requests that weren't recorded fail with ErrNotRecorded.
+	Replay Mode = "replay"
+)
+
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case Passthrough, Record, Replay:
+		return m, nil
+	}
+	return "", errors.Errorf("invalid cassette mode %s, expected passthrough, record or replay", s)
+}
+
+var ErrNotRecorded = errors.New("request not recorded")
+
+// Interaction is a recorded request and its response.
+type Interaction struct {
+	Key        string       `json:"key"`
+	Request    llm.Request  `json:"request"`
+	Response   llm.Response `json:"response"`
+	RecordedAt time.Time    `json:"recorded_at"`
+}
+
+// Cassette is an llm.LLM recording the completions of another, or replaying them, from a file.
+type Cassette struct {
+	path string
+	mode Mode
+	llm  llm.LLM
+
+	mutex        sync.Mutex
+	interactions map[string]Interaction
+}
+
+// New creates a cassette for l backed by the file at path, which is read if it exists.
+func New(path string, mode Mode, l llm.LLM) (*Cassette, error) {
+	c := &Cassette{
+		path:         path,
+		mode:         mode,
+		llm:          l,
+		interactions: map[string]Interaction{},
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var interactions []Interaction
+	if err := json.Unmarshal(b, &interactions); err != nil {
+		return nil, errors.Wrapf(err, "%s", path)
+	}
+	for _, i := range interactions {
+		c.interactions[i.Key] = i
+	}
+	return c, nil
+}
+
+// Unwrap returns the recorded llm.LLM.
+func (c *Cassette) Unwrap() llm.LLM {
+	return c.llm
+}
+
+// Key hashes everything in req that determines the completion.
+func Key(req llm.Request) (string, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (c *Cassette) Complete(ctx context.Context, req llm.Request) (llm.Response, error) {
+	return c.do(req, func() (llm.Response, error) {
+		return c.llm.Complete(ctx, req)
+	})
+}
+
+// Stream implements llm.Streamer, replayed completions are passed to delta in one chunk.
+func (c *Cassette) Stream(ctx context.Context, req llm.Request, delta func(text string)) (llm.Response, error) {
+	resp, err := c.do(req, func() (llm.Response, error) {
+		return llm.Stream(ctx, c.llm, req, delta)
+	})
+	if err == nil && c.mode == Replay {
+		delta(resp.Text)
+	}
+	return resp, err
+}
+
+func (c *Cassette) do(req llm.Request, call func() (llm.Response, error)) (llm.Response, error) {
+	if c.mode == Passthrough {
+		return call()
+	}
+	key, err := Key(req)
+	if err != nil {
+		return llm.Response{}, err
+	}
+	if c.mode == Replay {
+		c.mutex.Lock()
+		i, ok := c.interactions[key]
+		c.mutex.Unlock()
+		if !ok {
+			return llm.Response{}, errors.Wrapf(ErrNotRecorded, "%s: %s %s", filepath.Base(c.path), req.Task, key[:12])
+		}
+		return i.Response, nil
+	}
+
+	resp, err := call()
+	if err != nil {
+		return resp, err
+	}
+	return resp, c.record(Interaction{
+		Key:        key,
+		Request:    req,
+		Response:   resp,
+		RecordedAt: time.Now().UTC(),
+	})
+}
+
+// record adds i and rewrites the file. Writing a temporary file and renaming it over the cassette
+// means concurrent readers never see a partial file, and the lock keeps concurrent recordings
+// from losing each other's interactions.
+func (c *Cassette) record(i Interaction) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.interactions[i.Key] = i
+
+	interactions := make([]Interaction, 0, len(c.interactions))
+	for _, i := range c.interactions {
+		interactions = append(interactions, i)
+	}
+	// Sorted, so re-recording a cassette gives a readable diff.
+	slices.SortFunc(interactions, func(a, b Interaction) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	b, err := json.MarshalIndent(interactions, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*.tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(f.Name(), c.path))
+}
@@ -0,0 +1,107 @@
+package cassette
+
+import (
+	"context"
+	"fmt"
+	"github.com/newhook/whoishiring/llm"
+	"github.com/pkg/errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// echoLLM answers each prompt with its own text and counts its calls.
+type echoLLM struct {
+	calls atomic.Int32
+}
+
+func (e *echoLLM) Complete(_ context.Context, req llm.Request) (llm.Response, error) {
+	e.calls.Add(1)
+	return llm.Response{Text: "re: " + req.Messages[0].Content, Model: "echo"}, nil
+}
+
+func request(prompt string) llm.Request {
+	return llm.Request{
+		Task:     "test",
+		Messages: []llm.Message{{Role: "user", Content: prompt}},
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cassettes", "echo.json")
+	recorder, err := New(path, Record, &echoLLM{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prompt := range []string{"go", "rust"} {
+		if _, err := recorder.Complete(ctx, request(prompt)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l := &echoLLM{}
+	player, err := New(path, Replay, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each prompt gets its own response, whatever the order.
+	for _, prompt := range []string{"rust", "go", "rust"} {
+		resp, err := player.Complete(ctx, request(prompt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Text != "re: "+prompt {
+			t.Errorf("expected the response to %s, got %q", prompt, resp.Text)
+		}
+	}
+	var deltas []string
+	resp, err := player.Stream(ctx, request("go"), func(text string) {
+		deltas = append(deltas, text)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deltas) != 1 || deltas[0] != resp.Text {
+		t.Errorf("expected the replayed text as a single delta, got %q", deltas)
+	}
+	if l.calls.Load() != 0 {
+		t.Errorf("replay called the model %d times", l.calls.Load())
+	}
+
+	_, err = player.Complete(ctx, request("java"))
+	if !errors.Is(err, ErrNotRecorded) {
+		t.Errorf("expected ErrNotRecorded, got %v", err)
+	}
+}
+
+func TestConcurrentRecord(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "echo.json")
+	recorder, err := New(path, Record, &echoLLM{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := recorder.Complete(ctx, request(fmt.Sprint(i))); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	player, err := New(path, Replay, &echoLLM{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 20 {
+		if _, err := player.Complete(ctx, request(fmt.Sprint(i))); err != nil {
+			t.Errorf("prompt %d: %v", i, err)
+		}
+	}
+}
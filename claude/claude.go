@@ -1,244 +1,237 @@
 package claude
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
+	"github.com/newhook/whoishiring/llm"
+	"github.com/newhook/whoishiring/transport"
 	"github.com/pkg/errors"
-	"io"
 	"net/http"
 	"os"
-	"strings"
-	"text/template"
 )
 
 const (
-	ApiEndpoint = "https://api.anthropic.com/v1/messages"
-	model       = "claude-3-5-sonnet-20240620"
-	transcript  = "claude.json"
+	DefaultModel     = "claude-3-5-sonnet-20240620"
+	defaultMaxTokens = 1024
 )
 
-var apiKey = os.Getenv("ANTHROPIC_API_KEY")
+// ApiEndpoint is the messages API, a variable so tests can point it at a stub server.
+var ApiEndpoint = "https://api.anthropic.com/v1/messages"
+
+var (
+	apiKey = os.Getenv("ANTHROPIC_API_KEY")
+	client = transport.New("anthropic", transport.Limits{}, parseError)
+)
+
+// SetLimits configures the rate limits shared by all calls to the Anthropic API.
+func SetLimits(limits transport.Limits) {
+	client.SetLimits(limits)
+}
+
+func parseError(body []byte) (string, string) {
+	var resp struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", ""
+	}
+	return resp.Error.Type, resp.Error.Message
+}
 
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
 }
 
-type ApiRequest struct {
-	Model     string    `json:"model"`
-	MaxTokens int       `json:"max_tokens"`
-	Messages  []Message `json:"messages"`
+type Tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
 }
 
-type ApiResponse struct {
-	ID      string `json:"id"`
-	Type    string `json:"type"`
-	Role    string `json:"role"`
-	Model   string `json:"model"`
-	Content []struct {
-		Type string `json:"type"`
-		Text string `json:"text"`
-	} `json:"content"`
-	StopReason   string  `json:"stop_reason"`
-	StopSequence *string `json:"stop_sequence"`
-	Usage        struct {
-		InputTokens  int `json:"input_tokens"`
-		OutputTokens int `json:"output_tokens"`
-	} `json:"usage"`
+type ToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
 }
 
-func Completions(ctx context.Context, role string, fake bool, t *template.Template, context any) (*ApiResponse, error) {
-	if fake {
-		last, err := readLast(role)
-		if err != nil {
-			return nil, err
-		}
-		return &last.Response, nil
-	}
+type ApiRequest struct {
+	Model       string      `json:"model"`
+	MaxTokens   int         `json:"max_tokens"`
+	System      string      `json:"system,omitempty"`
+	Messages    []Message   `json:"messages"`
+	Temperature *float64    `json:"temperature,omitempty"`
+	Tools       []Tool      `json:"tools,omitempty"`
+	ToolChoice  *ToolChoice `json:"tool_choice,omitempty"`
+	Stream      bool        `json:"stream,omitempty"`
+}
 
-	sb := &strings.Builder{}
-	err := t.Execute(sb, context)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
+type Content struct {
+	Type  string          `json:"type"`
+	Text  string          `json:"text"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+}
 
-	messages := []Message{
-		{Role: "user", Content: sb.String()},
-	}
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
 
-	apiRequest := ApiRequest{
-		Model:     model,
-		MaxTokens: 1024,
-		Messages:  messages,
-	}
+type ApiResponse struct {
+	ID           string    `json:"id"`
+	Type         string    `json:"type"`
+	Role         string    `json:"role"`
+	Model        string    `json:"model"`
+	Content      []Content `json:"content"`
+	StopReason   string    `json:"stop_reason"`
+	StopSequence *string   `json:"stop_sequence"`
+	Usage        Usage     `json:"usage"`
+}
 
-	requestBody, err := json.Marshal(apiRequest)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
+// Client implements llm.LLM with the Anthropic messages API.
+type Client struct {
+	Model string
+}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", ApiEndpoint, bytes.NewBuffer(requestBody))
-	if err != nil {
-		return nil, errors.WithStack(err)
+func (c *Client) Complete(ctx context.Context, r llm.Request) (llm.Response, error) {
+	apiRequest, tokens := c.newRequest(r)
+	var apiResponse ApiResponse
+	if err := client.PostJSON(ctx, ApiEndpoint, header(), apiRequest, tokens, &apiResponse); err != nil {
+		return llm.Response{}, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-API-Key", apiKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
+	return toResponse(&apiResponse)
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// Stream implements llm.Streamer with the messages API's server-sent events. With a Schema, the deltas
+// are the tool input JSON as it's generated.
+func (c *Client) Stream(ctx context.Context, r llm.Request, delta func(text string)) (llm.Response, error) {
+	apiRequest, tokens := c.newRequest(r)
+	apiRequest.Stream = true
+	resp, err := client.PostStream(ctx, ApiEndpoint, header(), apiRequest, tokens)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return llm.Response{}, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("error response from the embedding API: " + resp.Status)
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-
 	var apiResponse ApiResponse
-	err = json.Unmarshal(body, &apiResponse)
+	var partialJSON []byte
+	err = transport.ReadEvents(resp.Body, func(event, data string) error {
+		var e struct {
+			Message      ApiResponse `json:"message"`
+			Index        int         `json:"index"`
+			ContentBlock Content     `json:"content_block"`
+			Delta        struct {
+				Type        string `json:"type"`
+				Text        string `json:"text"`
+				PartialJSON string `json:"partial_json"`
+				StopReason  string `json:"stop_reason"`
+			} `json:"delta"`
+			Usage Usage `json:"usage"`
+			Error struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return errors.Wrapf(err, "invalid %s event", event)
+		}
+		switch event {
+		case "message_start":
+			apiResponse = e.Message
+		case "content_block_start":
+			apiResponse.Content = append(apiResponse.Content, e.ContentBlock)
+			partialJSON = nil
+		case "content_block_delta":
+			if e.Index >= len(apiResponse.Content) {
+				return errors.Errorf("delta for unknown content block %d", e.Index)
+			}
+			switch e.Delta.Type {
+			case "text_delta":
+				apiResponse.Content[e.Index].Text += e.Delta.Text
+				delta(e.Delta.Text)
+			case "input_json_delta":
+				partialJSON = append(partialJSON, e.Delta.PartialJSON...)
+				delta(e.Delta.PartialJSON)
+			}
+		case "content_block_stop":
+			if e.Index < len(apiResponse.Content) && apiResponse.Content[e.Index].Type == "tool_use" {
+				apiResponse.Content[e.Index].Input = partialJSON
+			}
+		case "message_delta":
+			apiResponse.StopReason = e.Delta.StopReason
+			apiResponse.Usage.OutputTokens = e.Usage.OutputTokens
+		case "error":
+			return errors.Errorf("stream failed: %s: %s", e.Error.Type, e.Error.Message)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return llm.Response{}, err
 	}
 
-	if err := appendTranscript(RequestResponse{
-		Role:     role,
-		Request:  apiRequest,
-		Response: apiResponse,
-	}); err != nil {
-		return nil, err
-	}
-
-	return &apiResponse, nil
-}
-
-func parseJsonResponse1[T any](choice string, result T) error {
-	if err := json.Unmarshal([]byte(choice), result); err != nil {
-		return err
-	}
-	return nil
-}
-func parseJsonResponse2[T any](choice string, result T) error {
-	text := choice
-	i := strings.Index(choice, "[")
-	if i == -1 {
-		return errors.Errorf("could not find boundary")
-	}
-	text = choice[i+1:]
-	i = strings.LastIndex(text, "]")
-	if i == -1 {
-		return errors.Errorf("could not find boundary")
-	}
-	text = text[:i]
-	if err := json.Unmarshal([]byte("["+text+"]"), result); err == nil {
-		return err
-	}
-	return nil
+	return toResponse(&apiResponse)
 }
 
-func parseJsonResponse3[T any](choice string, result T) error {
-	// XXX: use re.
-	text := choice
-	boundary := "```"
-	i := strings.Index(text, boundary)
-	if i == -1 {
-		return errors.Errorf("could not find boundary")
-	}
-	text = text[i+3:]
-	i = strings.Index(text, boundary)
-	if i == -1 {
-		return errors.Errorf("could not find boundary")
-	}
-	text = text[:i]
-	fmt.Println(text)
-	if !strings.HasPrefix(text, "json") {
-		return errors.Errorf("expected json")
-	}
-	text = text[4:]
-	if err := json.Unmarshal([]byte(text), result); err != nil {
-		return err
-	}
-	return nil
-}
-func parseJsonResponse4[T any](choice string, result T) error {
-	var response struct {
-		Content T `json:"search_text"`
-	}
-	if err := json.Unmarshal([]byte(choice), &response); err != nil {
-		return err
-	}
-	result = response.Content
-	return nil
-}
-func ParseJsonResponse[T any](choice string, result T) error {
-	if err := parseJsonResponse1(choice, result); err == nil {
-		return nil
-	}
-	if err := parseJsonResponse2(choice, result); err == nil {
-		return nil
-	}
-	if err := parseJsonResponse3(choice, result); err == nil {
-		return nil
-	}
-	if err := parseJsonResponse4(choice, result); err == nil {
-		return nil
-	}
-	return errors.New("could not parse json response")
+// newRequest converts r, returning the estimated prompt tokens for rate limiting along with it.
+func (c *Client) newRequest(r llm.Request) (ApiRequest, int) {
+	apiRequest := ApiRequest{
+		Model:       c.Model,
+		MaxTokens:   r.MaxTokens,
+		System:      r.System,
+		Temperature: r.Temperature,
+	}
+	if apiRequest.MaxTokens == 0 {
+		apiRequest.MaxTokens = defaultMaxTokens
+	}
+	tokens := transport.EstimateTokens(r.System)
+	for _, m := range r.Messages {
+		apiRequest.Messages = append(apiRequest.Messages, Message{Role: m.Role, Content: m.Content})
+		tokens += transport.EstimateTokens(m.Content)
+	}
+	if r.Schema != nil {
+		// Forcing the use of a tool whose input is the schema is how Claude does structured output.
+		apiRequest.Tools = []Tool{{
+			Name:        r.Schema.Name,
+			Description: r.Schema.Description,
+			InputSchema: r.Schema.Schema,
+		}}
+		apiRequest.ToolChoice = &ToolChoice{Type: "tool", Name: r.Schema.Name}
+	}
+	return apiRequest, tokens
 }
 
-type RequestResponse struct {
-	Role     string      `json:"role"`
-	Request  ApiRequest  `json:"request"`
-	Response ApiResponse `json:"response"`
+func header() http.Header {
+	header := http.Header{}
+	header.Set("X-API-Key", apiKey)
+	header.Set("anthropic-version", "2023-06-01")
+	return header
 }
 
-func readLast(role string) (RequestResponse, error) {
-	file, err := os.Open(transcript)
-	if err != nil {
-		return RequestResponse{}, errors.WithStack(err)
-	}
-	defer file.Close()
-
-	decoder := json.NewDecoder(file)
-	var last RequestResponse
-	for decoder.More() {
-		var obj RequestResponse
-		err := decoder.Decode(&obj)
-		if err != nil {
-			return RequestResponse{}, errors.WithStack(err)
-		}
-		if obj.Role == role {
-			last = obj
+func toResponse(r *ApiResponse) (llm.Response, error) {
+	if len(r.Content) == 0 {
+		return llm.Response{}, errors.New("no content in the response")
+	}
+	resp := llm.Response{
+		Model: r.Model,
+		Usage: llm.Usage{
+			InputTokens:  r.Usage.InputTokens,
+			OutputTokens: r.Usage.OutputTokens,
+		},
+	}
+	if r.StopReason == "max_tokens" {
+		return llm.Response{}, errors.Errorf("response truncated after %d output tokens", r.Usage.OutputTokens)
+	}
+	// With forced tool use the tool call carries the structured output, any text before it is commentary.
+	for _, content := range r.Content {
+		if content.Type == "tool_use" {
+			resp.Text = string(content.Input)
+			return resp, nil
 		}
 	}
-	return last, nil
-}
-
-func appendTranscript(r RequestResponse) error {
-	b, err := json.Marshal(r)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	file, err := os.OpenFile(transcript, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	if _, err := file.Write(b); err != nil {
-		return errors.WithStack(err)
-	}
-	if _, err := file.WriteString("\n"); err != nil {
-		return errors.WithStack(err)
-	}
-
-	return nil
+	resp.Text = r.Content[len(r.Content)-1].Text
+	return resp, nil
 }
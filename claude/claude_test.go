@@ -0,0 +1,83 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/newhook/whoishiring/llm"
+	"github.com/newhook/whoishiring/transport"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useStubServer points the client at a server answering each decoded request with handle.
+func useStubServer(t *testing.T, handle func(req ApiRequest) (int, any)) {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ApiRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status, body := handle(req)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(s.Close)
+	endpoint := ApiEndpoint
+	ApiEndpoint = s.URL + "/v1/messages"
+	t.Cleanup(func() { ApiEndpoint = endpoint })
+}
+
+func TestCompleteWithSchema(t *testing.T) {
+	var got ApiRequest
+	useStubServer(t, func(req ApiRequest) (int, any) {
+		got = req
+		return http.StatusOK, ApiResponse{
+			Model: req.Model,
+			Content: []Content{
+				{Type: "text", Text: "Here are the terms."},
+				{Type: "tool_use", Name: "terms", Input: json.RawMessage(`{"terms":["go"]}`)},
+			},
+			StopReason: "tool_use",
+			Usage:      Usage{InputTokens: 12, OutputTokens: 5},
+		}
+	})
+
+	c := &Client{Model: DefaultModel}
+	resp, err := c.Complete(context.Background(), llm.Request{
+		Task:     "terms",
+		Messages: []llm.Message{{Role: "user", Content: "remote Go jobs"}},
+		Schema:   &llm.Schema{Name: "terms", Schema: json.RawMessage(`{"type":"object"}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.ToolChoice == nil || got.ToolChoice.Name != "terms" || len(got.Tools) != 1 {
+		t.Errorf("expected forced tool use, got %+v", got)
+	}
+	if resp.Text != `{"terms":["go"]}` || resp.Usage.InputTokens != 12 || resp.Usage.OutputTokens != 5 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestCompleteError(t *testing.T) {
+	useStubServer(t, func(req ApiRequest) (int, any) {
+		return http.StatusBadRequest, map[string]any{
+			"type":  "error",
+			"error": map[string]string{"type": "invalid_request_error", "message": "max_tokens: too large"},
+		}
+	})
+
+	c := &Client{Model: DefaultModel}
+	_, err := c.Complete(context.Background(), llm.Request{
+		Messages: []llm.Message{{Role: "user", Content: "hello"}},
+	})
+	var te *transport.Error
+	if !errors.As(err, &te) || te.Provider != "anthropic" || te.Type != "invalid_request_error" || te.Message != "max_tokens: too large" {
+		t.Errorf("expected the Anthropic error, got %v", err)
+	}
+}
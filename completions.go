@@ -2,135 +2,422 @@ package main
 
 import (
 	"context"
-	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/newhook/whoishiring/cassette"
 	"github.com/newhook/whoishiring/claude"
+	"github.com/newhook/whoishiring/llm"
+	"github.com/newhook/whoishiring/ollama"
 	"github.com/newhook/whoishiring/openai"
 	"github.com/pkg/errors"
-	"text/template"
+	"path/filepath"
+	"strings"
+	"sync"
 )
 
-//go:embed prompts/job_search.tmpl
-var jobSearchPrompt string
-
-//go:embed prompts/search_terms.tmpl
-var searchTermsPrompt string
-
-//go:embed prompts/analyze_resume.tmpl
-var analyzeResumePrompt string
-
-var (
-	analyzeResumeTemplate = template.Must(template.New("analyze_resume").Parse(analyzeResumePrompt))
-	searchTermsTemplate   = template.Must(template.New("search_terms").Parse(searchTermsPrompt))
-	jobSearchTemplate     = template.Must(template.New("jobSearch").Parse(jobSearchPrompt))
-)
+const systemPrompt = "You are job search assistant. Don't explain anything. Provide all results in json"
 
 type Completion struct {
-	Model         string
-	AnalyzeResume func(ctx context.Context, context any) (string, error)
-	GetTerms      func(ctx context.Context, context any) ([]string, error)
-	GetJobs       func(ctx context.Context, context any) ([]string, error)
+	Model string
+	LLM   llm.LLM
 }
 
 const (
 	Claude = "claude"
 	OpenAI = "openai"
+	Ollama = "ollama"
+)
+
+var (
+	claudeClient = &claude.Client{Model: claude.DefaultModel}
+	openaiClient = &openai.Client{Model: openai.DefaultModel}
+	ollamaClient = &ollama.Client{Model: ollama.DefaultChatModel}
 )
 
 var completions = map[string]Completion{
 	Claude: {
 		Model: Claude,
-		AnalyzeResume: func(ctx context.Context, context any) (string, error) {
-			var term string
-			resp, err := claude.Completions(ctx, "resume", *fake, analyzeResumeTemplate, context)
-			if err != nil {
-				return "", errors.WithStack(err)
-			}
-			choice := resp.Content[len(resp.Content)-1]
-			if err := claude.ParseJsonResponse(choice.Text, &term); err != nil {
-				return "", errors.WithStack(err)
-			}
-			return term, nil
-		},
-		GetTerms: func(ctx context.Context, context any) ([]string, error) {
-			var terms []string
-			resp, err := claude.Completions(ctx, "terms", *fake, searchTermsTemplate, context)
-			if err != nil {
-				return nil, errors.WithStack(err)
-			}
-			choice := resp.Content[len(resp.Content)-1]
-			if err := claude.ParseJsonResponse(choice.Text, &terms); err != nil {
-				return nil, errors.WithStack(err)
-			}
-			return terms, nil
-		},
-		GetJobs: func(ctx context.Context, context any) ([]string, error) {
-			var jobIDs []string
-			r2, err := claude.Completions(ctx, "job_search", *fake, jobSearchTemplate, context)
-			if err != nil {
-				return nil, errors.WithStack(err)
-			}
-			choice := r2.Content[len(r2.Content)-1]
-			if err := claude.ParseJsonResponse(choice.Text, &jobIDs); err != nil {
-				return nil, errors.WithStack(err)
-			}
-			return jobIDs, nil
-		},
+		LLM:   claudeClient,
 	},
 	OpenAI: {
 		Model: OpenAI,
-		AnalyzeResume: func(ctx context.Context, context any) (string, error) {
-			var term string
-			resp, err := openai.Completions(ctx, "terms", *fake, analyzeResumeTemplate, context)
-			if err != nil {
-				return "", errors.WithStack(err)
-			}
-			choice := resp.Choices[len(resp.Choices)-1]
-			if err := openai.ParseJsonResponse(choice, &term); err != nil {
-				return "", errors.WithStack(err)
-			}
-			return term, nil
-		},
-		GetTerms: func(ctx context.Context, context any) ([]string, error) {
-			var terms []string
-			resp, err := openai.Completions(ctx, "terms", *fake, searchTermsTemplate, context)
-			if err != nil {
-				return nil, errors.WithStack(err)
-			}
-			choice := resp.Choices[len(resp.Choices)-1]
-			if err := openai.ParseJsonResponse(choice, &terms); err != nil {
-				return nil, errors.WithStack(err)
-			}
-			return terms, nil
-		},
-		GetJobs: func(ctx context.Context, context any) ([]string, error) {
-			var jobIDs []string
-			r2, err := openai.Completions(ctx, "job_search", *fake, jobSearchTemplate, context)
-			if err != nil {
-				return nil, errors.WithStack(err)
-			}
-			if err := openai.ParseJsonResponse(r2.Choices[len(r2.Choices)-1], &jobIDs); err != nil {
-				return nil, errors.WithStack(err)
-			}
-			return jobIDs, nil
-		},
+		LLM:   openaiClient,
+	},
+	Ollama: {
+		Model: Ollama,
+		LLM:   ollamaClient,
 	},
 }
 
+// ValidateCompletionModel checks a completion model, or a comma separated chain of them.
 func ValidateCompletionModel(s string) error {
-	if _, ok := completions[s]; ok {
+	for _, model := range strings.Split(s, ",") {
+		if _, ok := completions[model]; !ok {
+			return errors.Errorf("invalid completion model: %s", model)
+		}
+	}
+	return nil
+}
+
+// useCassettes wraps every completion model in a cassette recorded in dir/<model>.json, unless mode is
+// passthrough.
+func useCassettes(dir string, mode cassette.Mode) error {
+	if mode == cassette.Passthrough {
 		return nil
 	}
-	return errors.Errorf("invalid completion model: %s", s)
+	for name, c := range completions {
+		cc, err := cassette.New(filepath.Join(dir, name+".json"), mode, c.LLM)
+		if err != nil {
+			return err
+		}
+		c.LLM = cc
+		completions[name] = c
+	}
+	return nil
+}
+
+// task is a completion whose output is a JSON object conforming to schema.
+type task struct {
+	name   string
+	prompt string
+	schema llm.Schema
+}
+
+var (
+	analyzeResumeTask = task{
+		name:   "resume",
+		prompt: analyzeResumePrompt,
+		schema: llm.Schema{
+			Name:        "resume_summary",
+			Description: "A job search prompt summarizing the resume.",
+			Schema: json.RawMessage(`{
+				"type": "object",
+				"properties": {"summary": {"type": "string"}},
+				"required": ["summary"],
+				"additionalProperties": false
+			}`),
+		},
+	}
+	searchTermsTask = task{
+		name:   "terms",
+		prompt: searchTermsPrompt,
+		schema: llm.Schema{
+			Name:        "search_terms",
+			Description: "Search terms for the vector database.",
+			Schema: json.RawMessage(`{
+				"type": "object",
+				"properties": {"terms": {"type": "array", "items": {"type": "string"}, "minItems": 1}},
+				"required": ["terms"],
+				"additionalProperties": false
+			}`),
+		},
+	}
+	jobSearchTask = task{
+		name:   "job_search",
+		prompt: jobSearchPrompt,
+		schema: llm.Schema{
+			Name:        "job_search",
+			Description: "The best matching jobs, best match first, and why they match.",
+			Schema: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"jobs": {
+						"type": "array",
+						"items": {
+							"type": "object",
+							"properties": {
+								"id": {"type": "integer"},
+								"rationale": {"type": "string"},
+								"matched_requirements": {"type": "array", "items": {"type": "string"}},
+								"concerns": {"type": "array", "items": {"type": "string"}},
+								"score": {"type": "integer", "minimum": 1, "maximum": 10}
+							},
+							"required": ["id", "rationale", "matched_requirements", "concerns", "score"],
+							"additionalProperties": false
+						}
+					}
+				},
+				"required": ["jobs"],
+				"additionalProperties": false
+			}`),
+		},
+	}
+	// candidateTermsTask and candidateSearchTask are searchTermsTask and jobSearchTask for employers,
+	// searching for job seekers matching a job description.
+	candidateTermsTask = task{
+		name:   "candidate_terms",
+		prompt: candidateTermsPrompt,
+		schema: searchTermsTask.schema,
+	}
+	candidateSearchTask = task{
+		name:   "candidate_search",
+		prompt: candidateSearchPrompt,
+		schema: llm.Schema{
+			Name:        "candidate_search",
+			Description: "The best fitting job seekers, best fit first, and why they fit.",
+			Schema:      jobSearchTask.schema.Schema,
+		},
+	}
+	refineTask = task{
+		name:   "refine",
+		prompt: refineSearchPrompt,
+		schema: llm.Schema{
+			Name:        "refine_search",
+			Description: "The job search revised for a follow-up instruction.",
+			Schema: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"prompt": {"type": "string"},
+					"terms": {"type": "array", "items": {"type": "string"}, "minItems": 1},
+					"like": {"type": "array", "items": {"type": "integer"}},
+					"exclude": {"type": "array", "items": {"type": "integer"}},
+					"months": {"type": "integer", "minimum": 0, "maximum": 6}
+				},
+				"required": ["prompt", "terms", "like", "exclude", "months"],
+				"additionalProperties": false
+			}`),
+		},
+	}
+	// candidateRefineTask is refineTask for employers, revising a search for job seekers.
+	candidateRefineTask = task{
+		name:   "candidate_refine",
+		prompt: candidateRefinePrompt,
+		schema: llm.Schema{
+			Name:        "candidate_refine",
+			Description: "The search for job seekers revised for a follow-up instruction.",
+			Schema:      refineTask.schema.Schema,
+		},
+	}
+)
+
+// repairPrompt asks the model to fix output that didn't conform to the schema.
+const repairPrompt = "Your response is invalid: %v. Respond again, following the schema exactly."
+
+// deltaFunc receives the output of a streamed completion as it's generated. attempt counts the
+// completions of a task, the output of a later attempt, the repair retry or the next provider of the
+// chain, replaces the earlier ones.
+type deltaFunc func(attempt int, text string)
+
+// completer runs the completions of a single job search.
+type completer struct {
+	prompts PromptSet
+	// cache is nil when the completion cache is disabled or bypassed.
+	cache *CompletionCache
+	meter *Meter
+
+	providers providersUsed
+
+	mutex sync.Mutex
+	// calls and hits count the completions and cache hits by task.
+	calls map[string]int
+	hits  map[string]int
+}
+
+func newCompleter(prompts PromptSet, cache *CompletionCache, meter *Meter) *completer {
+	return &completer{
+		prompts: prompts,
+		cache:   cache,
+		meter:   meter,
+		calls:   map[string]int{},
+		hits:    map[string]int{},
+	}
+}
+
+func (c *completer) record(task string, hit bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.calls[task]++
+	if hit {
+		c.hits[task]++
+	}
+}
+
+// cached reports whether all completions of task were served from the cache.
+func (c *completer) cached(task string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.calls[task] > 0 && c.hits[task] == c.calls[task]
+}
+
+// modelName returns the model a completion provider is configured with, for the cache key.
+func modelName(l llm.LLM) string {
+	switch l := l.(type) {
+	case *cassette.Cassette:
+		return modelName(l.Unwrap())
+	case *claude.Client:
+		return l.Model
+	case *openai.Client:
+		return l.Model
+	case *ollama.Client:
+		return l.Model
+	}
+	return ""
+}
+
+// complete renders the task's prompt with context, sends it to the task's completion models in order
+// until one is available, and decodes the structured output into a T. Output not matching the schema
+// gets a single retry, showing the model what was wrong, before failing with an llm.InvalidOutputError.
+// The completion is streamed to delta unless it's nil. Valid output is cached under the first request,
+// so a cache hit skips the retry as well.
+func complete[T any](ctx context.Context, cr *completer, t task, context any, delta deltaFunc) (T, error) {
+	var result T
+	p := cr.prompts[t.prompt]
+	sb := &strings.Builder{}
+	if err := p.Template.Execute(sb, context); err != nil {
+		return result, errors.WithStack(err)
+	}
+	req := llm.Request{
+		Task:   t.name,
+		System: systemPrompt,
+		Messages: []llm.Message{
+			{Role: "user", Content: sb.String()},
+		},
+		Schema:        &t.schema,
+		PromptVersion: p.Version,
+	}
+
+	attempt := 0
+	provider, err := withFailover(ctx, CompletionEndpoint, completionChain(t.name), func(name string) error {
+		var err error
+		result, err = completeWith[T](ctx, cr, t, completions[name], req, &attempt, delta)
+		return err
+	})
+	if err != nil {
+		return result, err
+	}
+	cr.providers.add(t.name, provider)
+	return result, nil
+}
+
+// completeWith is complete with a single completion model.
+func completeWith[T any](ctx context.Context, cr *completer, t task, c Completion, req llm.Request, attempt *int, delta deltaFunc) (T, error) {
+	var result T
+	model := modelName(c.LLM)
+	var key string
+	if cr.cache != nil {
+		var err error
+		key, err = completionKey(c.Model, model, req)
+		if err != nil {
+			return result, err
+		}
+		resp, ok, err := cr.cache.Get(ctx, key)
+		if err != nil {
+			return result, err
+		}
+		// Output that no longer decodes, e.g. after a change to T, is a miss.
+		if ok && decode(&t.schema, resp.Text, &result) == nil {
+			cr.record(t.name, true)
+			if delta != nil {
+				*attempt++
+				delta(*attempt, resp.Text)
+			}
+			return result, nil
+		}
+	}
+	cr.record(t.name, false)
+	cacheReq := req
+
+	send := func() (llm.Response, error) {
+		if err := cr.meter.Allow(ctx, CompletionEndpoint); err != nil {
+			return llm.Response{}, err
+		}
+		var resp llm.Response
+		var err error
+		if delta == nil {
+			resp, err = c.LLM.Complete(ctx, req)
+		} else {
+			*attempt++
+			n := *attempt
+			resp, err = llm.Stream(ctx, c.LLM, req, func(text string) { delta(n, text) })
+		}
+		if err != nil {
+			return resp, err
+		}
+		// Output that fails validation is billed all the same.
+		m := resp.Model
+		if m == "" {
+			m = model
+		}
+		return resp, cr.meter.Record(ctx, CompletionEndpoint, c.Model, m, t.name, resp.Usage)
+	}
+	put := func(resp llm.Response) error {
+		if cr.cache == nil {
+			return nil
+		}
+		return cr.cache.Put(ctx, key, c.Model, model, cacheReq, resp)
+	}
+
+	resp, err := send()
+	if err != nil {
+		return result, errors.Wrapf(err, "%s", t.name)
+	}
+	err = decode(&t.schema, resp.Text, &result)
+	if err == nil {
+		return result, put(resp)
+	}
+	req.Messages = append(req.Messages,
+		llm.Message{Role: "assistant", Content: resp.Text},
+		llm.Message{Role: "user", Content: fmt.Sprintf(repairPrompt, err)},
+	)
+
+	resp, err = send()
+	if err != nil {
+		return result, errors.Wrapf(err, "%s", t.name)
+	}
+	if err := decode(&t.schema, resp.Text, &result); err != nil {
+		return result, &llm.InvalidOutputError{
+			Task:   t.name,
+			Model:  c.Model,
+			Output: resp.Text,
+			Err:    err,
+		}
+	}
+	return result, put(resp)
+}
+
+func decode(schema *llm.Schema, text string, result any) error {
+	if err := schema.Validate([]byte(text)); err != nil {
+		return err
+	}
+	return errors.WithStack(json.Unmarshal([]byte(text), result))
+}
+
+func (c *completer) AnalyzeResume(ctx context.Context, context any) (string, error) {
+	result, err := complete[struct {
+		Summary string `json:"summary"`
+	}](ctx, c, analyzeResumeTask, context, nil)
+	return result.Summary, err
+}
+
+// GetTerms returns search terms for prompt, with searchTermsTask or candidateTermsTask.
+func (c *completer) GetTerms(ctx context.Context, t task, prompt string, prefs preferences) ([]string, error) {
+	result, err := complete[struct {
+		Terms []string `json:"terms"`
+	}](ctx, c, t, termsContext{Prompt: prompt, preferences: prefs}, nil)
+	return result.Terms, err
 }
 
-func AnalyzeResume(ctx context.Context, context any) (string, error) {
-	return completions[*completionModel].AnalyzeResume(ctx, context)
+// Refine revises a search with refineTask or candidateRefineTask.
+func (c *completer) Refine(ctx context.Context, t task, context any) (refinement, error) {
+	return complete[refinement](ctx, c, t, context, nil)
 }
 
-func GetTerms(ctx context.Context, context any) ([]string, error) {
-	return completions[*completionModel].GetTerms(ctx, context)
+// Pick is a job chosen by the completion model, with the reasons for choosing it.
+type Pick struct {
+	ID                  int      `json:"id"`
+	Rationale           string   `json:"rationale"`
+	MatchedRequirements []string `json:"matched_requirements"`
+	Concerns            []string `json:"concerns"`
+	// Score is how well the job fits, from 1 to 10.
+	Score int `json:"score"`
+	// Candidate are the fields of a job seeker's comment, for employer searches.
+	Candidate *Candidate `json:"candidate,omitempty"`
 }
 
-func GetJobs(ctx context.Context, context any) ([]string, error) {
-	return completions[*completionModel].GetJobs(ctx, context)
+// GetJobs returns the picks of jobSearchTask or candidateSearchTask.
+func (c *completer) GetJobs(ctx context.Context, t task, context any, delta deltaFunc) ([]Pick, error) {
+	result, err := complete[struct {
+		Jobs []Pick `json:"jobs"`
+	}](ctx, c, t, context, delta)
+	return result.Jobs, err
 }
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"embed"
+	"fmt"
+	"github.com/pkg/errors"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+//go:embed notifications/*.tmpl
+var notificationTemplates embed.FS
+
+var digestTemplates = template.Must(template.ParseFS(notificationTemplates, "notifications/*.tmpl"))
+
+// emailNotifier emails the alerts as a digest to the target address, through the -smtp server.
+type emailNotifier struct{}
+
+func (emailNotifier) Validate(target string) error {
+	if *smtpAddr == "" || *smtpFrom == "" {
+		return errors.New("email digests require -smtp and -smtp-from")
+	}
+	if _, err := mail.ParseAddress(target); err != nil {
+		return errors.Errorf("invalid email address %q", target)
+	}
+	return nil
+}
+
+func (emailNotifier) Notify(ctx context.Context, l *slog.Logger, target string, alert Alert) error {
+	msg, err := digestMessage(*smtpFrom, target, alert, time.Now())
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(*smtpFrom)
+	if err != nil {
+		return errors.Wrapf(err, "invalid -smtp-from address %q", *smtpFrom)
+	}
+	to, err := mail.ParseAddress(target)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := sendMail(ctx, *smtpAddr, from.Address, to.Address, msg); err != nil {
+		return errors.Wrapf(err, "couldn't email %s", to.Address)
+	}
+	l.Info("emailed digest", slog.String("search", alert.Search.ID), slog.Int("matches", len(alert.Matches)))
+	return nil
+}
+
+// smtpTimeout bounds sending an email, when the context has no earlier deadline.
+const smtpTimeout = 30 * time.Second
+
+// sendMail is smtp.SendMail within ctx: the connection's deadline is the context's, so a server that
+// stops responding doesn't hold up the refresh.
+func sendMail(ctx context.Context, addr, from, to string, msg []byte) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrapf(err, "invalid -smtp address %q", addr)
+	}
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return errors.WithStack(err)
+	}
+	// Cancelling the context interrupts the conversation too.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return errors.WithStack(err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if *smtpUsername != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("the SMTP server doesn't support authentication")
+		}
+		if err := c.Auth(smtp.PlainAuth("", *smtpUsername, os.Getenv("SMTP_PASSWORD"), host)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := c.Rcpt(to); err != nil {
+		return errors.WithStack(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := w.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(c.Quit())
+}
+
+// digest is the data of the digest templates.
+type digest struct {
+	ID     string
+	Name   string
+	Prompt string
+	// Every is how often the digest is sent, e.g. "every 7 days".
+	Every    string
+	Seekers  bool
+	Count    int
+	Postings []digestPosting
+}
+
+type digestPosting struct {
+	Rank int
+	Link string
+	// Title is the first line of the comment, shown when it has no company.
+	Title      string
+	Company    string
+	Location   string
+	Date       string
+	Score      int
+	Similarity float32
+	Rationale  string
+	Concerns   []string
+}
+
+// locationPart matches the part of a hiring comment's first line that is its location, e.g. "REMOTE (US)"
+// or "ONSITE New York".
+var locationPart = regexp.MustCompile(`(?i)\b(remote|onsite|on-site|hybrid|in-office|on site)\b`)
+
+// postingFields returns the company and location of a comment. Hiring comments start with a line like
+// "Company | Role | Location | Full-time" by convention, job seekers' have a "Location:" field.
+func postingFields(m Match) (title, company, location string) {
+	title = firstLine(m.Text)
+	if m.Pick.Candidate != nil {
+		return title, "", m.Pick.Candidate.Location
+	}
+	parts := strings.Split(title, "|")
+	if len(parts) < 2 {
+		return title, "", ""
+	}
+	company = strings.TrimSpace(parts[0])
+	for _, part := range parts[1:] {
+		if locationPart.MatchString(part) {
+			location = strings.TrimSpace(part)
+			break
+		}
+	}
+	return title, company, location
+}
+
+func newDigest(alert Alert) digest {
+	s := alert.Search
+	d := digest{
+		ID:      s.ID,
+		Name:    s.Name,
+		Prompt:  s.JobPrompt,
+		Every:   "at each refresh",
+		Seekers: s.SearchType == SearchType_WhoWantToBeHired,
+		Count:   len(alert.Matches),
+	}
+	if d.Name == "" {
+		d.Name = fmt.Sprintf("saved search %s", s.ID)
+	}
+	if s.Every > 0 {
+		d.Every = fmt.Sprintf("every %s", everyText(s.Every))
+	}
+	for i, m := range alert.Matches {
+		title, company, location := postingFields(m)
+		d.Postings = append(d.Postings, digestPosting{
+			Rank:       i + 1,
+			Link:       m.Link,
+			Title:      title,
+			Company:    company,
+			Location:   location,
+			Date:       time.Unix(int64(m.Time), 0).UTC().Format("January 2, 2006"),
+			Score:      m.Pick.Score,
+			Similarity: m.Similarity,
+			Rationale:  m.Pick.Rationale,
+			Concerns:   m.Pick.Concerns,
+		})
+	}
+	return d
+}
+
+// everyText formats an interval in days when it's a whole number of them, e.g. "7 days".
+func everyText(every time.Duration) string {
+	const day = 24 * time.Hour
+	switch {
+	case every == day:
+		return "day"
+	case every%day == 0:
+		return fmt.Sprintf("%d days", every/day)
+	default:
+		return every.String()
+	}
+}
+
+// renderDigest returns the plain text and HTML bodies of d.
+func renderDigest(d digest) (string, string, error) {
+	var text, html bytes.Buffer
+	if err := digestTemplates.ExecuteTemplate(&text, "digest.txt.tmpl", d); err != nil {
+		return "", "", errors.WithStack(err)
+	}
+	if err := digestTemplates.ExecuteTemplate(&html, "digest.html.tmpl", d); err != nil {
+		return "", "", errors.WithStack(err)
+	}
+	return text.String(), html.String(), nil
+}
+
+// digestMessage returns the email of the digest of alert, with plain text and HTML alternatives.
+func digestMessage(from, to string, alert Alert, now time.Time) ([]byte, error) {
+	d := newDigest(alert)
+	text, html, err := renderDigest(d)
+	if err != nil {
+		return nil, err
+	}
+	subject := fmt.Sprintf("%d new matches for %s", d.Count, d.Name)
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		qp := quotedprintable.NewWriter(pw)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if err := qp.Close(); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var msg bytes.Buffer
+	for _, header := range [][2]string{
+		{"From", from},
+		{"To", to},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + w.Boundary()},
+	} {
+		fmt.Fprintf(&msg, "%s: %s\r\n", header[0], header[1])
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func testAlert() Alert {
+	return Alert{
+		Search: &SavedSearch{
+			ID:         "0123456789abcdef",
+			Name:       "Go & Kubernetes",
+			SearchType: SearchType_WhoIsHiring,
+			JobPrompt:  "Remote Go backend engineer, distributed systems <no crypto>",
+			Every:      7 * 24 * time.Hour,
+		},
+		Matches: []Match{
+			{
+				ID:         1001,
+				Link:       "https://news.ycombinator.com/item?id=1001",
+				Text:       "Acme Payments | Senior Backend Engineer | REMOTE (US) | Full-time<p>We build payment infrastructure in Go and PostgreSQL.",
+				Time:       1717243200,
+				Similarity: 0.8123,
+				Pick: Pick{
+					ID:                  1001,
+					Rationale:           "Go & distributed systems, fully remote.",
+					MatchedRequirements: []string{"Go", "remote"},
+					Concerns:            []string{"US only, you're in the EU"},
+					Score:               9,
+				},
+			},
+			{
+				ID:         1005,
+				Link:       "https://news.ycombinator.com/item?id=1005",
+				Text:       "Infra Cloud &lt;SRE&gt; - we're hiring<p>Kubernetes, Terraform and Go.",
+				Time:       1717329600,
+				Similarity: 0.74,
+				Pick: Pick{
+					ID:        1005,
+					Rationale: "Kubernetes and Go, site reliability rather than backend.",
+					Concerns:  []string{},
+					Score:     7,
+				},
+			},
+		},
+	}
+}
+
+// golden compares got with testdata/name, or updates it with -update.
+func golden(t *testing.T, name string, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("%s doesn't match, run with -update if the change is intended:\n%s", path, got)
+	}
+}
+
+func TestRenderDigest(t *testing.T) {
+	text, html, err := renderDigest(newDigest(testAlert()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "digest.txt.golden", text)
+	golden(t, "digest.html.golden", html)
+}
+
+func TestPostingFields(t *testing.T) {
+	for _, c := range []struct {
+		match             Match
+		company, location string
+	}{
+		{Match{Text: "Pixel Studio | Frontend Engineer | ONSITE New York | Full-time<p>React."}, "Pixel Studio", "ONSITE New York"},
+		{Match{Text: "DeepML | Machine Learning Engineer | Hybrid London"}, "DeepML", "Hybrid London"},
+		{Match{Text: "We're hiring Go engineers, email me"}, "", ""},
+		{Match{Text: "Location: Berlin<p>Remote: Yes", Pick: Pick{Candidate: &Candidate{Location: "Berlin"}}}, "", "Berlin"},
+	} {
+		_, company, location := postingFields(c.match)
+		if company != c.company || location != c.location {
+			t.Errorf("expected %q and %q for %q, got %q and %q", c.company, c.location, c.match.Text, company, location)
+		}
+	}
+}
+
+// smtpSink is an SMTP server accepting every message, for testing.
+type smtpSink struct {
+	ln       net.Listener
+	messages chan sinkMessage
+}
+
+type sinkMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &smtpSink{ln: ln, messages: make(chan sinkMessage, 1)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 localhost ESMTP sink")
+	var msg sinkMessage
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			c.PrintfLine("250 localhost")
+		case "MAIL":
+			msg = sinkMessage{from: strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")}
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			b, err := io.ReadAll(c.DotReader())
+			if err != nil {
+				return
+			}
+			msg.data = string(b)
+			s.messages <- msg
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("250 OK")
+		}
+	}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	sink := newSMTPSink(t)
+	addr, from := *smtpAddr, *smtpFrom
+	*smtpAddr, *smtpFrom = sink.ln.Addr().String(), "Who is hiring <alerts@example.com>"
+	t.Cleanup(func() { *smtpAddr, *smtpFrom = addr, from })
+
+	n := notifiers["email"]
+	if err := n.Validate("not an address"); err == nil {
+		t.Error("expected an invalid address to be rejected")
+	}
+	if err := n.Validate("Ada <ada@example.com>"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), testLogger(), "Ada <ada@example.com>", testAlert()); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg sinkMessage
+	select {
+	case msg = <-sink.messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the sink to receive the digest")
+	}
+	if msg.from != "alerts@example.com" || len(msg.to) != 1 || msg.to[0] != "ada@example.com" {
+		t.Errorf("unexpected envelope from %s to %v", msg.from, msg.to)
+	}
+
+	m, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(msg.data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "2 new matches for Go & Kubernetes" {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("expected a multipart/alternative message, got %q", m.Header.Get("Content-Type"))
+	}
+
+	text, html, err := renderDigest(newDigest(testAlert()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := multipart.NewReader(m.Body, params["boundary"])
+	for _, want := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		part, err := parts.NextRawPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.Header.Get("Content-Type") != want.contentType {
+			t.Errorf("expected a %s part, got %s", want.contentType, part.Header.Get("Content-Type"))
+		}
+		b, err := io.ReadAll(quotedprintable.NewReader(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// SMTP sends lines ending in CRLF.
+		if got := strings.ReplaceAll(string(b), "\r\n", "\n"); got != want.body {
+			t.Errorf("unexpected %s part:\n%s", want.contentType, got)
+		}
+	}
+}
+
+func TestEmailNotifierStopsWhenCancelled(t *testing.T) {
+	// A server that accepts the connection and never greets.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	addr, from := *smtpAddr, *smtpFrom
+	*smtpAddr, *smtpFrom = ln.Addr().String(), "alerts@example.com"
+	t.Cleanup(func() { *smtpAddr, *smtpFrom = addr, from })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := notifiers["email"].Notify(ctx, testLogger(), "ada@example.com", testAlert()); err == nil {
+		t.Fatal("expected an error from the unresponsive server")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected to give up when the context expired, took %s", elapsed)
+	}
+}
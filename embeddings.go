@@ -3,20 +3,114 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"database/sql"
 	"encoding/binary"
+	"encoding/hex"
+	"github.com/newhook/whoishiring/hashing"
+	"github.com/newhook/whoishiring/llm"
 	"github.com/newhook/whoishiring/ollama"
 	"github.com/newhook/whoishiring/openai"
 	"github.com/newhook/whoishiring/queries"
+	"github.com/newhook/whoishiring/sbert"
 	"github.com/newhook/whoishiring/voyageai"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
 	"log/slog"
+	"math"
 	"time"
 )
 
 type Embedding struct {
-	Model     string
-	Embedding func(ctx context.Context, text string) ([]float32, error)
+	Model string
+	// Provider serves the model, for usage accounting.
+	Provider string
+	// Space names the model whose vectors this model's are interchangeable with, e.g. the same model
+	// served by Ollama and by an OpenAI-compatible server. It's the model itself when empty.
+	Space string
+	// Dimensions is the length of every vector the model creates.
+	Dimensions int
+	// Normalized declares that the model returns unit length vectors. Vectors of other models are
+	// normalized by Vector, since the vector search relies on dot product being cosine similarity.
+	Normalized bool
+	// Embedding returns the vector of text and the number of tokens billed for it.
+	Embedding func(ctx context.Context, text string) ([]float32, int, error)
+}
+
+// local adapts the embedding function of a model that doesn't bill tokens.
+func local(embed func(ctx context.Context, text string) ([]float32, error)) func(ctx context.Context, text string) ([]float32, int, error) {
+	return func(ctx context.Context, text string) ([]float32, int, error) {
+		v, err := embed(ctx, text)
+		return v, 0, err
+	}
+}
+
+// Compatible reports whether the vectors of o can be compared with e's, so o can stand in for e.
+func (e Embedding) Compatible(o Embedding) bool {
+	space := func(e Embedding) string {
+		if e.Space == "" {
+			return e.Model
+		}
+		return e.Space
+	}
+	return space(e) == space(o) && e.Dimensions == o.Dimensions
+}
+
+// normalizedTolerance is how far a stored vector's magnitude may be from one. float32 rounding
+// over a couple of thousand dimensions stays well within it.
+const normalizedTolerance = 1e-3
+
+// Vector creates the embedding of text and validates it against the model's declaration. The call is
+// checked against the budgets and recorded by m for task.
+func (e Embedding) Vector(ctx context.Context, m *Meter, task string, text string) ([]float32, error) {
+	if err := m.Allow(ctx, EmbeddingEndpoint); err != nil {
+		return nil, err
+	}
+	v, tokens, err := e.Embedding(ctx, text)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Record(ctx, EmbeddingEndpoint, e.Provider, e.Model, task, llm.Usage{InputTokens: tokens}); err != nil {
+		return nil, err
+	}
+	if !e.Normalized {
+		v = normalize(v)
+	}
+	if err := e.Validate(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Validate checks that v has the model's dimensions and is unit length.
+func (e Embedding) Validate(v []float32) error {
+	if len(v) != e.Dimensions {
+		return errors.Errorf("%s: expected %d dimensions, got %d", e.Model, e.Dimensions, len(v))
+	}
+	if m := magnitude(v); math.Abs(m-1) > normalizedTolerance {
+		return errors.Errorf("%s: expected a unit vector, got magnitude %f", e.Model, m)
+	}
+	return nil
+}
+
+func magnitude(v []float32) float64 {
+	var sum float64
+	for _, f := range v {
+		sum += float64(f) * float64(f)
+	}
+	return math.Sqrt(sum)
+}
+
+func normalize(v []float32) []float32 {
+	m := magnitude(v)
+	if m == 0 {
+		return v
+	}
+	res := make([]float32, len(v))
+	for i, f := range v {
+		res[i] = float32(float64(f) / m)
+	}
+	return res
 }
 
 const (
@@ -24,24 +118,52 @@ const (
 	Gemma        = "gemma:2b"
 	OpenAI3Small = string(openai.EmbeddingModelOpenAI3Small)
 	VoyagerAI    = string(voyageai.Voyage2Model)
+	MiniLM       = "all-MiniLM-L6-v2"
+	Fake         = "fake"
 )
 
 var embeddings = map[string]Embedding{
 	Nomic: {
-		Model:     Nomic,
-		Embedding: ollama.Embedding(Nomic, ""),
+		Model:      Nomic,
+		Provider:   "ollama",
+		Dimensions: 768,
+		Normalized: true,
+		Embedding:  local(ollama.Embedding(Nomic, "")),
 	},
 	Gemma: {
-		Model:     Gemma,
-		Embedding: ollama.Embedding(Gemma, ""),
+		Model:      Gemma,
+		Provider:   "ollama",
+		Dimensions: 2048,
+		Normalized: true,
+		Embedding:  local(ollama.Embedding(Gemma, "")),
 	},
 	OpenAI3Small: {
-		Model:     OpenAI3Small,
-		Embedding: openai.Embedding(openai.EmbeddingModelOpenAI(OpenAI3Small)),
+		Model:      OpenAI3Small,
+		Provider:   "openai",
+		Dimensions: 1536,
+		Normalized: true,
+		Embedding:  openai.Embedding(openai.EmbeddingModelOpenAI(OpenAI3Small)),
 	},
 	VoyagerAI: {
-		Model:     VoyagerAI,
-		Embedding: voyageai.Embedding(voyageai.Voyage2Model),
+		Model:      VoyagerAI,
+		Provider:   "voyageai",
+		Dimensions: 1024,
+		Normalized: true,
+		Embedding:  voyageai.Embedding(voyageai.Voyage2Model),
+	},
+	MiniLM: {
+		Model:      MiniLM,
+		Provider:   "sbert",
+		Dimensions: 384,
+		Normalized: true,
+		Embedding:  local(sbert.Embedding(MiniLM, "")),
+	},
+	Fake: {
+		Model:      Fake,
+		Provider:   "hashing",
+		Dimensions: hashing.Dimensions,
+		Normalized: true,
+		Embedding:  local(hashing.Embedding()),
 	},
 }
 
@@ -52,8 +174,21 @@ func ValidateEmbeddingModel(s string) error {
 	return errors.Errorf("invalid embedding model: %s", s)
 }
 
-func GetEmbedding(ctx context.Context, text string) ([]float32, error) {
-	return embeddings[*embeddingModel].Embedding(ctx, text)
+// GetEmbedding creates the query embedding of text, returning the model that created it.
+func GetEmbedding(ctx context.Context, m *Meter, text string) ([]float32, string, error) {
+	return createEmbedding(ctx, m, *embeddingModel, "query", text)
+}
+
+// createEmbedding creates the embedding of text with model, failing over to its compatible fallbacks.
+// It returns the model that created it.
+func createEmbedding(ctx context.Context, m *Meter, model string, task string, text string) ([]float32, string, error) {
+	var v []float32
+	used, err := withFailover(ctx, EmbeddingEndpoint, embeddingChain(model), func(name string) error {
+		var err error
+		v, err = embeddings[name].Vector(ctx, m, task, text)
+		return err
+	})
+	return v, used, err
 }
 
 func CreateEmbeddings(ctx context.Context, l *slog.Logger, q *queries.Queries, model string) error {
@@ -66,15 +201,47 @@ func CreateEmbeddings(ctx context.Context, l *slog.Logger, q *queries.Queries, m
 	return nil
 }
 
+// ContentHash identifies the text an embedding was created from. Identical texts share an
+// embedding, and an embedding whose hash no longer matches its item's text is stale.
+func ContentHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// pendingEmbedding is a unique text that needs an embedding, along with the items to insert
+// it for and the stale embedding rows to overwrite with it.
+type pendingEmbedding struct {
+	hash  string
+	text  string
+	items []int
+	stale []int
+	blob  []byte
+}
+
 func createEmbeddingsFor(ctx context.Context, l *slog.Logger, q *queries.Queries, clause string, model string) error {
 	posts, err := q.GetItemsWithTitle(ctx, clause)
 	if err != nil {
 		return err
 	}
 
-	var create []queries.Item
+	embedding := embeddings[model]
+	pending := map[string]*pendingEmbedding{}
+	pendingFor := func(hash string, text string) *pendingEmbedding {
+		p, ok := pending[hash]
+		if !ok {
+			p = &pendingEmbedding{hash: hash, text: text}
+			pending[hash] = p
+		}
+		return p
+	}
+
+	if len(posts) > MaxWindow {
+		posts = posts[:MaxWindow]
+	}
+
+	var created, stale, backfilled int
 	// last three months.
-	for _, post := range posts[:MaxWindow] {
+	for _, post := range posts {
 		children, err := q.GetItemsForParent(ctx, post.ID)
 		if err != nil {
 			return err
@@ -86,50 +253,115 @@ func createEmbeddingsFor(ctx context.Context, l *slog.Logger, q *queries.Queries
 		if err != nil {
 			return err
 		}
-		set := NewSet[int]()
+		byItem := map[int]queries.Embedding{}
 		for _, e := range embeddings {
-			set.Add(e.ItemID)
+			byItem[e.ItemID] = e
 		}
 		for _, c := range children {
-			if !set.Contains(c.ID) {
-				create = append(create, c)
+			if c.Text == "" {
+				continue
+			}
+			hash := ContentHash(c.Text)
+			e, ok := byItem[c.ID]
+			switch {
+			case !ok:
+				created++
+				p := pendingFor(hash, c.Text)
+				p.items = append(p.items, c.ID)
+			case e.ContentHash == hash:
+				// Up to date.
+			case e.ContentHash == "" && validateBlob(embedding, e.Embedding) == nil:
+				// Created before content hashes were recorded. Its text is assumed to be the current
+				// one rather than paying to embed the whole corpus again, -repair fixes broken vectors.
+				err := q.UpdateEmbedding(ctx, queries.UpdateEmbeddingParams{
+					Embedding:   e.Embedding,
+					ContentHash: hash,
+					UpdatedAt:   e.UpdatedAt,
+					ID:          e.ID,
+				})
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				backfilled++
+			default:
+				// The text changed, or a legacy embedding is broken.
+				stale++
+				p := pendingFor(hash, c.Text)
+				p.stale = append(p.stale, e.ID)
 			}
 		}
 	}
 
-	l.Info("creating embeddings", slog.String("clause", clause), slog.Int("count", len(create)), slog.String("model", model))
-	g, ctx := errgroup.WithContext(ctx)
-	g.SetLimit(10)
-	for _, comment := range create {
-		if comment.Text == "" {
-			continue
+	// Reuse an embedding of identical text from another item before asking the model.
+	var cached int
+	for _, p := range pending {
+		e, err := q.GetEmbeddingByContentHash(ctx, queries.GetEmbeddingByContentHashParams{
+			Model:       model,
+			ContentHash: p.hash,
+		})
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
 		}
+		if err == nil && validateBlob(embedding, e.Embedding) == nil {
+			p.blob = e.Embedding
+			cached++
+		}
+	}
 
+	l.Info("creating embeddings", slog.String("clause", clause), slog.Int("count", created), slog.Int("stale", stale),
+		slog.Int("backfilled", backfilled), slog.Int("unique", len(pending)), slog.Int("cached", cached), slog.String("model", model))
+	m := NewMeter(q, "")
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(10)
+	for _, p := range pending {
 		g.Go(func() error {
-			var blob []byte
-			vector, err := embeddings[model].Embedding(ctx, comment.Text)
-			if err != nil {
-				return err
-			}
-			blob, err = MarshalFloat32ArrayWithLength(vector)
-			if err != nil {
-				return err
+			blob := p.blob
+			if blob == nil {
+				vector, _, err := createEmbedding(ctx, m, model, "index", p.text)
+				if err != nil {
+					return err
+				}
+				blob, err = MarshalFloat32ArrayWithLength(vector)
+				if err != nil {
+					return err
+				}
 			}
 			now := int(time.Now().Unix())
-			err = q.InsertEmbedding(ctx, queries.InsertEmbeddingParams{
-				ItemID:    comment.ID,
-				Model:     model,
-				Embedding: blob,
-				CreatedAt: now,
-				UpdatedAt: now,
-			})
-			if err != nil {
-				return err
+			for _, id := range p.items {
+				err := q.InsertEmbedding(ctx, queries.InsertEmbeddingParams{
+					ItemID:      id,
+					Model:       model,
+					Embedding:   blob,
+					ContentHash: p.hash,
+					CreatedAt:   now,
+					UpdatedAt:   now,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			for _, id := range p.stale {
+				err := q.UpdateEmbedding(ctx, queries.UpdateEmbeddingParams{
+					Embedding:   blob,
+					ContentHash: p.hash,
+					UpdatedAt:   now,
+					ID:          id,
+				})
+				if err != nil {
+					return err
+				}
 			}
 			return nil
 		})
 	}
-	return g.Wait()
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if usage := m.Totals(); usage.Calls > 0 {
+		l.Info("created embeddings", slog.String("clause", clause), slog.Int("calls", usage.Calls),
+			slog.Int("tokens", usage.InputTokens), slog.Float64("cost", usage.Cost))
+	}
+	return nil
 }
 
 // MarshalFloat32ArrayWithLength marshals an array of float32 values to a binary blob, including the length of the array at the beginning.
@@ -157,6 +389,9 @@ func UnmarshalFloat32ArrayWithLength(data []byte) ([]float32, error) {
 	if err := binary.Read(buf, binary.LittleEndian, &length); err != nil {
 		return nil, err
 	}
+	if length < 0 || int64(len(data)) != 4+4*int64(length) {
+		return nil, errors.Errorf("corrupt vector: %d bytes for length %d", len(data), length)
+	}
 	floats := make([]float32, length)
 	for i := 0; i < int(length); i++ {
 		if err := binary.Read(buf, binary.LittleEndian, &floats[i]); err != nil {
@@ -165,3 +400,11 @@ func UnmarshalFloat32ArrayWithLength(data []byte) ([]float32, error) {
 	}
 	return floats, nil
 }
+
+func validateBlob(e Embedding, blob []byte) error {
+	v, err := UnmarshalFloat32ArrayWithLength(blob)
+	if err != nil {
+		return err
+	}
+	return e.Validate(v)
+}
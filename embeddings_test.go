@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/newhook/whoishiring/hn"
+	"github.com/newhook/whoishiring/queries"
+	"sync/atomic"
+	"testing"
+)
+
+// countEmbeddings counts the texts the fake embedding model is asked to embed.
+func countEmbeddings(t *testing.T) *atomic.Int32 {
+	t.Helper()
+	var calls atomic.Int32
+	fake := embeddings[Fake]
+	counting := fake
+	counting.Embedding = func(ctx context.Context, text string) ([]float32, int, error) {
+		calls.Add(1)
+		return fake.Embedding(ctx, text)
+	}
+	embeddings[Fake] = counting
+	t.Cleanup(func() { embeddings[Fake] = fake })
+	return &calls
+}
+
+func TestContentHash(t *testing.T) {
+	if ContentHash("Go engineers wanted") != ContentHash("Go engineers wanted") {
+		t.Error("expected identical texts to hash the same")
+	}
+	if ContentHash("Go engineers wanted") == ContentHash("Go engineers wanted.") {
+		t.Error("expected different texts to hash differently")
+	}
+	if len(ContentHash("")) != 64 {
+		t.Errorf("expected a hex encoded sha256, got %q", ContentHash(""))
+	}
+}
+
+func TestCreateEmbeddingsReusesIdenticalText(t *testing.T) {
+	q := newFixtureDB(t)
+	ctx := context.Background()
+	calls := countEmbeddings(t)
+
+	original, err := q.GetItem(ctx, 1001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same posting, posted again.
+	repost := hn.Item{ID: 1007, Type: "comment", By: "acme", Time: original.Time + 3600, Parent: 1000, Text: original.Text}
+	if err := insertItem(ctx, q, repost); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateEmbeddings(ctx, testLogger(), q, Fake); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 0 {
+		t.Errorf("expected the repost to reuse the original's embedding, the model was called %d times", calls.Load())
+	}
+
+	want, err := q.GetEmbedding(ctx, queries.GetEmbeddingParams{ItemID: 1001, Model: Fake})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := q.GetEmbedding(ctx, queries.GetEmbeddingParams{ItemID: 1007, Model: Fake})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ContentHash != ContentHash(original.Text) || !bytes.Equal(got.Embedding, want.Embedding) {
+		t.Errorf("expected the repost to have the original's embedding, got %+v", got)
+	}
+}
+
+func TestCreateEmbeddingsReembedsStale(t *testing.T) {
+	q := newFixtureDB(t)
+	ctx := context.Background()
+	calls := countEmbeddings(t)
+
+	want := map[int]queries.Embedding{}
+	for _, c := range []struct {
+		id     int
+		hash   string
+		broken bool
+	}{
+		// Embedded before the comment was edited.
+		{1001, ContentHash("Acme Payments | Backend Engineer"), true},
+		// Embedded before content hashes were recorded, the hash is backfilled.
+		{1002, "", false},
+		// Embedded before content hashes were recorded, and broken since.
+		{1003, "", true},
+	} {
+		e, err := q.GetEmbedding(ctx, queries.GetEmbeddingParams{ItemID: c.id, Model: Fake})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[c.id] = e
+		blob := e.Embedding
+		if c.broken {
+			blob = make([]byte, len(e.Embedding))
+		}
+		err = q.UpdateEmbedding(ctx, queries.UpdateEmbeddingParams{
+			Embedding:   blob,
+			ContentHash: c.hash,
+			UpdatedAt:   e.UpdatedAt,
+			ID:          e.ID,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := CreateEmbeddings(ctx, testLogger(), q, Fake); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected only the two broken embeddings to be created again, the model was called %d times", calls.Load())
+	}
+	for id, w := range want {
+		e, err := q.GetEmbedding(ctx, queries.GetEmbeddingParams{ItemID: id, Model: Fake})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.ID != w.ID || e.ContentHash != w.ContentHash || !bytes.Equal(e.Embedding, w.Embedding) {
+			t.Errorf("expected the embedding of %d to be of the current text, with its hash", id)
+		}
+	}
+}
+
+func TestEmbeddingValidate(t *testing.T) {
+	e := Embedding{Model: "test", Dimensions: 3}
+	for _, c := range []struct {
+		v     []float32
+		valid bool
+	}{
+		{[]float32{1, 0, 0}, true},
+		{[]float32{0.6, 0, 0.8}, true},
+		{[]float32{0.6, 0.8}, false},
+		{[]float32{0.6, 0.8, 0, 0}, false},
+		{[]float32{3, 0, 4}, false},
+		{[]float32{0, 0, 0}, false},
+	} {
+		if err := e.Validate(c.v); (err == nil) != c.valid {
+			t.Errorf("expected %v to be valid %t, got %v", c.v, c.valid, err)
+		}
+	}
+}
+
+func TestUnmarshalFloat32ArrayWithLength(t *testing.T) {
+	blob, err := MarshalFloat32ArrayWithLength([]float32{0.25, -1, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := UnmarshalFloat32ArrayWithLength(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 3 || v[0] != 0.25 || v[1] != -1 || v[2] != 3 {
+		t.Errorf("unexpected round trip %v", v)
+	}
+
+	for name, b := range map[string][]byte{
+		"empty":     {},
+		"truncated": blob[:len(blob)-1],
+		"trailing":  append(append([]byte{}, blob...), 0, 0, 0, 0),
+		"negative":  {0xff, 0xff, 0xff, 0xff},
+		"too long":  {0xff, 0xff, 0xff, 0x7f, 0, 0, 0, 0},
+	} {
+		if _, err := UnmarshalFloat32ArrayWithLength(b); err == nil {
+			t.Errorf("expected an error for a %s blob", name)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/newhook/whoishiring/queries"
+	"github.com/pkg/errors"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ErrNoJobDescription is returned by employer searches without a job description.
+var ErrNoJobDescription = errors.New("a job description, job URL or hiring comment ID is required to search for job seekers")
+
+// readJobDescription returns the job description of an employer search, from the prompt, the uploaded
+// document, the hiring comment JobID and the page at JobURL, whichever are given.
+func readJobDescription(ctx context.Context, q *queries.Queries, search SearchTerms) (string, error) {
+	if search.LinkedIn != "" {
+		return "", errors.New("LinkedIn profiles are for job searches, describe the job to search for job seekers")
+	}
+	var parts []string
+	if search.JobPrompt != "" {
+		parts = append(parts, search.JobPrompt)
+	}
+	if search.Resume != nil {
+		text, err := readDocument(search.ResumeName, search.Resume)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, text)
+	}
+	if search.JobID != 0 {
+		item, err := q.GetItem(ctx, search.JobID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", errors.Wrapf(ErrItemNotFound, "hiring comment %d", search.JobID)
+		}
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		clause, err := threadClause(ctx, q, item)
+		if err != nil {
+			return "", err
+		}
+		if clause != whoIsHiring {
+			return "", errors.Wrapf(ErrItemNotFound, "item %d isn't a comment of a \"Who is hiring?\" post", item.ID)
+		}
+		parts = append(parts, plainText(item.Text))
+	}
+	if search.JobURL != "" {
+		text, err := fetchJobPage(ctx, search.JobURL)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, text)
+	}
+	if len(parts) == 0 {
+		return "", ErrNoJobDescription
+	}
+	return strings.Join(parts, "\n\n"), nil
+}
+
+// searchPrompt returns prompt as it's pasted into the prompts of searchType. The job description of an
+// employer search comes from pages, documents and hiring comments written by others, so it's escaped by
+// untrustedText like a comment, to stay inside the <job_description> tag fencing it off.
+func searchPrompt(searchType SearchType, prompt string) string {
+	if searchType == SearchType_WhoWantToBeHired {
+		return untrustedText(prompt)
+	}
+	return prompt
+}
+
+// maxJobPageSize limits how much of a job page is read.
+const maxJobPageSize = 1 << 20
+
+// jobPageClient fetches job pages. They're given by anyone, so it only connects to public addresses.
+var jobPageClient = newPublicClient(30 * time.Second)
+
+var (
+	pageScripts = regexp.MustCompile(`(?is)<(script|style|noscript)\b.*?</(script|style|noscript)>`)
+	pageBlocks  = regexp.MustCompile(`(?i)</?(p|div|br|li|h[1-6]|tr|section|article)\b[^>]*>`)
+	blankLines  = regexp.MustCompile(`\n\s*\n\s*`)
+)
+
+// fetchJobPage returns the text of the job description page at link.
+func fetchJobPage(ctx context.Context, link string) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", errors.Errorf("invalid job URL %q", link)
+	}
+	if err := checkPublicURL(u); err != nil {
+		return "", errors.Wrap(err, "job URL")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	resp, err := jobPageClient.Do(req)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("couldn't fetch job URL %s: %s", link, resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxJobPageSize))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	text := pageScripts.ReplaceAllString(string(b), "")
+	text = pageBlocks.ReplaceAllString(text, "\n")
+	text = html.UnescapeString(htmlTag.ReplaceAllString(text, ""))
+	text = strings.TrimSpace(blankLines.ReplaceAllString(text, "\n\n"))
+	if text == "" {
+		return "", errors.Errorf("job URL %s has no text", link)
+	}
+	return text, nil
+}
+
+// Candidate are the fields of a "Who wants to be hired?" comment, which follow the template in the post:
+// "Location:", "Remote:", "Willing to relocate:", "Technologies:", "Résumé/CV:" and "Email:".
+type Candidate struct {
+	Location          string   `json:"location"`
+	Remote            string   `json:"remote"`
+	WillingToRelocate string   `json:"willing_to_relocate"`
+	Technologies      []string `json:"technologies"`
+	ResumeLinks       []string `json:"resume_links"`
+}
+
+var (
+	candidateField = regexp.MustCompile(`(?i)^\s*(location|remote|willing to relocate|technologies|r[eé]sum[eé](?:/cv)?|cv)\s*:\s*(.*)$`)
+	links          = regexp.MustCompile(`https?://[^\s"'<>]+`)
+	hrefs          = regexp.MustCompile(`(?i)href="([^"]+)"`)
+)
+
+// parseCandidate extracts the fields of a seeker's comment. Fields the seeker left out are empty.
+func parseCandidate(text string) Candidate {
+	c := Candidate{Technologies: []string{}, ResumeLinks: []string{}}
+	// Fields are usually paragraphs of their own, and sometimes lines.
+	for _, paragraph := range paragraphTag.Split(text, -1) {
+		for _, line := range strings.Split(paragraph, "\n") {
+			m := candidateField.FindStringSubmatch(plainText(line))
+			if m == nil {
+				continue
+			}
+			value := strings.TrimSpace(m[2])
+			switch strings.ToLower(m[1]) {
+			case "location":
+				c.Location = value
+			case "remote":
+				c.Remote = value
+			case "willing to relocate":
+				c.WillingToRelocate = value
+			case "technologies":
+				for _, tech := range strings.Split(value, ",") {
+					if tech = strings.TrimSpace(tech); tech != "" {
+						c.Technologies = append(c.Technologies, tech)
+					}
+				}
+			default:
+				// HN shortens the text of long links, the href has all of it.
+				found := hrefs.FindAllStringSubmatch(line, -1)
+				for _, href := range found {
+					c.ResumeLinks = append(c.ResumeLinks, html.UnescapeString(href[1]))
+				}
+				if len(found) == 0 {
+					for _, link := range links.FindAllString(value, -1) {
+						c.ResumeLinks = append(c.ResumeLinks, strings.TrimRight(link, ".,;)"))
+					}
+				}
+			}
+		}
+	}
+	return c
+}
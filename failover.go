@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"github.com/newhook/whoishiring/llm"
+	"github.com/newhook/whoishiring/transport"
+	"github.com/pkg/errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chains is the completion models tried in order for each task, a flag formatted as
+// "job_search=claude,openai;terms=ollama,claude". Tasks without a chain use the -completion chain.
+type Chains map[string][]string
+
+func (c *Chains) String() string {
+	if c == nil {
+		return ""
+	}
+	var parts []string
+	for task, chain := range *c {
+		parts = append(parts, task+"="+strings.Join(chain, ","))
+	}
+	slices.Sort(parts)
+	return strings.Join(parts, ";")
+}
+
+func (c *Chains) Set(s string) error {
+	chains := Chains{}
+	for _, part := range strings.Split(s, ";") {
+		if part == "" {
+			continue
+		}
+		task, chain, ok := strings.Cut(part, "=")
+		if !ok || chain == "" {
+			return errors.Errorf("invalid chain %q, expected task=model,model", part)
+		}
+		if !slices.Contains([]string{analyzeResumeTask.name, searchTermsTask.name, jobSearchTask.name, refineTask.name, candidateTermsTask.name, candidateSearchTask.name, candidateRefineTask.name}, task) {
+			return errors.Errorf("unknown task in chain %q", part)
+		}
+		chains[task] = strings.Split(chain, ",")
+	}
+	*c = chains
+	return nil
+}
+
+var (
+	// taskCompletions overrides the completion chain of tasks.
+	taskCompletions = Chains{}
+	// embeddingFallbacks are tried in order when the embedding model fails. They must make vectors
+	// compatible with it.
+	embeddingFallbacks []string
+)
+
+// completionChain returns the completion models tried in order for task.
+func completionChain(task string) []string {
+	if chain, ok := taskCompletions[task]; ok {
+		return chain
+	}
+	return strings.Split(*completionModel, ",")
+}
+
+// embeddingChain returns model followed by the fallbacks whose vectors are compatible with it.
+func embeddingChain(model string) []string {
+	chain := []string{model}
+	for _, fallback := range embeddingFallbacks {
+		if fallback != model && embeddings[model].Compatible(embeddings[fallback]) {
+			chain = append(chain, fallback)
+		}
+	}
+	return chain
+}
+
+// ValidateEmbeddingFallbacks checks that the fallbacks exist and are compatible with model, since
+// query vectors of another space would silently return unrelated results.
+func ValidateEmbeddingFallbacks(model string, fallbacks []string) error {
+	for _, fallback := range fallbacks {
+		if err := ValidateEmbeddingModel(fallback); err != nil {
+			return err
+		}
+		if !embeddings[model].Compatible(embeddings[fallback]) {
+			return errors.Errorf("embedding fallback %s isn't compatible with the vectors of %s", fallback, model)
+		}
+	}
+	return nil
+}
+
+var (
+	breakerFailures = 3
+	breakerCooldown = 30 * time.Second
+)
+
+// Breaker is the circuit breaker of a provider. After breakerFailures consecutive failures it opens,
+// and the provider is skipped until breakerCooldown has passed. Then calls are let through again, and
+// another failure opens it for another cooldown.
+type Breaker struct {
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+var (
+	breakersMutex sync.Mutex
+	breakers      = map[string]*Breaker{}
+)
+
+// breaker returns the circuit breaker of a completion or embedding model.
+func breaker(endpoint, name string) *Breaker {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+	key := endpoint + ":" + name
+	b, ok := breakers[key]
+	if !ok {
+		b = &Breaker{}
+		breakers[key] = b
+	}
+	return b
+}
+
+func (b *Breaker) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return !time.Now().Before(b.openUntil)
+}
+
+func (b *Breaker) Success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+func (b *Breaker) Failure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	if b.failures >= breakerFailures {
+		b.openUntil = time.Now().Add(breakerCooldown)
+	}
+}
+
+// failover reports whether err should be retried with the next provider of a chain. Exhausted budgets,
+// invalid output and cancelled requests would fail the same way with any provider.
+func failover(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var invalid *llm.InvalidOutputError
+	return !errors.Is(err, ErrBudgetExceeded) && !errors.As(err, &invalid)
+}
+
+// unhealthy reports whether err counts against the provider's circuit breaker: it's down, overloaded,
+// out of quota or rejecting the key, rather than refusing a particular request.
+func unhealthy(err error) bool {
+	var te *transport.Error
+	if errors.As(err, &te) {
+		return te.Temporary() || te.QuotaExceeded() || te.StatusCode == http.StatusUnauthorized || te.StatusCode == http.StatusForbidden
+	}
+	var ue *url.Error
+	return errors.As(err, &ue)
+}
+
+// withFailover calls call with each provider of chain in turn, skipping those whose breaker is open,
+// until one succeeds or fails with an error another provider wouldn't fix. It returns the provider
+// that succeeded.
+func withFailover(ctx context.Context, endpoint string, chain []string, call func(name string) error) (string, error) {
+	var errs []error
+	for _, name := range chain {
+		b := breaker(endpoint, name)
+		if !b.Allow() {
+			errs = append(errs, errors.Errorf("%s: skipped after repeated failures", name))
+			continue
+		}
+		err := call(name)
+		if err == nil {
+			b.Success()
+			return name, nil
+		}
+		if !failover(ctx, err) {
+			return "", err
+		}
+		if unhealthy(err) {
+			b.Failure()
+		}
+		slog.Warn("provider failed", slog.String("endpoint", endpoint), slog.String("provider", name), slog.String("error", err.Error()))
+		errs = append(errs, err)
+	}
+	if len(errs) == 1 {
+		return "", errs[0]
+	}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return "", errors.Errorf("no %s provider available: %s", endpoint, strings.Join(msgs, "; "))
+}
+
+// providersUsed collects the providers that served each task of a search.
+type providersUsed struct {
+	mutex     sync.Mutex
+	providers map[string]Set[string]
+}
+
+func (p *providersUsed) add(task, provider string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.providers == nil {
+		p.providers = map[string]Set[string]{}
+	}
+	if p.providers[task] == nil {
+		p.providers[task] = NewSet[string]()
+	}
+	p.providers[task].Add(provider)
+}
+
+// values returns the sorted providers by task.
+func (p *providersUsed) values() map[string][]string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	values := map[string][]string{}
+	for task, providers := range p.providers {
+		values[task] = providers.Values()
+		slices.Sort(values[task])
+	}
+	return values
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"github.com/newhook/whoishiring/hashing"
+	"github.com/newhook/whoishiring/llm"
+	"github.com/newhook/whoishiring/transport"
+	"github.com/pkg/errors"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+// downLLM fails like a provider that's down.
+type downLLM struct {
+	calls atomic.Int32
+}
+
+func (d *downLLM) Complete(ctx context.Context, req llm.Request) (llm.Response, error) {
+	d.calls.Add(1)
+	return llm.Response{}, &transport.Error{Provider: "down", StatusCode: http.StatusServiceUnavailable}
+}
+
+func TestCompletionFailover(t *testing.T) {
+	useTestModels(t, "remote Go backend engineer")
+	down := &downLLM{}
+	completions["down"] = Completion{Model: "down", LLM: down}
+	*completionModel = "down," + testCompletion
+	t.Cleanup(func() {
+		delete(completions, "down")
+		delete(breakers, CompletionEndpoint+":down")
+	})
+	q := newFixtureDB(t)
+
+	resp, err := JobSearch(context.Background(), testLogger(), q, SearchTerms{
+		Months:     1,
+		SearchType: SearchType_WhoIsHiring,
+		JobPrompt:  "remote Go backend engineer",
+		NoCache:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, task := range []string{searchTermsTask.name, jobSearchTask.name} {
+		if !slices.Equal(resp.Providers[task], []string{testCompletion}) {
+			t.Errorf("expected %s served by the fallback, got %v", task, resp.Providers)
+		}
+	}
+	if !slices.Equal(resp.Providers["embedding"], []string{Fake}) {
+		t.Errorf("expected the embedding model, got %v", resp.Providers["embedding"])
+	}
+	if len(resp.Comments) == 0 {
+		t.Error("expected picks")
+	}
+
+	// After breakerFailures failures the provider is skipped.
+	for range breakerFailures {
+		if _, err := newCompleter(testPrompts(t), nil, nil).GetTerms(context.Background(), searchTermsTask, "Go", preferences{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := down.calls.Load(); got != int32(breakerFailures) {
+		t.Errorf("expected %d calls before the breaker opened, got %d", breakerFailures, got)
+	}
+}
+
+func TestCompletionInvalidOutputDoesNotFailover(t *testing.T) {
+	useTestModels(t, "Go")
+	down := &downLLM{}
+	completions["down"] = Completion{Model: "down", LLM: down}
+	*completionModel = testCompletion + ",down"
+	t.Cleanup(func() { delete(completions, "down") })
+	testLLMClient.invalid = 2
+
+	_, err := newCompleter(testPrompts(t), nil, nil).GetTerms(context.Background(), searchTermsTask, "Go", preferences{})
+	var invalid *llm.InvalidOutputError
+	if !errors.As(err, &invalid) {
+		t.Errorf("expected invalid output, got %v", err)
+	}
+	if down.calls.Load() != 0 {
+		t.Error("invalid output must not fail over")
+	}
+}
+
+func TestEmbeddingFailover(t *testing.T) {
+	useTestModels(t, "remote Go backend engineer")
+	q := newFixtureDB(t)
+
+	// The same model served by another provider.
+	embeddings["fake-mirror"] = Embedding{
+		Model:      "fake-mirror",
+		Provider:   "mirror",
+		Space:      Fake,
+		Dimensions: hashing.Dimensions,
+		Normalized: true,
+		Embedding:  local(hashing.Embedding()),
+	}
+	fake := embeddings[Fake]
+	broken := fake
+	broken.Embedding = func(ctx context.Context, text string) ([]float32, int, error) {
+		return nil, 0, &transport.Error{Provider: "hashing", StatusCode: http.StatusBadGateway}
+	}
+	embeddings[Fake] = broken
+	embeddingFallbacks = []string{MiniLM, "fake-mirror"}
+	t.Cleanup(func() {
+		embeddings[Fake] = fake
+		delete(embeddings, "fake-mirror")
+		delete(breakers, EmbeddingEndpoint+":"+Fake)
+		embeddingFallbacks = nil
+	})
+
+	if err := ValidateEmbeddingFallbacks(Fake, embeddingFallbacks); err == nil {
+		t.Error("expected the incompatible fallback to be rejected")
+	}
+	if chain := embeddingChain(Fake); !slices.Equal(chain, []string{Fake, "fake-mirror"}) {
+		t.Errorf("expected only the compatible fallback in the chain, got %v", chain)
+	}
+
+	resp, err := JobSearch(context.Background(), testLogger(), q, SearchTerms{
+		Months:     1,
+		SearchType: SearchType_WhoIsHiring,
+		JobPrompt:  "remote Go backend engineer",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(resp.Providers["embedding"], []string{"fake-mirror"}) {
+		t.Errorf("expected the query embedded by the fallback, got %v", resp.Providers["embedding"])
+	}
+	if len(resp.OriginalComments) == 0 || resp.OriginalComments[0] != 1001 {
+		t.Errorf("expected the same results, got %v", resp.OriginalComments)
+	}
+}
@@ -0,0 +1,73 @@
+package hashing
+
+import (
+	"context"
+	"hash/fnv"
+	"html"
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Dimensions is the length of the vectors created by Embedding.
+const Dimensions = 256
+
+var tags = regexp.MustCompile(`<[^>]*>`)
+
+// Embedding returns a function that creates deterministic bag-of-words
+// embeddings using feature hashing: every word and pair of adjacent words is
+// hashed into one of Dimensions buckets. Texts sharing vocabulary end up with
+// a high dot product, which is good enough for tests and demos without any
+// network access.
+func Embedding() func(ctx context.Context, text string) ([]float32, error) {
+	return func(ctx context.Context, text string) ([]float32, error) {
+		return Vector(text), nil
+	}
+}
+
+// Vector returns the unit length embedding of text.
+func Vector(text string) []float32 {
+	v := make([]float32, Dimensions)
+	words := tokenize(text)
+	for i, word := range words {
+		addFeature(v, word)
+		if i > 0 {
+			addFeature(v, words[i-1]+" "+word)
+		}
+	}
+
+	var norm float64
+	for _, f := range v {
+		norm += float64(f) * float64(f)
+	}
+	if norm == 0 {
+		// Keep empty texts unit length.
+		v[0] = 1
+		return v
+	}
+	norm = math.Sqrt(norm)
+	for i := range v {
+		v[i] = float32(float64(v[i]) / norm)
+	}
+	return v
+}
+
+func addFeature(v []float32, feature string) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(feature))
+	sum := h.Sum64()
+	// The top bit picks the sign so that unrelated features cancel out on average.
+	if sum>>63 == 1 {
+		v[sum%Dimensions]--
+	} else {
+		v[sum%Dimensions]++
+	}
+}
+
+func tokenize(text string) []string {
+	text = html.UnescapeString(tags.ReplaceAllString(text, " "))
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
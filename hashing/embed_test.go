@@ -0,0 +1,44 @@
+package hashing
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func dot(a, b []float32) float32 {
+	var sum float32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+func TestVectorIsDeterministic(t *testing.T) {
+	a := Vector("Senior Go engineer, remote")
+	b := Vector("Senior Go engineer, remote")
+	if !slices.Equal(a, b) {
+		t.Fatal("expected identical vectors for identical texts")
+	}
+}
+
+func TestVectorIsNormalized(t *testing.T) {
+	for _, text := range []string{"", "<p>&#x27;</p>", "Go", "Rust and Go engineers wanted"} {
+		v := Vector(text)
+		if len(v) != Dimensions {
+			t.Fatalf("%q: expected %d dimensions, got %d", text, Dimensions, len(v))
+		}
+		if norm := math.Sqrt(float64(dot(v, v))); math.Abs(norm-1) > 1e-5 {
+			t.Errorf("%q: expected a unit vector, got norm %f", text, norm)
+		}
+	}
+}
+
+func TestVectorSimilarity(t *testing.T) {
+	query := Vector("remote golang backend engineer")
+	related := Vector("We are hiring a remote backend engineer to write golang services")
+	unrelated := Vector("Onsite iOS designer for our consumer mobile app")
+	if dot(query, related) <= dot(query, unrelated) {
+		t.Errorf("expected related text to be more similar: %f <= %f", dot(query, related), dot(query, unrelated))
+	}
+}
@@ -48,7 +48,7 @@ func GetUser(ctx context.Context, user string) (*User, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("error response from the embedding API: " + resp.Status)
+		return nil, errors.New("error response from the Hacker News API: " + resp.Status)
 	}
 
 	body, err := io.ReadAll(resp.Body)
@@ -78,7 +78,7 @@ func GetItem(ctx context.Context, id int) (Item, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return Item{}, errors.New("error response from the embedding API: " + resp.Status)
+		return Item{}, errors.New("error response from the Hacker News API: " + resp.Status)
 	}
 
 	body, err := io.ReadAll(resp.Body)
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"cmp"
+	"html"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// injectionPatterns match instruction-like text in comments, which are written by anyone on Hacker News
+// and pasted into the job search prompt. Each is reported with its reason.
+var injectionPatterns = []struct {
+	reason  string
+	pattern *regexp.Regexp
+}{
+	{
+		reason:  "tries to override the instructions",
+		pattern: regexp.MustCompile(`(?i)\b(ignore|disregard|forget|override|bypass)\b[^.\n]{0,40}\b(previous|prior|above|earlier|preceding|all|any|other|your|these|those)\b[^.\n]{0,20}\b(instructions?|prompts?|rules|directions|guidelines|context)\b`),
+	},
+	{
+		reason:  "gives new instructions",
+		pattern: regexp.MustCompile(`(?i)\b(new|updated|additional|real)\s+(instructions?|rules|task)\s*:`),
+	},
+	{
+		reason:  "mentions the system prompt",
+		pattern: regexp.MustCompile(`(?i)\b(system|developer)\s+(prompt|message|instructions?)\b`),
+	},
+	{
+		reason:  "addresses the model",
+		pattern: regexp.MustCompile(`(?i)\b(you\s+are\s+now|from\s+now\s+on\s+you|dear\s+(ai|llm|assistant|model)|(ai|llm|language\s+model|assistant|chatbot|gpt|claude)\s*(reading|evaluating|ranking|screening)\s+this)\b`),
+	},
+	{
+		reason:  "asks to be ranked first",
+		pattern: regexp.MustCompile(`(?i)\b(rank|rate|score|list|put|place|pick|select|return|output)\b[^.\n]{0,30}\b(this|my|our)\s+(job|post|comment|listing|submission|id|company)\b[^.\n]{0,30}\b(first|top|highest|number\s+one|10/10|above\s+(all|the\s+others|everything))\b`),
+	},
+	{
+		reason:  "dictates the response",
+		pattern: regexp.MustCompile(`(?i)\b(respond|reply|answer)\s+(only\s+)?(with|in)\b[^.\n]{0,30}\b(json|job\s+ids?|ids?)\b`),
+	},
+	{
+		reason:  "contains prompt markup",
+		pattern: regexp.MustCompile(`(?i)(</?\s*(system|assistant|user|instructions?|job|job_description|candidate)\b[^>]*>|<\|im_(start|end)\|>|\[/?INST\])`),
+	},
+}
+
+// detectInjection returns why text looks like it's instructing the model rather than describing a job,
+// or nil. It's a heuristic: the prompt fences comments off regardless, flagging only makes the attempts
+// visible and keeps them from winning.
+func detectInjection(text string) []string {
+	var reasons []string
+	for _, p := range injectionPatterns {
+		if p.pattern.MatchString(text) {
+			reasons = append(reasons, p.reason)
+		}
+	}
+	return reasons
+}
+
+// flagInjections returns the reasons of the results whose comments look like prompt injections, by ID.
+func flagInjections(results []Result) map[int][]string {
+	flagged := map[int][]string{}
+	for _, result := range results {
+		if reasons := detectInjection(plainText(result.Item.Text)); reasons != nil {
+			flagged[result.ID] = reasons
+		}
+	}
+	return flagged
+}
+
+var (
+	paragraphTag = regexp.MustCompile(`(?i)<p\s*/?>`)
+	htmlTag      = regexp.MustCompile(`<[^>]*>`)
+)
+
+// plainText converts the HTML of a Hacker News comment to text.
+func plainText(s string) string {
+	s = paragraphTag.ReplaceAllString(s, "\n\n")
+	s = htmlTag.ReplaceAllString(s, "")
+	return html.UnescapeString(s)
+}
+
+var untrustedEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// untrustedText is the comment's text as it's pasted into a prompt: plain text with the markup
+// characters escaped, so it can't close the <job> tag fencing it off or open tags of its own. Employer
+// searches' job descriptions are escaped the same way, see searchPrompt.
+func untrustedText(s string) string {
+	return untrustedEscaper.Replace(plainText(s))
+}
+
+// injectionConcern is added to the concerns of a pick whose comment was flagged.
+const injectionConcern = "The post contains text that tries to instruct the ranking: "
+
+// checkPicks makes the picks of the completion model safe to use. Picks of IDs that weren't candidates
+// and repeated picks are dropped, and the rest are ordered by score when the model's order contradicts
+// it. Picks of flagged candidates are moved after the others with a concern, since a post trying to
+// steer the ranking shouldn't win by it. At most picksPerRanking picks are kept.
+func checkPicks(l *slog.Logger, candidates []candidate, picks []Pick) []Pick {
+	byID := map[int]candidate{}
+	for _, c := range candidates {
+		byID[c.job.ID] = c
+	}
+	var checked []Pick
+	seen := NewSet[int]()
+	for _, pick := range picks {
+		if _, ok := byID[pick.ID]; !ok {
+			l.Warn("dropping pick that isn't a candidate", slog.Int("id", pick.ID))
+			continue
+		}
+		if seen.Contains(pick.ID) {
+			l.Warn("dropping repeated pick", slog.Int("id", pick.ID))
+			continue
+		}
+		seen.Add(pick.ID)
+		if flags := byID[pick.ID].flags; flags != nil {
+			pick.Concerns = append(slices.Clip(pick.Concerns), injectionConcern+strings.Join(flags, ", "))
+		}
+		checked = append(checked, pick)
+	}
+
+	order := func(a, b Pick) int {
+		flaggedA, flaggedB := byID[a.ID].flags != nil, byID[b.ID].flags != nil
+		if flaggedA != flaggedB {
+			if flaggedA {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Compare(b.Score, a.Score)
+	}
+	if !slices.IsSortedFunc(checked, order) {
+		l.Warn("reordering picks by flags and score")
+		slices.SortStableFunc(checked, order)
+	}
+	return checked[:min(picksPerRanking, len(checked))]
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"github.com/newhook/whoishiring/queries"
+	"github.com/pkg/errors"
+	"log/slog"
+	"time"
+)
+
+type integrityReport struct {
+	checked      int
+	corrupt      int
+	mismatched   int
+	unnormalized int
+}
+
+func (r integrityReport) problems() int {
+	return r.corrupt + r.mismatched + r.unnormalized
+}
+
+// CheckEmbeddings scans the embeddings table for blobs that can't be decoded, vectors whose
+// length doesn't match the model's dimensions, and vectors that aren't unit length. With repair
+// set, corrupt and mismatched embeddings are deleted so that CreateEmbeddings recreates them, and
+// unnormalized vectors are normalized in place.
+func CheckEmbeddings(ctx context.Context, l *slog.Logger, q *queries.Queries, repair bool) error {
+	start := time.Now()
+	reports := map[string]*integrityReport{}
+	unknown := map[string]int{}
+
+	lastID := 0
+	for {
+		page, err := q.PaginateEmbeddings(ctx, queries.PaginateEmbeddingsParams{
+			ID:    lastID,
+			Limit: 1000,
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, e := range page {
+			lastID = e.ID
+			model, ok := embeddings[e.Model]
+			if !ok {
+				unknown[e.Model]++
+				continue
+			}
+			r := reports[e.Model]
+			if r == nil {
+				r = &integrityReport{}
+				reports[e.Model] = r
+			}
+			r.checked++
+
+			v, err := UnmarshalFloat32ArrayWithLength(e.Embedding)
+			switch {
+			case err != nil:
+				r.corrupt++
+			case len(v) != model.Dimensions:
+				r.mismatched++
+			case model.Validate(v) != nil:
+				r.unnormalized++
+				if repair {
+					if err := repairUnnormalized(ctx, q, e, v); err != nil {
+						return err
+					}
+				}
+				continue
+			default:
+				continue
+			}
+			if repair {
+				if err := q.DeleteEmbedding(ctx, e.ID); err != nil {
+					return errors.WithStack(err)
+				}
+			}
+		}
+	}
+
+	for model, count := range unknown {
+		l.Warn("embeddings for unknown model", slog.String("model", model), slog.Int("count", count))
+	}
+	for model, r := range reports {
+		attrs := []any{slog.String("model", model), slog.Int("checked", r.checked), slog.Int("corrupt", r.corrupt),
+			slog.Int("mismatched", r.mismatched), slog.Int("unnormalized", r.unnormalized)}
+		switch {
+		case r.problems() == 0:
+			l.Info("embeddings ok", attrs...)
+		case repair:
+			l.Warn("repaired embeddings", attrs...)
+		default:
+			l.Warn("invalid embeddings, run with -repair to fix", attrs...)
+		}
+	}
+	l.Info("checked embeddings", slog.Duration("elapsed", time.Since(start)))
+	return nil
+}
+
+func repairUnnormalized(ctx context.Context, q *queries.Queries, e queries.Embedding, v []float32) error {
+	blob, err := MarshalFloat32ArrayWithLength(normalize(v))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = q.UpdateEmbedding(ctx, queries.UpdateEmbeddingParams{
+		Embedding:   blob,
+		ContentHash: e.ContentHash,
+		UpdatedAt:   int(time.Now().Unix()),
+		ID:          e.ID,
+	})
+	return errors.WithStack(err)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"github.com/newhook/whoishiring/hashing"
+	"github.com/newhook/whoishiring/queries"
+	"math"
+	"testing"
+)
+
+func TestCheckEmbeddings(t *testing.T) {
+	q := newFixtureDB(t)
+	ctx := context.Background()
+
+	get := func(id int) (queries.Embedding, bool) {
+		t.Helper()
+		embeddings, err := q.GetEmbeddingsByParent(ctx, queries.GetEmbeddingsByParentParams{Model: Fake, Parent: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range embeddings {
+			if e.ItemID == id {
+				return e, true
+			}
+		}
+		return queries.Embedding{}, false
+	}
+	set := func(id int, v []float32, blob []byte) {
+		t.Helper()
+		e, _ := get(id)
+		if v != nil {
+			var err error
+			if blob, err = MarshalFloat32ArrayWithLength(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := q.UpdateEmbedding(ctx, queries.UpdateEmbeddingParams{Embedding: blob, ContentHash: e.ContentHash, ID: e.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Truncated.
+	corrupt, _ := get(1001)
+	set(1001, nil, corrupt.Embedding[:len(corrupt.Embedding)-4])
+	set(1002, make([]float32, hashing.Dimensions/2), nil)
+	unnormalized := make([]float32, hashing.Dimensions)
+	unnormalized[0], unnormalized[1] = 3, 4
+	set(1003, unnormalized, nil)
+
+	if err := CheckEmbeddings(ctx, testLogger(), q, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{1001, 1002, 1003} {
+		if _, ok := get(id); !ok {
+			t.Fatalf("expected the check to leave %d alone", id)
+		}
+	}
+
+	if err := CheckEmbeddings(ctx, testLogger(), q, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{1001, 1002} {
+		if _, ok := get(id); ok {
+			t.Errorf("expected the broken embedding of %d to be deleted", id)
+		}
+	}
+	e, ok := get(1003)
+	if !ok {
+		t.Fatal("expected the unnormalized embedding to be kept")
+	}
+	v, err := UnmarshalFloat32ArrayWithLength(e.Embedding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(float64(v[0])-0.6) > 1e-6 || math.Abs(float64(v[1])-0.8) > 1e-6 || embeddings[Fake].Validate(v) != nil {
+		t.Errorf("expected the embedding to be normalized, got %v", v[:2])
+	}
+	if _, ok := get(1004); !ok {
+		t.Error("expected the valid embeddings to be kept")
+	}
+
+	// The deleted embeddings are recreated.
+	if err := CreateEmbeddings(ctx, testLogger(), q, Fake); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{1001, 1002} {
+		e, ok := get(id)
+		if !ok || validateBlob(embeddings[Fake], e.Embedding) != nil {
+			t.Errorf("expected the embedding of %d to be recreated", id)
+		}
+	}
+}
@@ -8,9 +8,10 @@ import (
 	"github.com/pkg/errors"
 	"io"
 	"log/slog"
+	"maps"
 	"os"
 	"os/exec"
-	"strconv"
+	"slices"
 	"strings"
 	"time"
 )
@@ -38,99 +39,211 @@ type SearchTerms struct {
 	ResumeName string
 	Resume     Reader
 	Size       int64
+
+	// JobID is a "Who is hiring?" comment and JobURL a page describing the job, for employer searches.
+	// The job description of an employer search joins JobPrompt, the uploaded document and these.
+	JobID  int
+	JobURL string
+
+	// Candidates is how many vector search results are reranked, DefaultCandidates if zero.
+	Candidates int
+	// TokenBudget limits the prompt tokens of each reranking request, DefaultTokenBudget if zero.
+	TokenBudget int
+
+	// PromptVariant overrides the prompt variants the search is assigned to.
+	PromptVariant string
+
+	// NoCache bypasses the completion cache.
+	NoCache bool
+
+	// Principal is who the search spends the budget of, see principal.
+	Principal string
+
+	// Exclusions are what the searcher doesn't want, e.g. "no crypto" or "not onsite", and Dislikes the
+	// comments they don't want more like. Comments similar to them rank lower or are left out, disliked
+	// comments always are, and the completion model is told about both.
+	Exclusions []string
+	Dislikes   []int
+
+	// Session is the search refined by Instruction, e.g. "more like #2 but remote". Its resume summary
+	// and query embeddings are reused, and the completion model revises its prompt and search terms.
+	// Other searches start a new session.
+	Session     *Session
+	Instruction string
 }
 
 type JobSearchResponse struct {
-	Items            []queries.Item
-	Comments         []int
-	Parents          []int
-	HNLinks          []string
-	ResumeSummary    string
-	SearchTerms      []string
-	TotalPosts       int
-	TotalItems       int
-	Posts            int
-	ItemsSearched    int
-	Latencies        map[string]float64
+	Items    []queries.Item
+	Comments []int
+	Parents  []int
+	// Picks explain why each of the Comments was chosen, in the same order.
+	Picks         []Pick
+	HNLinks       []string
+	ResumeSummary string
+	SearchTerms   []string
+	TotalPosts    int
+	TotalItems    int
+	Posts         int
+	ItemsSearched int
+	Latencies     map[string]float64
+	// Usage totals the tokens and cost of the search's completion and embedding calls.
+	Usage Usage
+	// Degraded is why the completion model was skipped, when its budget is exhausted. The results
+	// are ranked by vector search only.
+	Degraded string
+	// Flagged are the reasons the vector search results that look like prompt injections were flagged
+	// for, by comment ID. Their picks are ranked last.
+	Flagged map[int][]string
+	// Providers are the completion models that served each task, and the embedding models under
+	// "embedding".
+	Providers map[string][]string
+	// SessionID identifies the session to refine the search in.
+	SessionID string
+	// Diff compares the picks of a refinement with the previous ones.
+	Diff *Diff
+	// JobDescriptionFlagged are the reasons the job description of an employer search was flagged by
+	// detectInjection.
+	JobDescriptionFlagged []string
+	// PromptVersions are the versions of the prompts used, by name.
+	PromptVersions   map[string]string
 	OriginalComments []int
 	OriginalParents  []int
 }
 
+// Event reports the progress of a job search, and results as soon as they exist.
+type Event struct {
+	Name string
+	Data any
+}
+
 func JobSearch(ctx context.Context, l *slog.Logger, q *queries.Queries, search SearchTerms) (JobSearchResponse, error) {
+	return StreamJobSearch(ctx, l, q, search, nil)
+}
+
+// StreamJobSearch is JobSearch calling emit after each step: "progress" with the step's latency,
+// "resume_summary" for job searches, "search_terms", "candidates" with the vector search results,
+// and "delta" with the picks as the completion model generates them. The completion isn't streamed when emit is nil.
+//
+// Searches of "Who wants to be hired?" are employer searches: the input is a job description rather
+// than a resume, and job seekers are ranked for it.
+func StreamJobSearch(ctx context.Context, l *slog.Logger, q *queries.Queries, search SearchTerms, emit func(Event)) (JobSearchResponse, error) {
+	employer := search.SearchType == SearchType_WhoWantToBeHired
+	termsTask, rankTask := searchTasks(search.SearchType)
+	var delta deltaFunc
+	if emit == nil {
+		emit = func(Event) {}
+	} else {
+		delta = func(attempt int, text string) {
+			emit(Event{Name: "delta", Data: map[string]any{"task": rankTask.name, "attempt": attempt, "text": text}})
+		}
+	}
+
 	resp := JobSearchResponse{
 		Latencies: map[string]float64{},
 	}
+	var cr *completer
 	start := time.Now()
-	recordLatency := func(step string) {
+	// recordLatency records the latency of step, and whether the completions of its task were all
+	// served from the cache as <step>_cached.
+	recordLatency := func(step string, task string) {
 		resp.Latencies[step] = time.Since(start).Seconds()
 		start = time.Now()
+		cached := task != "" && cr.cached(task)
+		if cached {
+			resp.Latencies[step+"_cached"] = 1
+		}
+		emit(Event{Name: "progress", Data: map[string]any{"step": step, "seconds": resp.Latencies[step], "cached": cached}})
 	}
-	var clause string
-	switch search.SearchType {
-	case SearchType_WhoIsHiring:
-		clause = whoIsHiring
-	case SearchType_WhoWantToBeHired:
-		clause = whoWantsToBeHired
-	default:
-		return resp, errors.Errorf("invalid search type: %s", search.SearchType)
+	clause, err := searchClause(search.SearchType)
+	if err != nil {
+		return resp, err
+	}
+	if search.Candidates == 0 {
+		search.Candidates = DefaultCandidates
+	}
+	if search.Candidates < 1 || search.Candidates > MaxCandidates {
+		return resp, errors.Errorf("invalid number of candidates %d, expected 1 to %d", search.Candidates, MaxCandidates)
+	}
+	if search.TokenBudget == 0 {
+		search.TokenBudget = DefaultTokenBudget
+	}
+	if search.TokenBudget < MinTokenBudget {
+		return resp, errors.Errorf("invalid token budget %d, expected at least %d", search.TokenBudget, MinTokenBudget)
+	}
+	prompts, err := promptRegistry.Select(search.PromptVariant)
+	if err != nil {
+		return resp, err
+	}
+	resp.PromptVersions = prompts.Versions()
+	var cache *CompletionCache
+	if *completionCacheTTL > 0 && !search.NoCache {
+		cache = NewCompletionCache(q, *completionCacheTTL)
+	}
+	meter := NewMeter(q, search.Principal)
+	cr = newCompleter(prompts, cache, meter)
+	// degrade reports whether err is the exhausted completion budget, which falls back to vector search.
+	degrade := func(err error) bool {
+		var budgetErr *BudgetError
+		if !errors.As(err, &budgetErr) || budgetErr.Endpoint != CompletionEndpoint {
+			return false
+		}
+		if resp.Degraded == "" {
+			resp.Degraded = budgetErr.Error()
+			l.Warn("falling back to vector search", slog.String("reason", resp.Degraded))
+			emit(Event{Name: "degraded", Data: map[string]any{"reason": resp.Degraded}})
+		}
+		return true
 	}
 
-	resume := ""
-	if search.LinkedIn != "" {
-		var err error
-		resume, err = scrapeLinkedIn(ctx, q, search.LinkedIn)
+	session := search.Session
+	if session == nil {
+		session, err = newSession(search)
 		if err != nil {
 			return resp, err
 		}
-		recordLatency("scrape_linkedin")
-	} else if search.Resume != nil && strings.HasSuffix(search.ResumeName, "pdf") {
-		file, err := os.CreateTemp("", "*.pdf")
+	}
+
+	resume := ""
+	if search.Session != nil {
+		resp.ResumeSummary = session.ResumeSummary
+	} else if employer {
+		search.JobPrompt, err = readJobDescription(ctx, q, search)
 		if err != nil {
-			return resp, errors.WithStack(err)
+			return resp, err
 		}
-		defer os.Remove(file.Name())
-		f, err := os.OpenFile(file.Name(), os.O_RDWR, 0644)
-		if err != nil {
-			return resp, errors.WithStack(err)
+		resp.JobDescriptionFlagged = detectInjection(search.JobPrompt)
+		if resp.JobDescriptionFlagged != nil {
+			l.Warn("job description looks like a prompt injection", slog.Any("reasons", resp.JobDescriptionFlagged))
 		}
-		defer f.Close()
-		_, err = io.Copy(f, search.Resume)
+		recordLatency("job_description", "")
+	} else if search.LinkedIn != "" {
+		var err error
+		resume, err = scrapeLinkedIn(ctx, q, meter, search.LinkedIn)
 		if err != nil {
-			return resp, errors.WithStack(err)
-		}
-
-		// See "man pdftotext" for more options.
-		args := []string{
-			"-layout",   // Maintain (as best as possible) the original physical layout of the text.
-			"-nopgbrk",  // Don't insert page breaks (form feed characters) between pages.
-			file.Name(), // The input file.
-			"-",         // Send the output to stdout.
-		}
-		cmd := exec.CommandContext(context.Background(), "pdftotext", args...)
-
-		var buf bytes.Buffer
-		cmd.Stdout = &buf
-
-		if err := cmd.Run(); err != nil {
-			return resp, errors.WithStack(err)
+			return resp, err
 		}
-
-		resume = buf.String()
+		recordLatency("scrape_linkedin", "")
 	} else if search.Resume != nil {
-		b, err := io.ReadAll(search.Resume)
+		var err error
+		resume, err = readDocument(search.ResumeName, search.Resume)
 		if err != nil {
-			return resp, errors.WithStack(err)
+			return resp, err
 		}
-		resume = string(b)
 	}
 
 	if len(resume) > 0 {
-		analyze, err := AnalyzeResume(ctx, resume)
+		analyze, err := cr.AnalyzeResume(ctx, resume)
+		if degrade(err) {
+			// Search with the resume itself.
+			analyze, err = resume, nil
+		} else if err == nil {
+			resp.ResumeSummary = analyze
+			emit(Event{Name: "resume_summary", Data: map[string]any{"resume_summary": analyze}})
+		}
 		if err != nil {
 			return resp, err
 		}
-		recordLatency("analyze_resume")
-		resp.ResumeSummary = analyze
+		recordLatency("analyze_resume", analyzeResumeTask.name)
 		if search.JobPrompt != "" {
 			search.JobPrompt = fmt.Sprintf("%s\nIn addition consider the following %s", search.JobPrompt, analyze)
 		} else {
@@ -138,62 +251,113 @@ func JobSearch(ctx context.Context, l *slog.Logger, q *queries.Queries, search S
 		}
 	}
 
-	terms, err := GetTerms(ctx, search.JobPrompt)
+	prefs, err := getPreferences(ctx, q, search)
 	if err != nil {
 		return resp, err
 	}
-	recordLatency("get_terms")
+	var terms, likeTerms []string
+	var like []int
+	vectors := map[string][]float32{}
+	exclude := NewSet[int](session.Exclude...)
+	for _, id := range search.Dislikes {
+		exclude.Add(id)
+	}
+	if search.Session != nil {
+		r, err := refine(ctx, q, cr, session, search.Instruction)
+		if degrade(err) {
+			r, err = refinement{
+				Prompt: fmt.Sprintf("%s\n%s", search.JobPrompt, search.Instruction),
+				Terms:  append(slices.Clip(session.SearchTerms), search.Instruction),
+			}, nil
+		}
+		if err != nil {
+			return resp, err
+		}
+		recordLatency("refine", refineTaskFor(search.SearchType).name)
+		search.JobPrompt, terms, like = r.Prompt, r.Terms, r.Like
+		if r.Months > 0 {
+			search.Months = r.Months
+		}
+		for _, id := range r.Exclude {
+			exclude.Add(id)
+		}
+		// Terms the refinement kept aren't embedded again, and the picks to find more like are searched
+		// for with their own embeddings.
+		maps.Copy(vectors, session.vectors())
+		likeTerms, err = itemVectors(ctx, q, like, vectors)
+		if err != nil {
+			return resp, err
+		}
+	} else {
+		terms, err = cr.GetTerms(ctx, termsTask, searchPrompt(search.SearchType, search.JobPrompt), prefs)
+		if degrade(err) {
+			terms, err = []string{search.JobPrompt}, nil
+		}
+		if err != nil {
+			return resp, err
+		}
+		recordLatency("get_terms", termsTask.name)
+	}
 	resp.SearchTerms = terms
+	emit(Event{Name: "search_terms", Data: map[string]any{"search_terms": terms}})
 
-	limit := 10
-	queryResults, err := VectorSearch(ctx, l, q, search.Months, *embeddingModel, clause, terms, limit)
+	var negatives []string
+	for _, exclusion := range search.Exclusions {
+		negatives = append(negatives, negativeTerm(exclusion))
+	}
+	dislikeTerms, err := itemVectors(ctx, q, search.Dislikes, vectors)
 	if err != nil {
 		return resp, err
 	}
-	recordLatency("vector_search")
+	negatives = append(negatives, dislikeTerms...)
+
+	queryResults, err := VectorSearch(ctx, l, q, meter, search.Months, *embeddingModel, clause, append(slices.Clip(terms), likeTerms...), negatives, vectors, search.Candidates+len(exclude))
+	if err != nil {
+		return resp, err
+	}
+	queryResults.Results = slices.DeleteFunc(queryResults.Results, func(r Result) bool { return exclude.Contains(r.ID) })
+	queryResults.Results = queryResults.Results[:min(search.Candidates, len(queryResults.Results))]
+	recordLatency("vector_search", "")
 	resp.ItemsSearched = queryResults.Searched
 	resp.Posts = queryResults.Posts
 	resp.TotalItems = queryResults.TotalItems
 	resp.TotalPosts = queryResults.TotalPosts
 
+	resp.Flagged = flagInjections(queryResults.Results)
+	var candidates []queries.Item
 	for _, result := range queryResults.Results {
 		resp.OriginalComments = append(resp.OriginalComments, result.Item.ID)
 		resp.OriginalParents = append(resp.OriginalParents, result.Item.Parent)
+		candidates = append(candidates, result.Item)
 	}
+	emit(Event{Name: "candidates", Data: map[string]any{
+		"original_comments": resp.OriginalComments,
+		"original_parents":  resp.OriginalParents,
+		"items":             candidates,
+		"items_searched":    resp.ItemsSearched,
+		"flagged":           resp.Flagged,
+	}})
 
-	type jobDescription struct {
-		ID      int    `json:"id"`
-		Date    string `json:"date"`
-		Content string `json:"content"`
-	}
-	var descriptions []jobDescription
-	for _, result := range queryResults.Results {
-		descriptions = append(descriptions, jobDescription{
-			ID:      result.ID,
-			Date:    time.Unix(int64(result.Item.Time), 0).String(),
-			Content: result.Item.Text,
-		})
+	picks, err := rerank(ctx, l, cr, rankTask, searchPrompt(search.SearchType, search.JobPrompt), prefs, queryResults.Results, search.TokenBudget, emit, delta)
+	if degrade(err) {
+		picks, err = similarityPicks(queryResults.Results), nil
 	}
-
-	jobIDs, err := GetJobs(ctx, map[string]any{
-		"Prompt": search.JobPrompt,
-		"Jobs":   descriptions,
-	})
 	if err != nil {
 		return resp, err
 	}
-	recordLatency("get_jobs")
+	recordLatency("get_jobs", rankTask.name)
 
 	// The comments must be contained in the original query results.
-	for _, id := range jobIDs {
-		n, err := strconv.Atoi(id)
-		if err != nil {
-			return resp, err
-		}
+	for _, pick := range picks {
 		for _, result := range queryResults.Results {
-			if result.ID == n {
+			if result.ID == pick.ID {
+				if employer {
+					c := parseCandidate(result.Item.Text)
+					pick.Candidate = &c
+				}
 				resp.Comments = append(resp.Comments, result.Item.ID)
 				resp.Parents = append(resp.Parents, result.Item.Parent)
+				resp.Picks = append(resp.Picks, pick)
 				break
 			}
 		}
@@ -212,5 +376,90 @@ func JobSearch(ctx context.Context, l *slog.Logger, q *queries.Queries, search S
 	for _, parent := range allParents {
 		resp.Items = append(resp.Items, parent)
 	}
+	resp.Providers = cr.providers.values()
+	resp.Providers["embedding"] = queryResults.EmbeddingModels
+	if search.Session != nil {
+		resp.Diff = diffPicks(session.Comments, resp.Comments)
+	}
+	session.Exclude = exclude.Values()
+	slices.Sort(session.Exclude)
+	session.addTurn(search, like, queryResults.Vectors, queryResults.Results, resp)
+	if err := SaveSession(ctx, q, session); err != nil {
+		return resp, err
+	}
+	resp.SessionID = session.ID
+	resp.Usage = meter.Totals()
 	return resp, nil
 }
+
+// searchClause returns the title clause of the posts a search of searchType searches.
+func searchClause(searchType SearchType) (string, error) {
+	switch searchType {
+	case SearchType_WhoIsHiring:
+		return whoIsHiring, nil
+	case SearchType_WhoWantToBeHired:
+		return whoWantsToBeHired, nil
+	default:
+		return "", errors.Errorf("invalid search type: %d", searchType)
+	}
+}
+
+// searchTasks returns the tasks generating the search terms and ranking the results of a search of
+// searchType, the employer tasks for "Who wants to be hired?".
+func searchTasks(searchType SearchType) (task, task) {
+	if searchType == SearchType_WhoWantToBeHired {
+		return candidateTermsTask, candidateSearchTask
+	}
+	return searchTermsTask, jobSearchTask
+}
+
+// refineTaskFor returns the task refining the sessions of searchType.
+func refineTaskFor(searchType SearchType) task {
+	if searchType == SearchType_WhoWantToBeHired {
+		return candidateRefineTask
+	}
+	return refineTask
+}
+
+// readDocument returns the text of an uploaded document, a PDF or text file.
+func readDocument(name string, r Reader) (string, error) {
+	if !strings.HasSuffix(name, "pdf") {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		return string(b), nil
+	}
+
+	file, err := os.CreateTemp("", "*.pdf")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer os.Remove(file.Name())
+	f, err := os.OpenFile(file.Name(), os.O_RDWR, 0644)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	// See "man pdftotext" for more options.
+	args := []string{
+		"-layout",   // Maintain (as best as possible) the original physical layout of the text.
+		"-nopgbrk",  // Don't insert page breaks (form feed characters) between pages.
+		file.Name(), // The input file.
+		"-",         // Send the output to stdout.
+	}
+	cmd := exec.CommandContext(context.Background(), "pdftotext", args...)
+
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+
+	if err := cmd.Run(); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return buf.String(), nil
+}
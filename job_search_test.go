@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/newhook/whoishiring/hn"
+	"github.com/newhook/whoishiring/llm"
+	"github.com/newhook/whoishiring/queries"
+	"github.com/pkg/errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testCompletion = "test"
+
+// testLLM answers with a canned resume summary and search terms, and picks the
+// first three candidates in the order vector search ranked them, so the results
+// only depend on the fake embeddings.
+type testLLM struct {
+	terms []string
+	// invalid is the number of responses to answer with output not matching the schema.
+	invalid int
+	mutex   sync.Mutex
+	// requests are the requests received.
+	requests []llm.Request
+}
+
+var (
+	testLLMClient = &testLLM{}
+	jobIDs        = regexp.MustCompile(`<(?:job|candidate) id="(\d+)"`)
+)
+
+func init() {
+	completions[testCompletion] = Completion{
+		Model: testCompletion,
+		LLM:   testLLMClient,
+	}
+}
+
+func (t *testLLM) Complete(ctx context.Context, req llm.Request) (llm.Response, error) {
+	t.mutex.Lock()
+	t.requests = append(t.requests, req)
+	invalid := t.invalid > 0
+	if invalid {
+		t.invalid--
+	}
+	t.mutex.Unlock()
+	if invalid {
+		return llm.Response{Text: `["not", "an", "object"]`, Model: testCompletion}, nil
+	}
+
+	var result any
+	switch req.Task {
+	case "resume":
+		result = map[string]string{"summary": "Backend engineer experienced with Go and Kubernetes"}
+	case "terms", "candidate_terms":
+		result = map[string][]string{"terms": t.terms}
+	case "job_search", "candidate_search":
+		var picks []Pick
+		for i, m := range jobIDs.FindAllStringSubmatch(req.Messages[0].Content, 3) {
+			id, _ := strconv.Atoi(m[1])
+			picks = append(picks, Pick{
+				ID:                  id,
+				Rationale:           "Ranked by vector search",
+				MatchedRequirements: []string{"Go"},
+				Concerns:            []string{},
+				Score:               10 - i,
+			})
+		}
+		result = map[string][]Pick{"jobs": picks}
+	case "refine", "candidate_refine":
+		// Drop the first of the previous picks, and find more like the second.
+		var ids []int
+		for _, m := range jobIDs.FindAllStringSubmatch(req.Messages[0].Content, 2) {
+			id, _ := strconv.Atoi(m[1])
+			ids = append(ids, id)
+		}
+		result = refinement{
+			Prompt:  "refined prompt",
+			Terms:   t.terms,
+			Like:    ids[1:],
+			Exclude: ids[:1],
+		}
+	default:
+		return llm.Response{}, errors.Errorf("unexpected task %s", req.Task)
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		return llm.Response{}, err
+	}
+	return llm.Response{Text: string(b), Model: testCompletion, Usage: llm.Usage{InputTokens: 100, OutputTokens: 10}}, nil
+}
+
+// newFixtureDB creates a database holding testdata/items.json with fake embeddings.
+func newFixtureDB(t *testing.T) *queries.Queries {
+	t.Helper()
+	ctx := context.Background()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "whoishiring.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrate(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, ddl); err != nil {
+		t.Fatal(err)
+	}
+	q := queries.New(db)
+
+	b, err := os.ReadFile("testdata/items.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []hn.Item
+	if err := json.Unmarshal(b, &items); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		if err := insertItem(ctx, q, item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := CreateEmbeddings(ctx, testLogger(), q, Fake); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func useTestModels(t *testing.T, terms ...string) {
+	t.Helper()
+	embedding, completion := *embeddingModel, *completionModel
+	*embeddingModel, *completionModel = Fake, testCompletion
+	testLLMClient.terms = terms
+	testLLMClient.invalid = 0
+	testLLMClient.requests = nil
+	t.Cleanup(func() {
+		*embeddingModel, *completionModel = embedding, completion
+	})
+}
+
+func testPrompts(t *testing.T) PromptSet {
+	t.Helper()
+	prompts, err := promptRegistry.Select("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prompts
+}
+
+func TestCreateEmbeddingsIsIncremental(t *testing.T) {
+	q := newFixtureDB(t)
+	ctx := context.Background()
+
+	before, err := q.GetEmbeddingsByParent(ctx, queries.GetEmbeddingsByParentParams{Model: Fake, Parent: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != 6 {
+		t.Fatalf("expected 6 embeddings, got %d", len(before))
+	}
+	if err := CreateEmbeddings(ctx, testLogger(), q, Fake); err != nil {
+		t.Fatal(err)
+	}
+	after, err := q.GetEmbeddingsByParent(ctx, queries.GetEmbeddingsByParentParams{Model: Fake, Parent: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("expected %d embeddings after a second run, got %d", len(before), len(after))
+	}
+}
+
+func TestJobSearch(t *testing.T) {
+	useTestModels(t, "remote Go backend engineer, distributed systems and Kubernetes")
+	q := newFixtureDB(t)
+
+	resp, err := JobSearch(context.Background(), testLogger(), q, SearchTerms{
+		Months:     1,
+		SearchType: SearchType_WhoIsHiring,
+		JobPrompt:  "remote Go backend engineer, distributed systems and Kubernetes",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.OriginalComments) == 0 {
+		t.Fatal("expected vector search results")
+	}
+	if resp.OriginalComments[0] != 1001 {
+		t.Errorf("expected the Go backend job first, got %v", resp.OriginalComments)
+	}
+	if !slices.Equal(resp.Comments, resp.OriginalComments[:len(resp.Comments)]) {
+		t.Errorf("picks %v should follow the vector search order %v", resp.Comments, resp.OriginalComments)
+	}
+	if len(resp.Picks) != len(resp.Comments) || resp.Picks[0].ID != 1001 || resp.Picks[0].Score != 10 || resp.Picks[0].Rationale == "" {
+		t.Errorf("expected an explanation for each pick, got %+v", resp.Picks)
+	}
+	for _, parent := range resp.Parents {
+		if parent != 1000 {
+			t.Errorf("expected picks from the hiring thread, got parent %d", parent)
+		}
+	}
+	if resp.ItemsSearched != 6 {
+		t.Errorf("expected 6 items searched, got %d", resp.ItemsSearched)
+	}
+	if !slices.ContainsFunc(resp.Items, func(item queries.Item) bool { return item.ID == 1000 }) {
+		t.Error("expected the parent post in the items")
+	}
+}
+
+func TestJobSearchWithResume(t *testing.T) {
+	useTestModels(t, "Backend engineer experienced with Go and Kubernetes")
+	q := newFixtureDB(t)
+
+	resp, err := JobSearch(context.Background(), testLogger(), q, SearchTerms{
+		Months:     1,
+		SearchType: SearchType_WhoIsHiring,
+		ResumeName: "resume.txt",
+		Resume:     strings.NewReader("Ten years building backend services."),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.ResumeSummary == "" {
+		t.Error("expected a resume summary")
+	}
+	if len(resp.Comments) == 0 || resp.Comments[0] != 1001 {
+		t.Errorf("expected the Go backend job first, got %v", resp.Comments)
+	}
+	for _, parent := range resp.Parents {
+		if parent != 1000 {
+			t.Errorf("expected picks from the hiring thread, got parent %d", parent)
+		}
+	}
+}
+
+func TestCompletionRepairsInvalidOutput(t *testing.T) {
+	useTestModels(t, "remote Go backend engineer")
+	testLLMClient.invalid = 1
+
+	terms, err := newCompleter(testPrompts(t), nil, nil).GetTerms(context.Background(), searchTermsTask, "remote Go backend engineer", preferences{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(terms, []string{"remote Go backend engineer"}) {
+		t.Errorf("unexpected terms %v", terms)
+	}
+	if len(testLLMClient.requests) != 2 {
+		t.Fatalf("expected a single retry, got %d requests", len(testLLMClient.requests))
+	}
+	retry := testLLMClient.requests[1].Messages
+	if len(retry) != 3 || retry[1].Role != "assistant" || !strings.Contains(retry[2].Content, "$: expected object, got array") {
+		t.Errorf("expected the retry to explain the invalid output, got %+v", retry)
+	}
+}
+
+func TestCompletionFailsAfterRetry(t *testing.T) {
+	useTestModels(t, "remote Go backend engineer")
+	testLLMClient.invalid = 2
+
+	_, err := newCompleter(testPrompts(t), nil, nil).GetTerms(context.Background(), searchTermsTask, "remote Go backend engineer", preferences{})
+	var invalid *llm.InvalidOutputError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("expected an invalid output error, got %v", err)
+	}
+	if invalid.Task != "terms" || invalid.Output != `["not", "an", "object"]` {
+		t.Errorf("unexpected error %+v", invalid)
+	}
+}
+
+func TestJobSearchUsesCompletionCache(t *testing.T) {
+	useTestModels(t, "remote Go backend engineer, distributed systems and Kubernetes")
+	q := newFixtureDB(t)
+	search := SearchTerms{
+		Months:     1,
+		SearchType: SearchType_WhoIsHiring,
+		JobPrompt:  "remote Go backend engineer, distributed systems and Kubernetes",
+	}
+
+	first, err := JobSearch(context.Background(), testLogger(), q, search)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := first.Latencies["get_terms_cached"]; ok {
+		t.Error("expected the first search to miss the cache")
+	}
+	requests := len(testLLMClient.requests)
+
+	second, err := JobSearch(context.Background(), testLogger(), q, search)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testLLMClient.requests) != requests {
+		t.Errorf("expected no completions for a repeated search, got %d", len(testLLMClient.requests)-requests)
+	}
+	if second.Latencies["get_terms_cached"] != 1 || second.Latencies["get_jobs_cached"] != 1 {
+		t.Errorf("expected cache hits in the latencies, got %v", second.Latencies)
+	}
+	if !slices.Equal(first.Comments, second.Comments) {
+		t.Errorf("expected the cached picks %v, got %v", first.Comments, second.Comments)
+	}
+
+	search.NoCache = true
+	if _, err := JobSearch(context.Background(), testLogger(), q, search); err != nil {
+		t.Fatal(err)
+	}
+	if len(testLLMClient.requests) != requests+2 {
+		t.Errorf("expected the cache to be bypassed, got %d completions", len(testLLMClient.requests)-requests)
+	}
+}
+
+// strictSchema returns an error if an object in schema doesn't require all of its properties or
+// allows additional ones, which OpenAI's strict mode rejects.
+func strictSchema(path string, schema map[string]any) error {
+	if schema["type"] == "object" {
+		properties, _ := schema["properties"].(map[string]any)
+		required := map[string]bool{}
+		list, _ := schema["required"].([]any)
+		for _, name := range list {
+			required[name.(string)] = true
+		}
+		for name := range properties {
+			if !required[name] {
+				return errors.Errorf("%s.%s isn't required", path, name)
+			}
+		}
+		if schema["additionalProperties"] != false {
+			return errors.Errorf("%s allows additional properties", path)
+		}
+		for name, property := range properties {
+			if err := strictSchema(path+"."+name, property.(map[string]any)); err != nil {
+				return err
+			}
+		}
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		return strictSchema(path+"[]", items)
+	}
+	return nil
+}
+
+func TestTaskSchemasAreStrict(t *testing.T) {
+	for _, task := range []task{analyzeResumeTask, searchTermsTask, jobSearchTask, candidateTermsTask, candidateSearchTask, refineTask, candidateRefineTask} {
+		var schema map[string]any
+		if err := json.Unmarshal(task.schema.Schema, &schema); err != nil {
+			t.Fatalf("%s: %v", task.name, err)
+		}
+		if err := strictSchema(task.schema.Name, schema); err != nil {
+			t.Error(err)
+		}
+	}
+}
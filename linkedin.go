@@ -6,6 +6,7 @@ import (
 	_ "embed"
 	"encoding/json"
 	"github.com/newhook/whoishiring/linkedin"
+	"github.com/newhook/whoishiring/llm"
 	"github.com/newhook/whoishiring/queries"
 	"github.com/pkg/errors"
 	"strings"
@@ -20,7 +21,9 @@ var (
 	linkedInResumeTemplate = template.Must(template.New("linkedin_resume").Parse(linkedInResumeContent))
 )
 
-func scrapeLinkedIn(ctx context.Context, q *queries.Queries, link string) (string, error) {
+// scrapeLinkedIn returns the resume of the LinkedIn profile at link. Profiles are fetched once, the call
+// is checked against the budgets and recorded by m.
+func scrapeLinkedIn(ctx context.Context, q *queries.Queries, m *Meter, link string) (string, error) {
 	var jsonBody []byte
 	saved, err := q.GetLinkedInScrape(ctx, link)
 	if err != nil {
@@ -28,10 +31,16 @@ func scrapeLinkedIn(ctx context.Context, q *queries.Queries, link string) (strin
 			return "", errors.WithStack(err)
 		}
 
+		if err := m.Allow(ctx, LinkedInEndpoint); err != nil {
+			return "", err
+		}
 		profile, err := linkedin.Person(ctx, link)
 		if err != nil {
 			return "", err
 		}
+		if err := m.Record(ctx, LinkedInEndpoint, "proxycurl", proxycurlPerson, "resume", llm.Usage{}); err != nil {
+			return "", err
+		}
 		jsonBody, err = json.Marshal(profile)
 		if err != nil {
 			return "", errors.WithStack(err)
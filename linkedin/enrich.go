@@ -63,7 +63,7 @@ func Person(ctx context.Context, linkedInProfileUrl string) (*PersonEndpointResp
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("error response from the embedding API: " + resp.Status)
+		return nil, errors.New("error response from the Proxycurl API: " + resp.Status)
 	}
 
 	// Read response
@@ -0,0 +1,79 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+)
+
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Schema is a JSON schema the response must conform to. Providers that
+// support structured output enforce it, the root must be an object. OpenAI
+// enforces it in strict mode, so every object must list all of its properties
+// as required and set additionalProperties to false.
+type Schema struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema"`
+}
+
+// Request is a provider independent completion request.
+type Request struct {
+	// Task names the request, e.g. "terms", for logging.
+	Task      string    `json:"task"`
+	System    string    `json:"system,omitempty"`
+	Messages  []Message `json:"messages"`
+	MaxTokens int       `json:"max_tokens,omitempty"`
+	// Temperature is the provider's default when nil.
+	Temperature *float64 `json:"temperature,omitempty"`
+	Schema      *Schema  `json:"schema,omitempty"`
+	// PromptVersion identifies the prompt template the messages were rendered from.
+	PromptVersion string `json:"prompt_version,omitempty"`
+}
+
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type Response struct {
+	// Text is the completion, or the JSON arguments when a Schema was requested.
+	Text  string `json:"text"`
+	Model string `json:"model"`
+	Usage Usage  `json:"usage"`
+	// Cached is set when the response was served from a cache instead of the provider.
+	Cached bool `json:"cached,omitempty"`
+}
+
+// LLM is a completion provider.
+type LLM interface {
+	Complete(ctx context.Context, req Request) (Response, error)
+}
+
+// Streamer is implemented by providers that can stream a completion as it's generated. delta is called
+// with each chunk of text, the chunks concatenated are the Response's Text.
+type Streamer interface {
+	Stream(ctx context.Context, req Request, delta func(text string)) (Response, error)
+}
+
+// Stream streams the completion when l is a Streamer, otherwise the completion is passed to delta in
+// one chunk once it's complete.
+func Stream(ctx context.Context, l LLM, req Request, delta func(text string)) (Response, error) {
+	if s, ok := l.(Streamer); ok {
+		return s.Stream(ctx, req, delta)
+	}
+	resp, err := l.Complete(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	delta(resp.Text)
+	return resp, nil
+}
+
+// Temperature returns a pointer to t for Request.Temperature.
+func Temperature(t float64) *float64 {
+	return &t
+}
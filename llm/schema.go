@@ -0,0 +1,138 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"slices"
+	"strings"
+)
+
+// jsonSchema is the subset of JSON schema used for structured output: the keywords every provider's
+// structured output mode supports.
+type jsonSchema struct {
+	Type                 string                 `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+}
+
+// Validate checks that data is a single JSON value conforming to the schema. Errors name the path
+// of the offending value, e.g. `$.terms[1]: expected string, got number`.
+func (s *Schema) Validate(data []byte) error {
+	var schema jsonSchema
+	if err := json.Unmarshal(s.Schema, &schema); err != nil {
+		return errors.Wrapf(err, "invalid schema %s", s.Name)
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return errors.Wrap(err, "invalid JSON")
+	}
+	if d.More() {
+		return errors.New("invalid JSON: unexpected data after the value")
+	}
+	return schema.validate("$", v)
+}
+
+func (s *jsonSchema) validate(path string, v any) error {
+	if got := typeOf(v); s.Type != "" && s.Type != got && !(s.Type == "number" && got == "integer") {
+		return errors.Errorf("%s: expected %s, got %s", path, s.Type, got)
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return errors.Errorf("%s: missing property %q", path, name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			p, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return errors.Errorf("%s: unexpected property %q", path, name)
+				}
+				continue
+			}
+			if err := p.validate(path+"."+name, v[name]); err != nil {
+				return err
+			}
+		}
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return errors.Errorf("%s: invalid number %s", path, v)
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			return errors.Errorf("%s: expected at least %g, got %s", path, *s.Minimum, v)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return errors.Errorf("%s: expected at most %g, got %s", path, *s.Maximum, v)
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return errors.Errorf("%s: expected at least %d items, got %d", path, *s.MinItems, len(v))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return errors.Errorf("%s: expected at most %d items, got %d", path, *s.MaxItems, len(v))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func typeOf(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if strings.ContainsAny(v.String(), ".eE") {
+			return "number"
+		}
+		return "integer"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// InvalidOutputError is returned when a model's output doesn't conform to the requested schema.
+type InvalidOutputError struct {
+	Task  string
+	Model string
+	// Output is the offending completion.
+	Output string
+	Err    error
+}
+
+func (e *InvalidOutputError) Error() string {
+	return fmt.Sprintf("%s: %s returned output not matching the schema: %v", e.Task, e.Model, e.Err)
+}
+
+func (e *InvalidOutputError) Unwrap() error {
+	return e.Err
+}
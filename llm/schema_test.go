@@ -0,0 +1,48 @@
+package llm
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	schema := &Schema{
+		Name: "test",
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"terms": {"type": "array", "items": {"type": "string"}, "minItems": 1, "maxItems": 3},
+				"ids": {"type": "array", "items": {"type": "integer", "minimum": 1, "maximum": 10}}
+			},
+			"required": ["terms"],
+			"additionalProperties": false
+		}`),
+	}
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{data: `{"terms": ["go"], "ids": [1, 2]}`},
+		{data: ` {"terms": ["go", "rust"]} `},
+		{data: `["go"]`, err: "$: expected object, got array"},
+		{data: `{"ids": []}`, err: `$: missing property "terms"`},
+		{data: `{"terms": ["go", 1]}`, err: "$.terms[1]: expected string, got integer"},
+		{data: `{"terms": []}`, err: "$.terms: expected at least 1 items, got 0"},
+		{data: `{"terms": ["a", "b", "c", "d"]}`, err: "$.terms: expected at most 3 items, got 4"},
+		{data: `{"terms": ["go"], "ids": [1.5]}`, err: "$.ids[0]: expected integer, got number"},
+		{data: `{"terms": ["go"], "ids": [0]}`, err: "$.ids[0]: expected at least 1, got 0"},
+		{data: `{"terms": ["go"], "ids": [11]}`, err: "$.ids[0]: expected at most 10, got 11"},
+		{data: `{"terms": ["go"], "extra": true}`, err: `$: unexpected property "extra"`},
+		{data: "```json\n{\"terms\": [\"go\"]}\n```", err: "invalid JSON: invalid character '`' looking for beginning of value"},
+		{data: `{"terms": ["go"]} {"terms": ["rust"]}`, err: "invalid JSON: unexpected data after the value"},
+	}
+	for _, tt := range tests {
+		err := schema.Validate([]byte(tt.data))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.data, err)
+		case tt.err != "" && (err == nil || err.Error() != tt.err):
+			t.Errorf("%s: expected error %q, got %v", tt.data, tt.err, err)
+		}
+	}
+}
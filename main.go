@@ -10,7 +10,13 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/newhook/whoishiring/cassette"
+	"github.com/newhook/whoishiring/claude"
+	"github.com/newhook/whoishiring/ollama"
+	"github.com/newhook/whoishiring/openai"
 	"github.com/newhook/whoishiring/queries"
+	"github.com/newhook/whoishiring/transport"
+	"github.com/newhook/whoishiring/voyageai"
 	"github.com/pkg/errors"
 	slogecho "github.com/samber/slog-echo"
 	"golang.org/x/sync/errgroup"
@@ -21,6 +27,7 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -41,11 +48,49 @@ var banner string
 var ddl string
 
 var (
-	fake            = flag.Bool("fake", false, "use fake data")
-	completionModel = flag.String("completion", Claude, "completion model")
-	embeddingModel  = flag.String("embedding", OpenAI3Small, "embedding model")
+	fake               = flag.Bool("fake", false, "use fake data, replays recorded completions and uses the fake embedding model")
+	cassettesDir       = flag.String("cassettes", "cassettes", "directory of recorded completions, one file per completion model")
+	cassetteMode       = flag.String("cassette-mode", string(cassette.Passthrough), "passthrough calls the completion model, record also records its completions and replay only answers from the recordings")
+	completionModel    = flag.String("completion", Claude, "completion model, or a comma separated chain of them tried in order, e.g. claude,openai,ollama")
+	embeddingModel     = flag.String("embedding", OpenAI3Small, "embedding model")
+	embeddingFallback  = flag.String("embedding-fallbacks", "", "comma separated embedding models tried in order when the embedding model fails, their vectors must be compatible")
+	ollamaURL          = flag.String("ollama-url", ollama.DefaultBaseURL, "base URL of the Ollama API")
+	ollamaModel        = flag.String("ollama-model", ollama.DefaultChatModel, "Ollama completion model")
+	ollamaJSON         = flag.Bool("ollama-json", false, "use Ollama's JSON mode for completions")
+	check              = flag.Bool("check", false, "check the embeddings for corrupt blobs, wrong dimensions and unnormalized vectors at startup")
+	repair             = flag.Bool("repair", false, "check the embeddings at startup, deleting corrupt ones and normalizing unnormalized ones")
+	promptsDir         = flag.String("prompts", "prompts", "directory of prompt templates overriding the embedded ones")
+	promptsReload      = flag.Duration("prompts-reload", 5*time.Second, "how often to check the prompts directory for changes, 0 disables reloading")
+	promptAB           = flag.String("prompt-ab", "", "prompt variants to A/B test, e.g. job_search=b:0.5 assigns half the requests to job_search.b.tmpl")
+	sessionTTL         = flag.Duration("session-ttl", 7*24*time.Hour, "how long sessions are kept after their last search, 0 keeps them forever")
+	completionCacheTTL = flag.Duration("completion-cache-ttl", 7*24*time.Hour, "how long completions are cached, 0 disables the cache")
+	providersPath      = flag.String("providers", "", "JSON file of OpenAI-compatible providers to register as completion and embedding models")
+	similar            = flag.Int("similar", 0, "print the comments most similar to this comment and exit")
+	similarMonths      = flag.Int("similar-months", MaxWindow, "how many months -similar searches")
+	smtpAddr           = flag.String("smtp", "", "address of the SMTP server sending email digests, e.g. smtp.example.com:587, the password is read from SMTP_PASSWORD")
+	smtpFrom           = flag.String("smtp-from", "", "sender address of email digests")
+	smtpUsername       = flag.String("smtp-username", "", "SMTP username, if the server requires authentication")
+	trustedProxies     = flag.String("trusted-proxies", "", "comma separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For is trusted, e.g. 10.0.0.0/8")
+	refreshInterval    = flag.Duration("refresh", 6*time.Hour, "how often new posts are fetched and saved searches evaluated, 0 only fetches them at startup")
+
+	claudeLimits   transport.Limits
+	openaiLimits   transport.Limits
+	voyageaiLimits = transport.Limits{RequestsPerSecond: 4}
+	ollamaLimits   transport.Limits
 )
 
+func init() {
+	flag.Var(&claudeLimits, "claude-limits", "Anthropic rate limits, e.g. rps=1,tpm=80000")
+	flag.Var(&openaiLimits, "openai-limits", "OpenAI rate limits, e.g. rps=5,tpm=1000000")
+	flag.Var(&voyageaiLimits, "voyageai-limits", "Voyage AI rate limits, e.g. rps=4,tpm=1000000")
+	flag.Var(&ollamaLimits, "ollama-limits", "Ollama rate limits, e.g. rps=10")
+	flag.Var(&taskCompletions, "task-completion", "completion chains of tasks overriding -completion, e.g. job_search=claude,openai;terms=ollama,claude")
+	flag.IntVar(&breakerFailures, "breaker-failures", breakerFailures, "consecutive failures after which a provider is skipped")
+	flag.DurationVar(&breakerCooldown, "breaker-cooldown", breakerCooldown, "how long a failing provider is skipped")
+	flag.Var(&userBudget, "user-budget", "daily budget of each API key or address, e.g. completion.usd=1,embedding.tokens=100000,linkedin.usd=0.1")
+	flag.Var(&globalBudget, "global-budget", "daily budget of all requests, e.g. completion.usd=20,linkedin.usd=2")
+}
+
 func main() {
 	flag.Parse()
 
@@ -62,14 +107,60 @@ func main() {
 func run(ctx context.Context, l *slog.Logger) error {
 	fmt.Println(banner)
 
+	if *fake {
+		*embeddingModel = Fake
+		*cassetteMode = string(cassette.Replay)
+	}
+	if *providersPath != "" {
+		if err := LoadProviders(*providersPath); err != nil {
+			return err
+		}
+	}
+	mode, err := cassette.ParseMode(*cassetteMode)
+	if err != nil {
+		return err
+	}
+	if err := useCassettes(*cassettesDir, mode); err != nil {
+		return err
+	}
+	ollama.DefaultBaseURL = *ollamaURL
+	ollamaClient.Model = *ollamaModel
+	ollamaClient.JSON = *ollamaJSON
+	claude.SetLimits(claudeLimits)
+	openai.SetLimits(openaiLimits)
+	voyageai.SetLimits(voyageaiLimits)
+	ollama.SetLimits(ollamaLimits)
+
+	if err := promptRegistry.Load(*promptsDir); err != nil {
+		return err
+	}
+	experiments, err := ParseExperiments(*promptAB)
+	if err != nil {
+		return err
+	}
+	if err := promptRegistry.SetExperiments(experiments); err != nil {
+		return err
+	}
+	l.Info("loaded prompts", slog.String("dir", *promptsDir), slog.Any("versions", promptRegistry.Versions()))
+
 	if err := ValidateEmbeddingModel(*embeddingModel); err != nil {
 		return err
 	}
 	if err := ValidateCompletionModel(*completionModel); err != nil {
 		return err
 	}
+	for _, chain := range taskCompletions {
+		if err := ValidateCompletionModel(strings.Join(chain, ",")); err != nil {
+			return err
+		}
+	}
+	if *embeddingFallback != "" {
+		embeddingFallbacks = strings.Split(*embeddingFallback, ",")
+	}
+	if err := ValidateEmbeddingFallbacks(*embeddingModel, embeddingFallbacks); err != nil {
+		return err
+	}
 
-	var err error
 	dbPath := "./whoishiring.db"
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
@@ -77,25 +168,70 @@ func run(ctx context.Context, l *slog.Logger) error {
 	}
 	defer db.Close()
 	l.Info("database opened", slog.String("path", dbPath))
+	if err := migrate(ctx, db); err != nil {
+		return err
+	}
 	if _, err := db.ExecContext(ctx, ddl); err != nil {
 		return errors.WithStack(err)
 	}
 
 	q := queries.New(db)
 
+	if *similar != 0 {
+		item, resp, err := SimilarItems(ctx, l, q, *similar, *similarMonths, DefaultCandidates)
+		if err != nil {
+			return err
+		}
+		printSimilar(os.Stdout, item, resp)
+		return nil
+	}
+
+	if *completionCacheTTL > 0 {
+		expired, err := NewCompletionCache(q, *completionCacheTTL).DeleteExpired(ctx)
+		if err != nil {
+			return err
+		}
+		l.Info("deleted expired completions", slog.Int64("count", expired))
+	}
+	if *sessionTTL > 0 {
+		expired, err := DeleteExpiredSessions(ctx, q, *sessionTTL)
+		if err != nil {
+			return err
+		}
+		l.Info("deleted expired sessions", slog.Int64("count", expired))
+	}
+
 	if err := FetchPosts(ctx, l, q); err != nil {
 		return err
 	}
 
+	// Scanning every embedding takes a while on a large database, so it's only done when asked.
+	if *check || *repair {
+		if err := CheckEmbeddings(ctx, l, q, *repair); err != nil {
+			return err
+		}
+	}
+
 	if err := CreateEmbeddings(ctx, l, q, *embeddingModel); err != nil {
 		return err
 	}
 
+	if err := EvaluateSavedSearches(ctx, l, q); err != nil {
+		return err
+	}
+
 	//if err := PrintTokens(ctx); err != nil {
 	//	return err
 	//}
 
+	proxies, err := ParseTrustedProxies(*trustedProxies)
+	if err != nil {
+		return err
+	}
+	SetAPIKeys(os.Getenv("API_KEYS"))
+
 	e := echo.New()
+	e.IPExtractor = IPExtractor(proxies)
 	e.Use(slogecho.New(l))
 	// For debugging this one is a pain.
 	//e.Use(middleware.TimeoutWithConfig(middleware.TimeoutConfig{
@@ -109,85 +245,168 @@ func run(ctx context.Context, l *slog.Logger) error {
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins: []string{"*"},                                        // Allow all origins
 		AllowMethods: []string{echo.GET, echo.PUT, echo.POST, echo.DELETE}, // Specify allowed methods
-		AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept},
+		AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, "X-API-Key"},
 	}))
+	e.Use(requireAPIKey)
 
 	e.POST("/jobs", func(c echo.Context) error {
-		if err := c.Request().ParseMultipartForm(32 << 20); err != nil { // 32 MB max memory
-			return err
-		}
+		return withSearchTerms(c, func(terms SearchTerms) error {
+			if err := CheckBudget(c.Request().Context(), q, terms); err != nil {
+				return searchFailed(c, l, err)
+			}
+			resp, err := JobSearch(c.Request().Context(), l, q, terms)
+			if err != nil {
+				return searchFailed(c, l, err)
+			}
+			return c.JSON(http.StatusOK, jobsResponse(resp))
+		})
+	})
+
+	e.POST("/jobs/stream", func(c echo.Context) error {
+		return withSearchTerms(c, func(terms SearchTerms) error {
+			// Once the stream starts, errors can only be events.
+			if err := CheckBudget(c.Request().Context(), q, terms); err != nil {
+				return searchFailed(c, l, err)
+			}
+			return streamJobSearch(c, l, q, terms)
+		})
+	})
 
-		monthsParam := c.FormValue("months")
-		prompt := c.FormValue("prompt")
-		searchType := c.FormValue("type")
-		linkedin := c.FormValue("linkedin")
-		form, err := c.MultipartForm()
+	e.GET("/items/:id/similar", func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
 		if err != nil {
-			log.Println(err.Error())
-			return err
+			return c.String(http.StatusBadRequest, "Invalid id parameter")
 		}
-		var terms SearchTerms
-		for _, files := range form.File {
-			if len(files) != 1 {
-				return c.String(http.StatusBadRequest, "Invalid number of files")
+		months := MaxWindow
+		if param := c.QueryParam("months"); param != "" {
+			months, err = strconv.Atoi(param)
+			if err != nil || months < 1 {
+				return c.String(http.StatusBadRequest, "Invalid months parameter")
 			}
-			file := files[0]
+		}
+		k := DefaultCandidates
+		if param := c.QueryParam("k"); param != "" {
+			k, err = strconv.Atoi(param)
+			if err != nil || k < 1 || k > MaxCandidates {
+				return c.String(http.StatusBadRequest, "Invalid k parameter")
+			}
+		}
+		item, resp, err := SimilarItems(c.Request().Context(), l, q, id, months, k)
+		if errors.Is(err, ErrItemNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		}
+		if err != nil {
+			l.Error("similar search failed", slog.String("error", err.Error()))
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, similarResponse(item, resp))
+	})
+
+	e.GET("/sessions/:id", func(c echo.Context) error {
+		session, err := GetSession(c.Request().Context(), q, c.Param("id"), principal(c))
+		if errors.Is(err, ErrSessionNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		}
+		if err != nil {
+			l.Error("couldn't get session", slog.String("error", err.Error()))
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		// The query embeddings are of no use to the client.
+		session.Vectors = nil
+		return c.JSON(http.StatusOK, session)
+	})
 
-			f, err := file.Open()
+	e.POST("/sessions/:id/refine", func(c echo.Context) error {
+		session, err := GetSession(c.Request().Context(), q, c.Param("id"), principal(c))
+		if errors.Is(err, ErrSessionNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		}
+		if err != nil {
+			return searchFailed(c, l, err)
+		}
+		instruction := c.FormValue("instruction")
+		if instruction == "" {
+			return c.String(http.StatusBadRequest, "Missing instruction parameter")
+		}
+		terms := session.Refinement(instruction)
+		if noCache := c.FormValue("no_cache"); noCache != "" {
+			terms.NoCache, err = strconv.ParseBool(noCache)
 			if err != nil {
-				return err
+				return c.String(http.StatusBadRequest, "Invalid no_cache parameter")
 			}
-			defer f.Close()
-
-			terms.ResumeName = file.Filename
-			terms.Resume = f
-			terms.Size = file.Size
 		}
+		if err := CheckBudget(c.Request().Context(), q, terms); err != nil {
+			return searchFailed(c, l, err)
+		}
+		resp, err := JobSearch(c.Request().Context(), l, q, terms)
+		if err != nil {
+			return searchFailed(c, l, err)
+		}
+		return c.JSON(http.StatusOK, jobsResponse(resp))
+	})
 
-		terms.Months, err = strconv.Atoi(monthsParam)
+	e.POST("/saved-searches", func(c echo.Context) error {
+		saved, err := savedSearchForm(c, q)
+		if errors.Is(err, ErrSessionNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		}
 		if err != nil {
-			return c.String(http.StatusBadRequest, "Invalid months parameter")
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		err = NewSavedSearch(c.Request().Context(), q, saved)
+		if errors.Is(err, ErrEmailRequiresAPIKey) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
 		}
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		saved.Vectors = nil
+		return c.JSON(http.StatusCreated, saved)
+	})
 
-		terms.LinkedIn = linkedin
-		terms.JobPrompt = prompt
+	e.GET("/saved-searches", func(c echo.Context) error {
+		searches, err := GetSavedSearches(c.Request().Context(), q, principal(c))
+		if err != nil {
+			l.Error("couldn't get saved searches", slog.String("error", err.Error()))
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		for _, s := range searches {
+			s.Vectors = nil
+		}
+		return c.JSON(http.StatusOK, searches)
+	})
 
-		if searchType == "hiring" {
-			terms.SearchType = SearchType_WhoIsHiring
-		} else if searchType == "seekers" {
-			terms.SearchType = SearchType_WhoWantToBeHired
+	e.DELETE("/saved-searches/:id", func(c echo.Context) error {
+		err := DeleteSavedSearch(c.Request().Context(), q, c.Param("id"), principal(c))
+		if errors.Is(err, ErrSavedSearchNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		}
+		if err != nil {
+			l.Error("couldn't delete saved search", slog.String("error", err.Error()))
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		}
+		return c.NoContent(http.StatusNoContent)
+	})
 
-		resp, err := JobSearch(c.Request().Context(), l, q, terms)
+	e.GET("/usage", func(c echo.Context) error {
+		// The report is everyone's spending, for the operators holding an API key.
+		if !authenticated(principal(c)) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "the usage report requires an API key"})
+		}
+		days := 30
+		if param := c.QueryParam("days"); param != "" {
+			var err error
+			days, err = strconv.Atoi(param)
+			if err != nil || days < 1 {
+				return c.String(http.StatusBadRequest, "Invalid days parameter")
+			}
+		}
+		report, err := GetUsageReport(c.Request().Context(), q, days)
 		if err != nil {
-			l.Error("job search failed", slog.String("error", err.Error()))
+			l.Error("usage report failed", slog.String("error", err.Error()))
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		}
-		var links []string
-		for _, id := range resp.Comments {
-			links = append(links, fmt.Sprintf("https://news.ycombinator.com/item?id=%d", id))
-		}
-
-		var originalLinks []string
-		for _, id := range resp.OriginalComments {
-			originalLinks = append(originalLinks, fmt.Sprintf("https://news.ycombinator.com/item?id=%d", id))
-		}
-		return c.JSON(http.StatusOK, map[string]any{
-			"comments":                   resp.Comments,
-			"parents":                    resp.Parents,
-			"items":                      resp.Items,
-			"original_comments":          resp.OriginalComments,
-			"original_parents":           resp.OriginalParents,
-			"hacker_news_links":          links,
-			"original_hacker_news_links": originalLinks,
-			"resume_summary":             resp.ResumeSummary,
-			"search_terms":               resp.SearchTerms,
-			"total_posts":                resp.TotalPosts,
-			"total_items":                resp.TotalItems,
-			"posts":                      resp.Posts,
-			"items_searched":             resp.ItemsSearched,
-			"latencies":                  resp.Latencies,
-		})
+		return c.JSON(http.StatusOK, report)
 	})
 
 	ln, err := net.Listen("tcp", ":8080")
@@ -211,6 +430,17 @@ func run(ctx context.Context, l *slog.Logger) error {
 		return nil
 	})
 
+	if *promptsReload > 0 {
+		g.Go(func() error {
+			return promptRegistry.Watch(ctx, l, *promptsReload)
+		})
+	}
+	if *refreshInterval > 0 {
+		g.Go(func() error {
+			return ScheduleRefresh(ctx, l, q, *refreshInterval)
+		})
+	}
+
 	<-ctx.Done()
 
 	// start gracefully shutdown with a timeout of 10 seconds.
@@ -223,3 +453,232 @@ func run(ctx context.Context, l *slog.Logger) error {
 
 	return g.Wait()
 }
+
+// withSearchTerms parses the multipart form of a job search and calls fn with the search terms. The
+// uploaded resume is open until fn returns.
+func withSearchTerms(c echo.Context, fn func(terms SearchTerms) error) error {
+	if err := c.Request().ParseMultipartForm(32 << 20); err != nil { // 32 MB max memory
+		return err
+	}
+
+	monthsParam := c.FormValue("months")
+	prompt := c.FormValue("prompt")
+	searchType := c.FormValue("type")
+	linkedin := c.FormValue("linkedin")
+	form, err := c.MultipartForm()
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	var terms SearchTerms
+	for _, files := range form.File {
+		if len(files) != 1 {
+			return c.String(http.StatusBadRequest, "Invalid number of files")
+		}
+		file := files[0]
+
+		f, err := file.Open()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		terms.ResumeName = file.Filename
+		terms.Resume = f
+		terms.Size = file.Size
+	}
+
+	terms.Months, err = strconv.Atoi(monthsParam)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid months parameter")
+	}
+
+	terms.LinkedIn = linkedin
+	terms.JobPrompt = prompt
+	terms.JobURL = c.FormValue("job_url")
+	if jobID := c.FormValue("job_id"); jobID != "" {
+		terms.JobID, err = strconv.Atoi(jobID)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid job_id parameter")
+		}
+	}
+	terms.Principal = principal(c)
+
+	terms.PromptVariant = c.FormValue("prompt_variant")
+	if noCache := c.FormValue("no_cache"); noCache != "" {
+		terms.NoCache, err = strconv.ParseBool(noCache)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid no_cache parameter")
+		}
+	}
+
+	if k := c.FormValue("k"); k != "" {
+		terms.Candidates, err = strconv.Atoi(k)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid k parameter")
+		}
+	}
+	if budget := c.FormValue("budget"); budget != "" {
+		terms.TokenBudget, err = strconv.Atoi(budget)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid budget parameter")
+		}
+	}
+
+	// Repeat exclude for each phrase, e.g. exclude=no crypto&exclude=not onsite.
+	for _, exclusion := range form.Value["exclude"] {
+		if exclusion = strings.TrimSpace(exclusion); exclusion != "" {
+			terms.Exclusions = append(terms.Exclusions, exclusion)
+		}
+	}
+	for _, dislikes := range form.Value["dislike"] {
+		for _, param := range strings.Split(dislikes, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(param))
+			if err != nil {
+				return c.String(http.StatusBadRequest, "Invalid dislike parameter")
+			}
+			terms.Dislikes = append(terms.Dislikes, id)
+		}
+	}
+
+	if searchType == "hiring" {
+		terms.SearchType = SearchType_WhoIsHiring
+	} else if searchType == "seekers" {
+		terms.SearchType = SearchType_WhoWantToBeHired
+	}
+
+	return fn(terms)
+}
+
+// savedSearchForm parses the form of a new saved search: either the session_id of a search to save,
+// or its type, prompt and filters as for a job search, with the notifier, target and min_score.
+func savedSearchForm(c echo.Context, q *queries.Queries) (*SavedSearch, error) {
+	var saved *SavedSearch
+	if id := c.FormValue("session_id"); id != "" {
+		session, err := GetSession(c.Request().Context(), q, id, principal(c))
+		if err != nil {
+			return nil, err
+		}
+		saved = NewSavedSearchFromSession(session)
+	} else {
+		saved = &SavedSearch{Principal: principal(c), JobPrompt: c.FormValue("prompt")}
+		switch c.FormValue("type") {
+		case "hiring":
+			saved.SearchType = SearchType_WhoIsHiring
+		case "seekers":
+			saved.SearchType = SearchType_WhoWantToBeHired
+		default:
+			return nil, errors.New("invalid type parameter, expected hiring or seekers")
+		}
+		form, err := c.FormParams()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, exclusion := range form["exclude"] {
+			if exclusion = strings.TrimSpace(exclusion); exclusion != "" {
+				saved.Exclusions = append(saved.Exclusions, exclusion)
+			}
+		}
+		for _, dislikes := range form["dislike"] {
+			for _, param := range strings.Split(dislikes, ",") {
+				id, err := strconv.Atoi(strings.TrimSpace(param))
+				if err != nil {
+					return nil, errors.New("invalid dislike parameter")
+				}
+				saved.Dislikes = append(saved.Dislikes, id)
+			}
+		}
+	}
+	saved.Name = c.FormValue("name")
+	saved.Notifier = c.FormValue("notifier")
+	saved.Target = c.FormValue("target")
+	if every := c.FormValue("every"); every != "" {
+		var err error
+		saved.Every, err = time.ParseDuration(every)
+		if err != nil {
+			return nil, errors.New("invalid every parameter, expected a duration such as 168h")
+		}
+	}
+	if minScore := c.FormValue("min_score"); minScore != "" {
+		var err error
+		saved.MinScore, err = strconv.Atoi(minScore)
+		if err != nil {
+			return nil, errors.New("invalid min_score parameter")
+		}
+	}
+	return saved, nil
+}
+
+// searchFailed responds with err, 429 when a budget is exhausted.
+func searchFailed(c echo.Context, l *slog.Logger, err error) error {
+	if errors.Is(err, ErrSessionConflict) {
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	}
+	var budgetErr *BudgetError
+	if errors.As(err, &budgetErr) {
+		l.Warn("job search over budget", slog.String("principal", principal(c)), slog.String("error", err.Error()))
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(time.Until(budgetErr.Reset).Seconds())+1))
+		return c.JSON(http.StatusTooManyRequests, map[string]string{"error": err.Error()})
+	}
+	l.Error("job search failed", slog.String("error", err.Error()))
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+}
+
+func similarResponse(item queries.Item, resp VectorSearchResponse) map[string]any {
+	comments := []int{}
+	similarities := []float32{}
+	items := []queries.Item{}
+	var links []string
+	for _, result := range resp.Results {
+		comments = append(comments, result.ID)
+		similarities = append(similarities, result.Similarity)
+		items = append(items, result.Item)
+		links = append(links, fmt.Sprintf("https://news.ycombinator.com/item?id=%d", result.ID))
+	}
+	return map[string]any{
+		"item":              item,
+		"comments":          comments,
+		"similarities":      similarities,
+		"items":             items,
+		"hacker_news_links": links,
+		"posts":             resp.Posts,
+		"items_searched":    resp.Searched,
+	}
+}
+
+func jobsResponse(resp JobSearchResponse) map[string]any {
+	var links []string
+	for _, id := range resp.Comments {
+		links = append(links, fmt.Sprintf("https://news.ycombinator.com/item?id=%d", id))
+	}
+
+	var originalLinks []string
+	for _, id := range resp.OriginalComments {
+		originalLinks = append(originalLinks, fmt.Sprintf("https://news.ycombinator.com/item?id=%d", id))
+	}
+	return map[string]any{
+		"comments":                   resp.Comments,
+		"parents":                    resp.Parents,
+		"picks":                      resp.Picks,
+		"items":                      resp.Items,
+		"original_comments":          resp.OriginalComments,
+		"original_parents":           resp.OriginalParents,
+		"hacker_news_links":          links,
+		"original_hacker_news_links": originalLinks,
+		"resume_summary":             resp.ResumeSummary,
+		"search_terms":               resp.SearchTerms,
+		"total_posts":                resp.TotalPosts,
+		"total_items":                resp.TotalItems,
+		"posts":                      resp.Posts,
+		"items_searched":             resp.ItemsSearched,
+		"latencies":                  resp.Latencies,
+		"providers":                  resp.Providers,
+		"usage":                      resp.Usage,
+		"degraded":                   resp.Degraded,
+		"flagged":                    resp.Flagged,
+		"job_description_flagged":    resp.JobDescriptionFlagged,
+		"prompt_versions":            resp.PromptVersions,
+		"session_id":                 resp.SessionID,
+		"diff":                       resp.Diff,
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/pkg/errors"
+)
+
+// migrations add columns to tables created by an older schema.sql. CREATE TABLE IF NOT EXISTS
+// leaves existing tables untouched, so new columns must be added before the schema (and any
+// index referencing them) is applied.
+var migrations = []struct {
+	table  string
+	column string
+	ddl    string
+}{
+	{"embeddings", "content_hash", "ALTER TABLE embeddings ADD COLUMN content_hash TEXT NOT NULL DEFAULT ''"},
+	{"usage", "principal", "ALTER TABLE usage ADD COLUMN principal TEXT NOT NULL DEFAULT ''"},
+	{"sessions", "version", "ALTER TABLE sessions ADD COLUMN version INTEGER NOT NULL DEFAULT 0"},
+}
+
+func migrate(ctx context.Context, db *sql.DB) error {
+	for _, m := range migrations {
+		var tables int
+		err := db.QueryRowContext(ctx, "select count(*) from sqlite_master where type = 'table' and name = ?", m.table).Scan(&tables)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if tables == 0 {
+			// A fresh database, the schema creates the column.
+			continue
+		}
+		var columns int
+		err = db.QueryRowContext(ctx, "select count(*) from pragma_table_info(?) where name = ?", m.table, m.column).Scan(&columns)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if columns > 0 {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, m.ddl); err != nil {
+			return errors.Wrapf(err, "migrating %s.%s", m.table, m.column)
+		}
+	}
+	return nil
+}
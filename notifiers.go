@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Alert is what a saved search found among the newly ingested comments.
+type Alert struct {
+	Search  *SavedSearch `json:"search"`
+	Matches []Match      `json:"matches"`
+}
+
+// Match is a comment matching a saved search, with the completion model's pick explaining why.
+type Match struct {
+	ID   int    `json:"id"`
+	Link string `json:"link"`
+	// Thread is the title of the post the comment is in, e.g. "Ask HN: Who is hiring? (June 2024)".
+	Thread string `json:"thread"`
+	// Text is the HTML of the comment, as posted.
+	Text string `json:"text"`
+	Time int    `json:"time"`
+	// Similarity is the comment's vector search similarity with the embedding model.
+	Similarity float32 `json:"similarity"`
+	Pick       Pick    `json:"pick"`
+}
+
+// Notifier delivers the alerts of saved searches to their target, whose meaning is up to the notifier,
+// e.g. the URL of a webhook.
+type Notifier interface {
+	// Validate returns an error if target can't be notified, when a saved search is created.
+	Validate(target string) error
+	Notify(ctx context.Context, l *slog.Logger, target string, alert Alert) error
+}
+
+// notifiers are the notifiers saved searches can use, by name.
+var notifiers = map[string]Notifier{
+	"email":   emailNotifier{},
+	"log":     logNotifier{},
+	"webhook": webhookNotifier{client: newPublicClient(30 * time.Second)},
+}
+
+// logNotifier logs the alerts, for trying out saved searches.
+type logNotifier struct{}
+
+func (logNotifier) Validate(target string) error {
+	return nil
+}
+
+func (logNotifier) Notify(ctx context.Context, l *slog.Logger, target string, alert Alert) error {
+	for _, m := range alert.Matches {
+		l.Info("saved search match", slog.String("search", alert.Search.ID), slog.String("name", alert.Search.Name),
+			slog.String("link", m.Link), slog.Int("score", m.Pick.Score), slog.String("rationale", m.Pick.Rationale))
+	}
+	return nil
+}
+
+// webhookNotifier posts the alert as JSON to the target URL. Anyone can save a search, so the URL must be
+// a public address.
+type webhookNotifier struct {
+	client *http.Client
+}
+
+func (webhookNotifier) Validate(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return errors.Errorf("invalid webhook URL %q", target)
+	}
+	return errors.Wrap(checkPublicURL(u), "webhook URL")
+}
+
+func (n webhookNotifier) Notify(ctx context.Context, l *slog.Logger, target string, alert Alert) error {
+	b, err := json.Marshal(alert)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(b))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("webhook %s responded %s", target, resp.Status)
+	}
+	return nil
+}
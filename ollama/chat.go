@@ -0,0 +1,103 @@
+package ollama
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/newhook/whoishiring/llm"
+	"github.com/newhook/whoishiring/transport"
+)
+
+const DefaultChatModel = "llama3.1"
+
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type Options struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"`
+}
+
+type ChatRequest struct {
+	Model    string    `json:"model"`
+	Messages []Message `json:"messages"`
+	Stream   bool      `json:"stream"`
+	// Format is "json" for JSON mode, or a JSON schema the response must follow.
+	Format  json.RawMessage `json:"format,omitempty"`
+	Options *Options        `json:"options,omitempty"`
+}
+
+type ChatResponse struct {
+	Model           string  `json:"model"`
+	CreatedAt       string  `json:"created_at"`
+	Message         Message `json:"message"`
+	Done            bool    `json:"done"`
+	DoneReason      string  `json:"done_reason"`
+	PromptEvalCount int     `json:"prompt_eval_count"`
+	EvalCount       int     `json:"eval_count"`
+}
+
+// Client implements llm.LLM with Ollama's chat API, so completions can run on
+// a self-hosted model.
+type Client struct {
+	// BaseURL is the base URL of the Ollama API, DefaultBaseURL if it's empty.
+	BaseURL string
+	Model   string
+	// JSON turns on Ollama's JSON mode when the request has no schema. JSON
+	// mode only produces objects.
+	JSON bool
+}
+
+func (c *Client) Complete(ctx context.Context, r llm.Request) (llm.Response, error) {
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+
+	chatRequest := ChatRequest{
+		Model: c.Model,
+	}
+	if r.System != "" {
+		chatRequest.Messages = append(chatRequest.Messages, Message{Role: "system", Content: r.System})
+	}
+	tokens := 0
+	for _, m := range r.Messages {
+		chatRequest.Messages = append(chatRequest.Messages, Message{Role: m.Role, Content: m.Content})
+		tokens += transport.EstimateTokens(m.Content)
+	}
+	switch {
+	case r.Schema != nil:
+		chatRequest.Format = r.Schema.Schema
+	case c.JSON:
+		chatRequest.Format = json.RawMessage(`"json"`)
+	}
+	if r.Temperature != nil || r.MaxTokens > 0 {
+		chatRequest.Options = &Options{
+			Temperature: r.Temperature,
+			NumPredict:  r.MaxTokens,
+		}
+	}
+
+	var cr ChatResponse
+	if err := client.PostJSON(ctx, baseURL+"/chat", nil, chatRequest, tokens, &cr); err != nil {
+		return llm.Response{}, err
+	}
+	if !cr.Done {
+		return llm.Response{}, errors.New("incomplete chat response")
+	}
+	if cr.DoneReason == "length" {
+		return llm.Response{}, fmt.Errorf("response truncated after %d output tokens", cr.EvalCount)
+	}
+
+	return llm.Response{
+		Text:  cr.Message.Content,
+		Model: cr.Model,
+		Usage: llm.Usage{
+			InputTokens:  cr.PromptEvalCount,
+			OutputTokens: cr.EvalCount,
+		},
+	}, nil
+}
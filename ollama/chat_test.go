@@ -0,0 +1,119 @@
+package ollama
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/newhook/whoishiring/llm"
+	"github.com/newhook/whoishiring/transport"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newStubServer serves /api/chat, handing each decoded request to handle.
+func newStubServer(t *testing.T, handle func(req ChatRequest) (int, any)) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/chat" {
+			http.NotFound(w, r)
+			return
+		}
+		var req ChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status, body := handle(req)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestComplete(t *testing.T) {
+	var got ChatRequest
+	s := newStubServer(t, func(req ChatRequest) (int, any) {
+		got = req
+		return http.StatusOK, ChatResponse{
+			Model:           req.Model,
+			Message:         Message{Role: "assistant", Content: `["go backend", "remote"]`},
+			Done:            true,
+			PromptEvalCount: 12,
+			EvalCount:       5,
+		}
+	})
+
+	c := &Client{BaseURL: s.URL + "/api", Model: "llama3.1", JSON: true}
+	resp, err := c.Complete(context.Background(), llm.Request{
+		Task:        "terms",
+		System:      "You are a job search assistant.",
+		Messages:    []llm.Message{{Role: "user", Content: "Find search terms"}},
+		MaxTokens:   100,
+		Temperature: llm.Temperature(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Model != "llama3.1" || got.Stream {
+		t.Errorf("unexpected request %+v", got)
+	}
+	if len(got.Messages) != 2 || got.Messages[0].Role != "system" || got.Messages[1].Content != "Find search terms" {
+		t.Errorf("unexpected messages %+v", got.Messages)
+	}
+	if string(got.Format) != `"json"` {
+		t.Errorf("expected JSON mode, got format %s", got.Format)
+	}
+	if got.Options == nil || got.Options.NumPredict != 100 || got.Options.Temperature == nil || *got.Options.Temperature != 0 {
+		t.Errorf("unexpected options %+v", got.Options)
+	}
+
+	if resp.Text != `["go backend", "remote"]` {
+		t.Errorf("unexpected text %q", resp.Text)
+	}
+	if resp.Usage.InputTokens != 12 || resp.Usage.OutputTokens != 5 {
+		t.Errorf("unexpected usage %+v", resp.Usage)
+	}
+}
+
+func TestCompleteWithSchema(t *testing.T) {
+	var got ChatRequest
+	s := newStubServer(t, func(req ChatRequest) (int, any) {
+		got = req
+		return http.StatusOK, ChatResponse{Model: req.Model, Message: Message{Content: `{"terms": []}`}, Done: true}
+	})
+
+	schema := json.RawMessage(`{"type":"object","properties":{"terms":{"type":"array","items":{"type":"string"}}}}`)
+	c := &Client{BaseURL: s.URL + "/api", Model: "llama3.1", JSON: true}
+	_, err := c.Complete(context.Background(), llm.Request{
+		Messages: []llm.Message{{Role: "user", Content: "Find search terms"}},
+		Schema:   &llm.Schema{Name: "terms", Schema: schema},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Format) != string(schema) {
+		t.Errorf("expected the schema as the format, got %s", got.Format)
+	}
+}
+
+func TestCompleteError(t *testing.T) {
+	s := newStubServer(t, func(req ChatRequest) (int, any) {
+		return http.StatusNotFound, map[string]string{"error": `model "missing" not found, try pulling it first`}
+	})
+
+	c := &Client{BaseURL: s.URL + "/api", Model: "missing"}
+	_, err := c.Complete(context.Background(), llm.Request{
+		Messages: []llm.Message{{Role: "user", Content: "hello"}},
+	})
+	var apiErr *transport.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected a transport error, got %v", err)
+	}
+	if apiErr.StatusCode != http.StatusNotFound || apiErr.Message != `model "missing" not found, try pulling it first` {
+		t.Errorf("unexpected error %+v", apiErr)
+	}
+}
@@ -0,0 +1,26 @@
+package ollama
+
+import (
+	"encoding/json"
+	"github.com/newhook/whoishiring/transport"
+)
+
+// DefaultBaseURL is the Ollama API used by clients that don't set their own.
+var DefaultBaseURL = "http://localhost:11434/api"
+
+var client = transport.New("ollama", transport.Limits{}, parseError)
+
+// SetLimits configures the rate limits shared by all calls to the Ollama API.
+func SetLimits(limits transport.Limits) {
+	client.SetLimits(limits)
+}
+
+func parseError(body []byte) (string, string) {
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", ""
+	}
+	return "", resp.Error
+}
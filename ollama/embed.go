@@ -1,19 +1,13 @@
 package ollama
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
-	"fmt"
-	"io"
+	"github.com/newhook/whoishiring/transport"
 	"math"
-	"net/http"
 	"sync"
 )
 
-const defaultBaseURLOllama = "http://localhost:11434/api"
-
 type ollamaResponse struct {
 	Embedding []float32 `json:"embedding"`
 }
@@ -23,12 +17,8 @@ type ollamaResponse struct {
 // that supports embeddings. A good one as of 2024-03-02 is "nomic-embed-text".
 // See https://ollama.com/library/nomic-embed-text
 // baseURLOllama is the base URL of the Ollama API. If it's empty,
-// "http://localhost:11434/api" is used.
+// DefaultBaseURL is used.
 func Embedding(model string, baseURLOllama string) func(ctx context.Context, text string) ([]float32, error) {
-	if baseURLOllama == "" {
-		baseURLOllama = defaultBaseURLOllama
-	}
-
 	// We don't set a default timeout here, although it's usually a good idea.
 	// In our case though, the library user can set the timeout on the context,
 	// and it might have to be a long timeout, depending on the text length.
@@ -36,44 +26,18 @@ func Embedding(model string, baseURLOllama string) func(ctx context.Context, tex
 	checkNormalized := sync.Once{}
 
 	return func(ctx context.Context, text string) ([]float32, error) {
-		// Prepare the request body.
-		reqBody, err := json.Marshal(map[string]string{
-			"model":  model,
-			"prompt": text,
-		})
-		if err != nil {
-			return nil, fmt.Errorf("couldn't marshal request body: %w", err)
-		}
-
-		// Create the request. Creating it with context is important for a timeout
-		// to be possible, because the client is configured without a timeout.
-		req, err := http.NewRequestWithContext(ctx, "POST", baseURLOllama+"/embeddings", bytes.NewBuffer(reqBody))
-		if err != nil {
-			return nil, fmt.Errorf("couldn't create request: %w", err)
+		baseURL := baseURLOllama
+		if baseURL == "" {
+			baseURL = DefaultBaseURL
 		}
-		req.Header.Set("Content-Type", "application/json")
 
-		// Send the request.
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return nil, fmt.Errorf("couldn't send request: %w", err)
-		}
-		defer resp.Body.Close()
-
-		// Check the response status.
-		if resp.StatusCode != http.StatusOK {
-			return nil, errors.New("error response from the embedding API: " + resp.Status)
-		}
-
-		// Read and decode the response body.
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("couldn't read response body: %w", err)
-		}
 		var embeddingResponse ollamaResponse
-		err = json.Unmarshal(body, &embeddingResponse)
+		err := client.PostJSON(ctx, baseURL+"/embeddings", nil, map[string]string{
+			"model":  model,
+			"prompt": text,
+		}, transport.EstimateTokens(text), &embeddingResponse)
 		if err != nil {
-			return nil, fmt.Errorf("couldn't unmarshal response body: %w", err)
+			return nil, err
 		}
 
 		// Check if the response contains embeddings.
@@ -0,0 +1,89 @@
+package openai
+
+import (
+	"encoding/json"
+	"github.com/newhook/whoishiring/transport"
+	"net/http"
+	"os"
+)
+
+const BaseURLOpenAI = "https://api.openai.com/v1"
+
+var (
+	apiKey = os.Getenv("OPENAI_API_KEY")
+	client = NewTransport("openai", transport.Limits{})
+)
+
+// SetLimits configures the rate limits shared by all calls to the OpenAI API.
+func SetLimits(limits transport.Limits) {
+	client.SetLimits(limits)
+}
+
+// NewTransport creates a transport for an OpenAI-compatible provider that understands OpenAI's error
+// responses, so each provider can have its own rate limits.
+func NewTransport(provider string, limits transport.Limits) *transport.Client {
+	return transport.New(provider, limits, parseError)
+}
+
+// Client talks to the OpenAI API, or to any server exposing the same API such as vLLM, LiteLLM or
+// llama.cpp. The zero value calls OpenAI with OPENAI_API_KEY.
+type Client struct {
+	// BaseURL is the base URL of the API, BaseURLOpenAI if it's empty.
+	BaseURL string
+	// APIKey is sent as a bearer token. OPENAI_API_KEY is only used when BaseURL is empty, so the
+	// OpenAI key is never sent to another server.
+	APIKey string
+	// Headers are added to every request, e.g. for gateways that route or authenticate on a header.
+	Headers map[string]string
+	// Transport throttles and retries the calls, the transport shared by all OpenAI calls if it's nil.
+	Transport *transport.Client
+	// Model is the completion model.
+	Model string
+}
+
+func (c *Client) baseURL() string {
+	if c.BaseURL == "" {
+		return BaseURLOpenAI
+	}
+	return c.BaseURL
+}
+
+func (c *Client) header() http.Header {
+	header := http.Header{}
+	for k, v := range c.Headers {
+		header.Set(k, v)
+	}
+	key := c.APIKey
+	if key == "" && c.BaseURL == "" {
+		key = apiKey
+	}
+	if key != "" {
+		header.Set("Authorization", "Bearer "+key)
+	}
+	return header
+}
+
+func (c *Client) transport() *transport.Client {
+	if c.Transport == nil {
+		return client
+	}
+	return c.Transport
+}
+
+func parseError(body []byte) (string, string) {
+	var resp struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Code    any    `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", ""
+	}
+	// The code is more specific than the type, e.g. "insufficient_quota" vs "invalid_request_error".
+	if code, ok := resp.Error.Code.(string); ok && code != "" {
+		return code, resp.Error.Message
+	}
+	return resp.Error.Type, resp.Error.Message
+}
@@ -1,33 +1,46 @@
 package openai
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
+	"github.com/newhook/whoishiring/llm"
+	"github.com/newhook/whoishiring/transport"
 	"github.com/pkg/errors"
-	"io"
-	"net/http"
-	"os"
-	"strings"
-	"text/template"
 )
 
-const transcript = "openai.json"
-const url = "https://api.openai.com/v1/chat/completions"
-
-var (
-	apiKey = os.Getenv("OPENAI_API_KEY")
-)
+const DefaultModel = "gpt-4o"
 
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// Refusal explains why the model declined to produce the structured output.
+	Refusal string `json:"refusal,omitempty"`
+}
+
+type JSONSchema struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema"`
+	Strict      bool            `json:"strict"`
+}
+
+type ResponseFormat struct {
+	Type       string      `json:"type"`
+	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
 }
 
 type ChatRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
+	Model          string          `json:"model"`
+	Messages       []Message       `json:"messages"`
+	MaxTokens      int             `json:"max_tokens,omitempty"`
+	Temperature    *float64        `json:"temperature,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	Stream         bool            `json:"stream,omitempty"`
+	StreamOptions  *StreamOptions  `json:"stream_options,omitempty"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type Choice struct {
@@ -53,184 +66,120 @@ type ChatResponse struct {
 	Usage             Usage    `json:"usage"`
 }
 
-func Completions(ctx context.Context, role string, fake bool, t *template.Template, context any) (*ChatResponse, error) {
-	if fake {
-		last, err := readLast(role)
-		if err != nil {
-			return nil, err
-		}
-		return &last.Response, nil
-	}
-
-	sb := &strings.Builder{}
-	err := t.Execute(sb, context)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	chatRequest := ChatRequest{
-		Model: "gpt-4o",
-		Messages: []Message{
-			{
-				Role:    "system",
-				Content: "You are job search assistant. Don't explain anything. Provide all results in json",
-			},
-			{
-				Role:    "user",
-				Content: sb.String(),
-			},
-		},
-	}
-
-	jsonData, err := json.Marshal(chatRequest)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+// Complete implements llm.LLM with the chat completions API.
+func (c *Client) Complete(ctx context.Context, r llm.Request) (llm.Response, error) {
+	chatRequest, tokens := c.newRequest(r)
+	var cr ChatResponse
+	err := c.transport().PostJSON(ctx, c.baseURL()+"/chat/completions", c.header(), chatRequest, tokens, &cr)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return llm.Response{}, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+	return toResponse(&cr)
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// Stream implements llm.Streamer with the chat completions API's server-sent events.
+func (c *Client) Stream(ctx context.Context, r llm.Request, delta func(text string)) (llm.Response, error) {
+	chatRequest, tokens := c.newRequest(r)
+	chatRequest.Stream = true
+	chatRequest.StreamOptions = &StreamOptions{IncludeUsage: true}
+	resp, err := c.transport().PostStream(ctx, c.baseURL()+"/chat/completions", c.header(), chatRequest, tokens)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return llm.Response{}, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("error response from the embedding API: " + resp.Status)
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-
-	var cr ChatResponse
-	if err := json.Unmarshal(body, &cr); err != nil {
-		return nil, err
-	}
-
-	if err := appendTranscript(RequestResponse{
-		Role:     role,
-		Request:  chatRequest,
-		Response: cr,
-	}); err != nil {
-		return nil, err
-	}
-
-	return &cr, nil
-}
-func parseJsonResponse1[T any](choice Choice, result T) error {
-	if err := json.Unmarshal([]byte(choice.Message.Content), result); err != nil {
-		return err
-	}
-	return nil
-}
-func parseJsonResponse2[T any](choice Choice, result T) error {
-	text := choice.Message.Content
-	i := strings.Index(choice.Message.Content, "[")
-	if i == -1 {
-		return errors.Errorf("could not find boundary")
-	}
-	text = choice.Message.Content[i+1:]
-	i = strings.LastIndex(text, "]")
-	if i == -1 {
-		return errors.Errorf("could not find boundary")
-	}
-	text = text[:i]
-	if err := json.Unmarshal([]byte("["+text+"]"), result); err == nil {
-		return err
-	}
-	return nil
-}
-
-func parseJsonResponse3[T any](choice Choice, result T) error {
-	// XXX: use re.
-	text := choice.Message.Content
-	boundary := "```"
-	i := strings.Index(text, boundary)
-	if i == -1 {
-		return errors.Errorf("could not find boundary")
-	}
-	text = text[i+3:]
-	i = strings.Index(text, boundary)
-	if i == -1 {
-		return errors.Errorf("could not find boundary")
-	}
-	text = text[:i]
-	fmt.Println(text)
-	if !strings.HasPrefix(text, "json") {
-		return errors.Errorf("expected json")
-	}
-	text = text[4:]
-	if err := json.Unmarshal([]byte(text), result); err != nil {
-		return err
-	}
-	return nil
-}
-
-func ParseJsonResponse[T any](choice Choice, result T) error {
-	if err := parseJsonResponse1(choice, result); err == nil {
-		return nil
-	}
-	if err := parseJsonResponse2(choice, result); err == nil {
-		return nil
-	}
-	if err := parseJsonResponse3(choice, result); err == nil {
+	// The chunks are assembled into a single choice, like a regular completion.
+	cr := ChatResponse{Choices: []Choice{{Message: Message{Role: "assistant"}}}}
+	choice := &cr.Choices[0]
+	err = transport.ReadEvents(resp.Body, func(_, data string) error {
+		if data == "[DONE]" {
+			return nil
+		}
+		var chunk struct {
+			ID      string `json:"id"`
+			Created int    `json:"created"`
+			Model   string `json:"model"`
+			Choices []struct {
+				Delta        Message `json:"delta"`
+				FinishReason string  `json:"finish_reason"`
+			} `json:"choices"`
+			Usage *Usage `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return errors.Wrap(err, "invalid chunk")
+		}
+		cr.ID, cr.Created, cr.Model = chunk.ID, chunk.Created, chunk.Model
+		if chunk.Usage != nil {
+			cr.Usage = *chunk.Usage
+		}
+		for _, c := range chunk.Choices {
+			choice.Message.Content += c.Delta.Content
+			choice.Message.Refusal += c.Delta.Refusal
+			if c.FinishReason != "" {
+				choice.FinishReason = c.FinishReason
+			}
+			if c.Delta.Content != "" {
+				delta(c.Delta.Content)
+			}
+		}
 		return nil
+	})
+	if err != nil {
+		return llm.Response{}, err
 	}
-	return errors.New("could not parse json response")
-}
 
-type RequestResponse struct {
-	Role     string       `json:"role"`
-	Request  ChatRequest  `json:"request"`
-	Response ChatResponse `json:"response"`
+	return toResponse(&cr)
 }
 
-func readLast(role string) (RequestResponse, error) {
-	file, err := os.Open(transcript)
-	if err != nil {
-		return RequestResponse{}, errors.WithStack(err)
-	}
-	defer file.Close()
-
-	decoder := json.NewDecoder(file)
-	var last RequestResponse
-	for decoder.More() {
-		var obj RequestResponse
-		err := decoder.Decode(&obj)
-		if err != nil {
-			return RequestResponse{}, errors.WithStack(err)
-		}
-		if obj.Role == role {
-			last = obj
+// newRequest creates the chat request for r, and estimates its tokens for the rate limits.
+func (c *Client) newRequest(r llm.Request) (ChatRequest, int) {
+	chatRequest := ChatRequest{
+		Model:       c.Model,
+		MaxTokens:   r.MaxTokens,
+		Temperature: r.Temperature,
+	}
+	if r.System != "" {
+		chatRequest.Messages = append(chatRequest.Messages, Message{Role: "system", Content: r.System})
+	}
+	tokens := 0
+	for _, m := range r.Messages {
+		chatRequest.Messages = append(chatRequest.Messages, Message{Role: m.Role, Content: m.Content})
+		tokens += transport.EstimateTokens(m.Content)
+	}
+	if r.Schema != nil {
+		chatRequest.ResponseFormat = &ResponseFormat{
+			Type: "json_schema",
+			JSONSchema: &JSONSchema{
+				Name:        r.Schema.Name,
+				Description: r.Schema.Description,
+				Schema:      r.Schema.Schema,
+				// Without strict mode the schema is only a hint, and the output is merely validated locally.
+				Strict: true,
+			},
 		}
 	}
-	return last, nil
+
+	return chatRequest, tokens
 }
 
-func appendTranscript(r RequestResponse) error {
-	b, err := json.Marshal(r)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	file, err := os.OpenFile(transcript, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
+func toResponse(cr *ChatResponse) (llm.Response, error) {
+	if len(cr.Choices) == 0 {
+		return llm.Response{}, errors.New("no choices in the response")
 	}
-	defer file.Close()
-
-	if _, err := file.Write(b); err != nil {
-		return errors.WithStack(err)
+	choice := cr.Choices[len(cr.Choices)-1]
+	if choice.Message.Refusal != "" {
+		return llm.Response{}, errors.Errorf("model refused: %s", choice.Message.Refusal)
 	}
-	if _, err := file.WriteString("\n"); err != nil {
-		return errors.WithStack(err)
+	if choice.FinishReason == "length" {
+		return llm.Response{}, errors.Errorf("response truncated after %d output tokens", cr.Usage.CompletionTokens)
 	}
-
-	return nil
+	return llm.Response{
+		Text:  choice.Message.Content,
+		Model: cr.Model,
+		Usage: llm.Usage{
+			InputTokens:  cr.Usage.PromptTokens,
+			OutputTokens: cr.Usage.CompletionTokens,
+		},
+	}, nil
 }
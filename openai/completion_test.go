@@ -0,0 +1,155 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/newhook/whoishiring/llm"
+	"github.com/newhook/whoishiring/transport"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newStubServer serves the chat completions and embeddings endpoints of an OpenAI-compatible API
+// under /v1, recording the headers of the last request.
+func newStubServer(t *testing.T, header *http.Header) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		*header = r.Header.Clone()
+		var req ChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, chunk := range []string{
+				`{"id":"1","model":"m","choices":[{"index":0,"delta":{"role":"assistant","content":""}}]}`,
+				`{"id":"1","model":"m","choices":[{"index":0,"delta":{"content":"[\"go"}}]}`,
+				`{"id":"1","model":"m","choices":[{"index":0,"delta":{"content":"\"]"},"finish_reason":"stop"}]}`,
+				`{"id":"1","model":"m","choices":[],"usage":{"prompt_tokens":7,"completion_tokens":3}}`,
+				`[DONE]`,
+			} {
+				_, _ = w.Write([]byte("data: " + chunk + "\n\n"))
+			}
+			return
+		}
+		_ = json.NewEncoder(w).Encode(ChatResponse{
+			Model: req.Model,
+			Choices: []Choice{
+				{Message: Message{Role: "assistant", Content: `["go"]`}, FinishReason: "stop"},
+			},
+			Usage: Usage{PromptTokens: 7, CompletionTokens: 3},
+		})
+	})
+	mux.HandleFunc("POST /v1/embeddings", func(w http.ResponseWriter, r *http.Request) {
+		*header = r.Header.Clone()
+		_, _ = w.Write([]byte(`{"data": [{"embedding": [3, 4]}], "usage": {"prompt_tokens": 1, "total_tokens": 1}}`))
+	})
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestCompleteCompatibleServer(t *testing.T) {
+	apiKey = "openai-key"
+	t.Cleanup(func() { apiKey = "" })
+
+	var header http.Header
+	s := newStubServer(t, &header)
+	c := &Client{
+		BaseURL:   s.URL + "/v1",
+		APIKey:    "vllm-key",
+		Headers:   map[string]string{"X-Team": "search"},
+		Transport: NewTransport("vllm", transport.Limits{}),
+		Model:     "meta-llama/Meta-Llama-3.1-8B-Instruct",
+	}
+	resp, err := c.Complete(context.Background(), llm.Request{
+		Task:     "test",
+		Messages: []llm.Message{{Role: "user", Content: "hello"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Text != `["go"]` || resp.Model != c.Model {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if resp.Usage.InputTokens != 7 || resp.Usage.OutputTokens != 3 {
+		t.Errorf("unexpected usage %+v", resp.Usage)
+	}
+	if got := header.Get("Authorization"); got != "Bearer vllm-key" {
+		t.Errorf("expected the provider's key, got %q", got)
+	}
+	if got := header.Get("X-Team"); got != "search" {
+		t.Errorf("expected the extra header, got %q", got)
+	}
+}
+
+func TestStream(t *testing.T) {
+	var header http.Header
+	s := newStubServer(t, &header)
+	c := &Client{BaseURL: s.URL + "/v1", Model: "m"}
+	var deltas []string
+	resp, err := c.Stream(context.Background(), llm.Request{
+		Task:     "test",
+		Messages: []llm.Message{{Role: "user", Content: "hello"}},
+	}, func(text string) {
+		deltas = append(deltas, text)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deltas) != 2 || deltas[0] != `["go` {
+		t.Errorf("unexpected deltas %q", deltas)
+	}
+	if resp.Text != `["go"]` || resp.Model != "m" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if resp.Usage.InputTokens != 7 || resp.Usage.OutputTokens != 3 {
+		t.Errorf("unexpected usage %+v", resp.Usage)
+	}
+}
+
+func TestEmbeddingCompatibleServerWithoutKey(t *testing.T) {
+	apiKey = "openai-key"
+	t.Cleanup(func() { apiKey = "" })
+
+	var header http.Header
+	s := newStubServer(t, &header)
+	c := &Client{BaseURL: s.URL + "/v1"}
+	v, tokens, err := c.Embedding("BAAI/bge-large-en-v1.5")(context.Background(), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(v) != 2 || v[0] != 0.6 || v[1] != 0.8 {
+		t.Errorf("expected a normalized vector, got %v", v)
+	}
+	if tokens != 1 {
+		t.Errorf("expected the reported usage, got %d tokens", tokens)
+	}
+	if got := header.Get("Authorization"); got != "" {
+		t.Errorf("OPENAI_API_KEY must not be sent to another server, got %q", got)
+	}
+}
+
+func TestNewRequestStrictSchema(t *testing.T) {
+	c := &Client{Model: "m"}
+	req, _ := c.newRequest(llm.Request{
+		Task:     "test",
+		Messages: []llm.Message{{Role: "user", Content: "hello"}},
+		Schema: &llm.Schema{
+			Name:   "terms",
+			Schema: json.RawMessage(`{"type": "object", "properties": {"terms": {"type": "array", "items": {"type": "string"}}}, "required": ["terms"], "additionalProperties": false}`),
+		},
+	})
+	if req.ResponseFormat == nil || req.ResponseFormat.Type != "json_schema" || req.ResponseFormat.JSONSchema.Name != "terms" {
+		t.Fatalf("expected a json_schema response format, got %+v", req.ResponseFormat)
+	}
+	if !req.ResponseFormat.JSONSchema.Strict {
+		t.Error("expected the schema to be enforced in strict mode")
+	}
+}
@@ -1,18 +1,13 @@
 package openai
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"github.com/newhook/whoishiring/transport"
 	"github.com/pkg/errors"
-	"io"
 	"math"
-	"net/http"
 	"sync"
 )
 
-const BaseURLOpenAI = "https://api.openai.com/v1"
-
 type EmbeddingModelOpenAI string
 
 const (
@@ -25,58 +20,35 @@ type openAIResponse struct {
 	Data []struct {
 		Embedding []float32 `json:"embedding"`
 	} `json:"data"`
+	Usage struct {
+		PromptTokens int `json:"prompt_tokens"`
+	} `json:"usage"`
+}
+
+// Embedding creates embeddings with OpenAI's API, returning the vector and the tokens billed.
+func Embedding(model EmbeddingModelOpenAI) func(ctx context.Context, text string) ([]float32, int, error) {
+	return (&Client{}).Embedding(model)
 }
 
-func Embedding(model EmbeddingModelOpenAI) func(ctx context.Context, text string) ([]float32, error) {
+// Embedding creates embeddings with the client's API. The model doesn't need to be one of OpenAI's,
+// e.g. a vLLM server names its models after the Hugging Face repository.
+func (c *Client) Embedding(model EmbeddingModelOpenAI) func(ctx context.Context, text string) ([]float32, int, error) {
 	var checkedNormalized bool
 	checkNormalized := sync.Once{}
 
-	baseURL := BaseURLOpenAI
-	return func(ctx context.Context, text string) ([]float32, error) {
-		// Prepare the request body.
-		reqBody, err := json.Marshal(map[string]string{
+	return func(ctx context.Context, text string) ([]float32, int, error) {
+		var embeddingResponse openAIResponse
+		err := c.transport().PostJSON(ctx, c.baseURL()+"/embeddings", c.header(), map[string]string{
 			"input": text,
 			"model": string(model),
-		})
-		if err != nil {
-			return nil, errors.Errorf("couldn't marshal request body: %w", err)
-		}
-
-		// Create the request. Creating it with context is important for a timeout
-		// to be possible, because the client is configured without a timeout.
-		req, err := http.NewRequestWithContext(ctx, "POST", baseURL+"/embeddings", bytes.NewBuffer(reqBody))
-		if err != nil {
-			return nil, errors.Errorf("couldn't create request: %w", err)
-		}
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer "+apiKey)
-
-		// Send the request.
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return nil, errors.Errorf("couldn't send request: %w", err)
-		}
-		defer resp.Body.Close()
-
-		// Check the response status.
-		if resp.StatusCode != http.StatusOK {
-			return nil, errors.New("error response from the embedding API: " + resp.Status)
-		}
-
-		// Read and decode the response body.
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, errors.Errorf("couldn't read response body: %w", err)
-		}
-		var embeddingResponse openAIResponse
-		err = json.Unmarshal(body, &embeddingResponse)
+		}, transport.EstimateTokens(text), &embeddingResponse)
 		if err != nil {
-			return nil, errors.Errorf("couldn't unmarshal response body: %w", err)
+			return nil, 0, err
 		}
 
 		// Check if the response contains embeddings.
 		if len(embeddingResponse.Data) == 0 || len(embeddingResponse.Data[0].Embedding) == 0 {
-			return nil, errors.New("no embeddings found in the response")
+			return nil, 0, errors.New("no embeddings found in the response")
 		}
 
 		v := embeddingResponse.Data[0].Embedding
@@ -91,7 +63,7 @@ func Embedding(model EmbeddingModelOpenAI) func(ctx context.Context, text string
 			v = normalizeVector(v)
 		}
 
-		return v, nil
+		return v, embeddingResponse.Usage.PromptTokens, nil
 	}
 }
 
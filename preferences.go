@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"github.com/newhook/whoishiring/queries"
+	"github.com/pkg/errors"
+	"regexp"
+	"strings"
+)
+
+// preferences are the negative preferences of a search, as shown to the completion model.
+type preferences struct {
+	Exclusions []string
+	// Dislikes are the first lines of the disliked comments, typically their company and role, escaped
+	// by untrustedText.
+	Dislikes []string
+}
+
+func getPreferences(ctx context.Context, q *queries.Queries, search SearchTerms) (preferences, error) {
+	prefs := preferences{Exclusions: search.Exclusions}
+	if len(search.Dislikes) == 0 {
+		return prefs, nil
+	}
+	items, err := q.GetItems(ctx, search.Dislikes)
+	if err != nil {
+		return prefs, errors.WithStack(err)
+	}
+	for _, item := range items {
+		prefs.Dislikes = append(prefs.Dislikes, untrustedEscaper.Replace(firstLine(item.Text)))
+	}
+	return prefs, nil
+}
+
+var negation = regexp.MustCompile(`(?i)^\s*(no|not|non|without|avoid)\b[\s-]*`)
+
+// negativeTerm returns the term embedded for an exclusion. The negation is dropped, "no crypto" is
+// searched for as "crypto", since embeddings don't capture it.
+func negativeTerm(exclusion string) string {
+	if term := negation.ReplaceAllString(exclusion, ""); strings.TrimSpace(term) != "" {
+		return strings.TrimSpace(term)
+	}
+	return strings.TrimSpace(exclusion)
+}
+
+// termsContext is the context of the search terms prompt. It prints as the job search prompt, which
+// is what templates written before the preferences expect.
+type termsContext struct {
+	Prompt string
+	preferences
+}
+
+func (c termsContext) String() string {
+	return c.Prompt
+}
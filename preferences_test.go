@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNegativeTerm(t *testing.T) {
+	for exclusion, want := range map[string]string{
+		"no crypto":    "crypto",
+		"Not onsite":   "onsite",
+		"non-remote":   "remote",
+		"without PHP":  "PHP",
+		"adtech":       "adtech",
+		"no":           "no",
+		" avoid  Java": "Java",
+	} {
+		if got := negativeTerm(exclusion); got != want {
+			t.Errorf("negativeTerm(%q) = %q, expected %q", exclusion, got, want)
+		}
+	}
+}
+
+func TestJobSearchWithNegativePreferences(t *testing.T) {
+	useTestModels(t, "remote Go backend engineer, distributed systems and Kubernetes")
+	q := newFixtureDB(t)
+
+	search := SearchTerms{
+		Months:     1,
+		SearchType: SearchType_WhoIsHiring,
+		JobPrompt:  "remote Go backend engineer, distributed systems and Kubernetes",
+	}
+	before, err := JobSearch(context.Background(), testLogger(), q, search)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(before.OriginalComments, 1004) || !slices.Contains(before.OriginalComments, 1005) {
+		t.Fatalf("expected the crypto and SRE jobs without preferences, got %v", before.OriginalComments)
+	}
+
+	testLLMClient.requests = nil
+	search.Exclusions = []string{"no crypto or blockchain"}
+	search.Dislikes = []int{1005}
+	resp, err := JobSearch(context.Background(), testLogger(), q, search)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(resp.OriginalComments, 1005) {
+		t.Errorf("expected the disliked job to be left out, got %v", resp.OriginalComments)
+	}
+	if i := slices.Index(resp.OriginalComments, 1004); i >= 0 && i <= slices.Index(before.OriginalComments, 1004) {
+		t.Errorf("expected the crypto job to rank lower, got %v", resp.OriginalComments)
+	}
+
+	for _, req := range testLLMClient.requests {
+		content := req.Messages[0].Content
+		if !strings.Contains(content, "- no crypto or blockchain") {
+			t.Errorf("expected the %s prompt to have the exclusion:\n%s", req.Task, content)
+		}
+		if !strings.Contains(content, "- Infra Cloud | Site Reliability Engineer | REMOTE (EU)") {
+			t.Errorf("expected the %s prompt to have the disliked job:\n%s", req.Task, content)
+		}
+	}
+}
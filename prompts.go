@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/fs"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+//go:embed prompts/*.tmpl
+var defaultPrompts embed.FS
+
+const (
+	analyzeResumePrompt = "analyze_resume"
+	searchTermsPrompt   = "search_terms"
+	jobSearchPrompt     = "job_search"
+	refineSearchPrompt  = "refine_search"
+
+	candidateTermsPrompt  = "candidate_terms"
+	candidateSearchPrompt = "candidate_search"
+	candidateRefinePrompt = "candidate_refine"
+
+	// DefaultVariant names the prompt in <name>.tmpl, variants are in <name>.<variant>.tmpl.
+	DefaultVariant = "default"
+)
+
+// Prompt is a version of a prompt template.
+type Prompt struct {
+	Name    string
+	Variant string
+	// Version identifies the template's content, e.g. "job_search.b@1a2b3c4d".
+	Version  string
+	Template *template.Template
+}
+
+func newPrompt(name, variant string, text []byte) (*Prompt, error) {
+	t, err := template.New(name).Parse(string(text))
+	if err != nil {
+		return nil, errors.Wrapf(err, "prompt %s", name)
+	}
+	sum := sha256.Sum256(text)
+	version := name
+	if variant != DefaultVariant {
+		version += "." + variant
+	}
+	return &Prompt{
+		Name:     name,
+		Variant:  variant,
+		Version:  version + "@" + hex.EncodeToString(sum[:4]),
+		Template: t,
+	}, nil
+}
+
+// PromptSet is the prompt for each name used by a request.
+type PromptSet map[string]*Prompt
+
+// Versions returns the version of each prompt by name, to report which variants produced a result.
+func (s PromptSet) Versions() map[string]string {
+	versions := map[string]string{}
+	for name, p := range s {
+		versions[name] = p.Version
+	}
+	return versions
+}
+
+// Experiment A/B tests a variant of a prompt against its default.
+type Experiment struct {
+	Variant string
+	// Share is the fraction of requests assigned to the variant.
+	Share float64
+}
+
+// ParseExperiments parses experiments formatted as "job_search=b:0.5,search_terms=b:0.2".
+func ParseExperiments(s string) (map[string]Experiment, error) {
+	experiments := map[string]Experiment{}
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+		name, arm, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, errors.Errorf("invalid experiment %q, expected name=variant:share", part)
+		}
+		variant, shareParam, ok := strings.Cut(arm, ":")
+		if !ok {
+			return nil, errors.Errorf("invalid experiment %q, expected name=variant:share", part)
+		}
+		share, err := strconv.ParseFloat(shareParam, 64)
+		if err != nil || share < 0 || share > 1 {
+			return nil, errors.Errorf("invalid experiment %q, expected a share from 0 to 1", part)
+		}
+		experiments[name] = Experiment{Variant: variant, Share: share}
+	}
+	return experiments, nil
+}
+
+// PromptRegistry holds the prompt templates. Templates are read from a directory, falling back to
+// the embedded defaults for those the directory doesn't have, and reloaded when the directory changes.
+type PromptRegistry struct {
+	mutex       sync.RWMutex
+	dir         string
+	prompts     map[string]map[string]*Prompt
+	experiments map[string]Experiment
+	// signature identifies the state of the directory's files, to notice changes.
+	signature string
+}
+
+var promptRegistry = mustLoadDefaultPrompts()
+
+func mustLoadDefaultPrompts() *PromptRegistry {
+	r := &PromptRegistry{}
+	if err := r.Load(""); err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Load replaces the prompts with the embedded defaults, overridden by the templates in dir. A missing
+// directory only has the defaults.
+func (r *PromptRegistry) Load(dir string) error {
+	prompts := map[string]map[string]*Prompt{}
+	add := func(fsys fs.FS, file string) error {
+		name, variant, err := parsePromptFile(file)
+		if err != nil {
+			return err
+		}
+		text, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		p, err := newPrompt(name, variant, text)
+		if err != nil {
+			return err
+		}
+		if prompts[name] == nil {
+			prompts[name] = map[string]*Prompt{}
+		}
+		prompts[name][variant] = p
+		return nil
+	}
+
+	defaults, err := fs.Sub(defaultPrompts, "prompts")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	files, err := fs.Glob(defaults, "*.tmpl")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, file := range files {
+		if err := add(defaults, file); err != nil {
+			return err
+		}
+	}
+
+	signature := ""
+	if dir != "" {
+		signature, files, err = promptFiles(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			name, _, err := parsePromptFile(file)
+			if err != nil {
+				return err
+			}
+			if _, ok := prompts[name]; !ok {
+				return errors.Errorf("%s: unknown prompt %s", filepath.Join(dir, file), name)
+			}
+			if err := add(os.DirFS(dir), file); err != nil {
+				return errors.Wrapf(err, "%s", dir)
+			}
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	// Don't drop a variant that's being A/B tested.
+	if err := checkExperiments(prompts, r.experiments); err != nil {
+		return errors.Wrapf(err, "%s", dir)
+	}
+	r.dir, r.prompts, r.signature = dir, prompts, signature
+	return nil
+}
+
+// parsePromptFile splits "job_search.b.tmpl" into its name and variant.
+func parsePromptFile(file string) (string, string, error) {
+	name, variant, found := strings.Cut(strings.TrimSuffix(path.Base(file), ".tmpl"), ".")
+	if name == "" || found && (variant == "" || variant == DefaultVariant || strings.Contains(variant, ".")) {
+		return "", "", errors.Errorf("invalid prompt file name %s", file)
+	}
+	if !found {
+		variant = DefaultVariant
+	}
+	return name, variant, nil
+}
+
+// promptFiles lists the templates in dir, with a signature of their names, sizes and modification times.
+func promptFiles(dir string) (string, []string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+	var files []string
+	sb := &strings.Builder{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".tmpl") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return "", nil, errors.WithStack(err)
+		}
+		files = append(files, entry.Name())
+		fmt.Fprintf(sb, "%s:%d:%d;", entry.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return sb.String(), files, nil
+}
+
+// Watch reloads the prompts when the directory changes, polling every interval, until ctx is done.
+// Templates that don't parse are reported and the previous prompts stay in use.
+func (r *PromptRegistry) Watch(ctx context.Context, l *slog.Logger, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		r.mutex.RLock()
+		dir, previous := r.dir, r.signature
+		r.mutex.RUnlock()
+		signature, _, err := promptFiles(dir)
+		if err != nil {
+			l.Error("couldn't list prompts", slog.String("dir", dir), slog.String("error", err.Error()))
+			continue
+		}
+		if signature == previous {
+			continue
+		}
+		if err := r.Load(dir); err != nil {
+			l.Error("couldn't reload prompts", slog.String("dir", dir), slog.String("error", err.Error()))
+			// Don't report the same broken files again.
+			r.mutex.Lock()
+			r.signature = signature
+			r.mutex.Unlock()
+			continue
+		}
+		l.Info("reloaded prompts", slog.String("dir", dir), slog.Any("versions", r.Versions()))
+	}
+}
+
+func (r *PromptRegistry) SetExperiments(experiments map[string]Experiment) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := checkExperiments(r.prompts, experiments); err != nil {
+		return err
+	}
+	r.experiments = experiments
+	return nil
+}
+
+// checkExperiments returns an error if an experiment's prompt or variant isn't in prompts.
+func checkExperiments(prompts map[string]map[string]*Prompt, experiments map[string]Experiment) error {
+	for name, e := range experiments {
+		variants, ok := prompts[name]
+		if !ok {
+			return errors.Errorf("experiment for unknown prompt %s", name)
+		}
+		if _, ok := variants[e.Variant]; !ok {
+			return errors.Errorf("experiment for %s has no %s.%s.tmpl", name, name, e.Variant)
+		}
+	}
+	return nil
+}
+
+// Versions returns the versions of all prompts, sorted.
+func (r *PromptRegistry) Versions() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var versions []string
+	for _, variants := range r.prompts {
+		for _, p := range variants {
+			versions = append(versions, p.Version)
+		}
+	}
+	slices.Sort(versions)
+	return versions
+}
+
+// Select picks the prompts for a request. variant overrides the variant of every prompt that has it,
+// otherwise requests are assigned to experiment variants at random by their share. A variant that no
+// prompt has is an error. The set stays the same for the request when the prompts are reloaded.
+func (r *PromptRegistry) Select(variant string) (PromptSet, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	set := PromptSet{}
+	found := variant == "" || variant == DefaultVariant
+	for name, variants := range r.prompts {
+		set[name] = variants[DefaultVariant]
+		if variant != "" {
+			if p, ok := variants[variant]; ok {
+				set[name] = p
+				found = true
+			}
+			continue
+		}
+		if e, ok := r.experiments[name]; ok && rand.Float64() < e.Share {
+			set[name] = variants[e.Variant]
+		}
+	}
+	if !found {
+		return nil, errors.Errorf("unknown prompt variant %s", variant)
+	}
+	return set, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPromptRegistry(t *testing.T) {
+	dir := t.TempDir()
+	writePrompt(t, dir, "job_search.b.tmpl", "Variant B for {{.Prompt}}")
+	writePrompt(t, dir, "search_terms.tmpl", "Custom terms for {{.}}")
+
+	r := &PromptRegistry{}
+	if err := r.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	prompts, err := r.Select("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(prompts[jobSearchPrompt].Version, "job_search@") {
+		t.Errorf("expected the embedded job search prompt, got %s", prompts[jobSearchPrompt].Version)
+	}
+	if got := render(t, prompts[searchTermsPrompt], "go"); got != "Custom terms for go" {
+		t.Errorf("expected the directory to override the embedded prompt, got %q", got)
+	}
+	if prompts[analyzeResumePrompt] == nil {
+		t.Error("expected the embedded resume prompt")
+	}
+
+	prompts, err = r.Select("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(prompts[jobSearchPrompt].Version, "job_search.b@") {
+		t.Errorf("expected variant b, got %s", prompts[jobSearchPrompt].Version)
+	}
+	if prompts[searchTermsPrompt].Variant != DefaultVariant {
+		t.Errorf("expected the default for prompts without variant b, got %s", prompts[searchTermsPrompt].Variant)
+	}
+	if _, err := r.Select("c"); err == nil {
+		t.Error("expected an error for an unknown variant")
+	}
+}
+
+func TestPromptExperiment(t *testing.T) {
+	dir := t.TempDir()
+	writePrompt(t, dir, "job_search.b.tmpl", "Variant B for {{.Prompt}}")
+	r := &PromptRegistry{}
+	if err := r.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for share, expected := range map[string]string{"0": DefaultVariant, "1": "b"} {
+		experiments, err := ParseExperiments("job_search=b:" + share)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.SetExperiments(experiments); err != nil {
+			t.Fatal(err)
+		}
+		prompts, err := r.Select("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prompts[jobSearchPrompt].Variant != expected {
+			t.Errorf("share %s: expected variant %s, got %s", share, expected, prompts[jobSearchPrompt].Variant)
+		}
+	}
+
+	if _, err := ParseExperiments("job_search=b:2"); err == nil {
+		t.Error("expected an error for a share above 1")
+	}
+	if err := r.SetExperiments(map[string]Experiment{"unknown": {Variant: "b", Share: 1}}); err == nil {
+		t.Error("expected an error for an unknown prompt")
+	}
+	if err := r.SetExperiments(map[string]Experiment{searchTermsPrompt: {Variant: "b", Share: 1}}); err == nil {
+		t.Error("expected an error for a missing variant")
+	}
+
+	// The variant being tested can't be removed.
+	if err := r.SetExperiments(map[string]Experiment{jobSearchPrompt: {Variant: "b", Share: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "job_search.b.tmpl")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Load(dir); err == nil {
+		t.Error("expected an error reloading without the variant")
+	}
+	if prompts, err := r.Select(""); err != nil || prompts[jobSearchPrompt].Variant != "b" {
+		t.Errorf("expected the variant to stay in use, got %v", err)
+	}
+}
+
+func TestPromptReload(t *testing.T) {
+	dir := t.TempDir()
+	writePrompt(t, dir, "search_terms.tmpl", "First {{.}}")
+	r := &PromptRegistry{}
+	if err := r.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	prompts, err := r.Select("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := prompts[searchTermsPrompt]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, testLogger(), 10*time.Millisecond)
+
+	// A template that doesn't parse keeps the previous version.
+	writePrompt(t, dir, "search_terms.tmpl", "Broken {{.")
+	time.Sleep(100 * time.Millisecond)
+	if prompts, _ := r.Select(""); prompts[searchTermsPrompt].Version != first.Version {
+		t.Errorf("expected %s to stay after a broken edit, got %s", first.Version, prompts[searchTermsPrompt].Version)
+	}
+
+	writePrompt(t, dir, "search_terms.tmpl", "Second {{.}}")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		prompts, _ := r.Select("")
+		if render(t, prompts[searchTermsPrompt], "go") == "Second go" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the prompt to be reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The prompts selected for a request don't change.
+	if render(t, first, "go") != "First go" {
+		t.Error("expected the selected prompt to stay the same")
+	}
+}
+
+func writePrompt(t *testing.T, dir, name, text string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	mtime := time.Now()
+	if info, err := os.Stat(path); err == nil {
+		// Filesystems with a coarse timestamp resolution would hide the change otherwise.
+		mtime = info.ModTime().Add(time.Second)
+	}
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func render(t *testing.T, p *Prompt, data any) string {
+	t.Helper()
+	sb := &strings.Builder{}
+	if err := p.Template.Execute(sb, data); err != nil {
+		t.Fatal(err)
+	}
+	return sb.String()
+}
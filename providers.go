@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/newhook/whoishiring/openai"
+	"github.com/newhook/whoishiring/transport"
+	"github.com/pkg/errors"
+	"os"
+)
+
+// Provider is an OpenAI-compatible server, e.g. vLLM, LiteLLM or llama.cpp, registered under its name
+// as a completion model, an embedding model or both.
+type Provider struct {
+	Name    string `json:"name"`
+	BaseURL string `json:"base_url"`
+	// APIKeyEnv names the environment variable holding the API key, so keys stay out of the file.
+	APIKeyEnv string `json:"api_key_env"`
+	// Headers are sent with every request. Values are expanded with environment variables.
+	Headers map[string]string `json:"headers"`
+	// Limits is formatted like the -openai-limits flag, e.g. "rps=5,tpm=1000000".
+	Limits string `json:"limits"`
+
+	CompletionModel string `json:"completion_model"`
+
+	EmbeddingModel      string `json:"embedding_model"`
+	EmbeddingDimensions int    `json:"embedding_dimensions"`
+	// EmbeddingSpace names a registered embedding model the vectors are compatible with, e.g.
+	// "nomic-embed-text" for a server hosting nomic-embed-text-v1.5, so it can be a fallback for it.
+	EmbeddingSpace string `json:"embedding_space"`
+}
+
+// LoadProviders reads a JSON array of providers from path and registers them.
+func LoadProviders(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var providers []Provider
+	if err := json.Unmarshal(b, &providers); err != nil {
+		return errors.Wrapf(err, "%s", path)
+	}
+	for _, p := range providers {
+		if err := registerProvider(p); err != nil {
+			return errors.Wrapf(err, "%s", path)
+		}
+	}
+	return nil
+}
+
+// registerProvider adds p to completions and embeddings.
+func registerProvider(p Provider) error {
+	if p.Name == "" {
+		return errors.New("provider without a name")
+	}
+	if p.BaseURL == "" {
+		return errors.Errorf("provider %s: missing base_url", p.Name)
+	}
+	if p.CompletionModel == "" && p.EmbeddingModel == "" {
+		return errors.Errorf("provider %s: expected a completion_model or an embedding_model", p.Name)
+	}
+	if _, ok := completions[p.Name]; ok && p.CompletionModel != "" {
+		return errors.Errorf("provider %s: completion model already registered", p.Name)
+	}
+	if _, ok := embeddings[p.Name]; ok && p.EmbeddingModel != "" {
+		return errors.Errorf("provider %s: embedding model already registered", p.Name)
+	}
+	if p.EmbeddingModel != "" && p.EmbeddingDimensions <= 0 {
+		return errors.Errorf("provider %s: missing embedding_dimensions", p.Name)
+	}
+	if p.EmbeddingSpace != "" {
+		if e, ok := embeddings[p.EmbeddingSpace]; !ok || e.Dimensions != p.EmbeddingDimensions {
+			return errors.Errorf("provider %s: embedding_space %s isn't a model with %d dimensions", p.Name, p.EmbeddingSpace, p.EmbeddingDimensions)
+		}
+	}
+
+	var limits transport.Limits
+	if err := limits.Set(p.Limits); err != nil {
+		return errors.Wrapf(err, "provider %s", p.Name)
+	}
+	var apiKey string
+	if p.APIKeyEnv != "" {
+		apiKey = os.Getenv(p.APIKeyEnv)
+		if apiKey == "" {
+			return errors.Errorf("provider %s: %s is not set", p.Name, p.APIKeyEnv)
+		}
+	}
+	headers := map[string]string{}
+	for k, v := range p.Headers {
+		headers[k] = os.ExpandEnv(v)
+	}
+
+	c := &openai.Client{
+		BaseURL:   p.BaseURL,
+		APIKey:    apiKey,
+		Headers:   headers,
+		Transport: openai.NewTransport(p.Name, limits),
+		Model:     p.CompletionModel,
+	}
+	if p.CompletionModel != "" {
+		completions[p.Name] = Completion{
+			Model: p.Name,
+			LLM:   c,
+		}
+	}
+	// Embeddings are stored under the provider name, so pointing a provider at another model
+	// needs a new name, since the stored vectors aren't comparable with the new ones.
+	if p.EmbeddingModel != "" {
+		embeddings[p.Name] = Embedding{
+			Model:      p.Name,
+			Provider:   p.Name,
+			Space:      p.EmbeddingSpace,
+			Dimensions: p.EmbeddingDimensions,
+			// The openai client normalizes vectors of servers that don't.
+			Normalized: true,
+			Embedding:  c.Embedding(openai.EmbeddingModelOpenAI(p.EmbeddingModel)),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// maxRedirects is how many redirects a public client follows.
+const maxRedirects = 5
+
+// sharedAddressSpace is the carrier-grade NAT range, which isn't reachable from the internet either.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicIP reports whether ip is an internet address, as opposed to one of the server's own network.
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified() && !sharedAddressSpace.Contains(ip)
+}
+
+// allowedIP decides the addresses public clients connect to, tests allow their local servers.
+var allowedIP = publicIP
+
+// newPublicClient returns a client for the URLs given by users, e.g. job pages and webhooks. It only
+// connects to public addresses, so those URLs can't reach the server's own network. The address is
+// checked when connecting, after the host name is resolved, so redirects and DNS rebinding are covered
+// too.
+func newPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if ip := net.ParseIP(host); ip == nil || !allowedIP(ip) {
+				return errors.Errorf("%s isn't a public address", host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// No proxy from the environment, it would be the one connected to.
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: timeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return checkPublicURL(req.URL)
+		},
+	}
+}
+
+// checkPublicURL returns an error if u isn't an http or https URL, or names an address that isn't public.
+// Host names are checked by the client when it connects.
+func checkPublicURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" || u.Hostname() == "" {
+		return errors.Errorf("invalid URL %q", u.Redacted())
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !allowedIP(ip) {
+		return errors.Errorf("%s isn't a public address", u.Hostname())
+	}
+	return nil
+}
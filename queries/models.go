@@ -4,13 +4,23 @@
 
 package queries
 
+type CompletionCache struct {
+	Key           string `json:"key"`
+	Provider      string `json:"provider"`
+	Model         string `json:"model"`
+	PromptVersion string `json:"prompt_version"`
+	Response      string `json:"response"`
+	CreatedAt     int    `json:"created_at"`
+}
+
 type Embedding struct {
-	ID        int    `json:"id"`
-	Model     string `json:"model"`
-	ItemID    int    `json:"item_id"`
-	Embedding []byte `json:"embedding"`
-	CreatedAt int    `json:"created_at"`
-	UpdatedAt int    `json:"updated_at"`
+	ID          int    `json:"id"`
+	Model       string `json:"model"`
+	ItemID      int    `json:"item_id"`
+	Embedding   []byte `json:"embedding"`
+	CreatedAt   int    `json:"created_at"`
+	UpdatedAt   int    `json:"updated_at"`
+	ContentHash string `json:"content_hash"`
 }
 
 type Item struct {
@@ -45,3 +55,39 @@ type LinkedinScrape struct {
 	CreatedAt int    `json:"created_at"`
 	UpdatedAt int    `json:"updated_at"`
 }
+
+type NotifiedItem struct {
+	SavedSearchID string `json:"saved_search_id"`
+	ItemID        int    `json:"item_id"`
+	CreatedAt     int    `json:"created_at"`
+}
+
+type SavedSearch struct {
+	ID        string `json:"id"`
+	Principal string `json:"principal"`
+	State     string `json:"state"`
+	CreatedAt int    `json:"created_at"`
+	UpdatedAt int    `json:"updated_at"`
+}
+
+type Session struct {
+	ID        string `json:"id"`
+	Principal string `json:"principal"`
+	State     string `json:"state"`
+	CreatedAt int    `json:"created_at"`
+	UpdatedAt int    `json:"updated_at"`
+	Version   int    `json:"version"`
+}
+
+type Usage struct {
+	ID           int     `json:"id"`
+	Endpoint     string  `json:"endpoint"`
+	Provider     string  `json:"provider"`
+	Model        string  `json:"model"`
+	Task         string  `json:"task"`
+	InputTokens  int     `json:"input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+	Cost         float64 `json:"cost"`
+	CreatedAt    int     `json:"created_at"`
+	Principal    string  `json:"principal"`
+}
@@ -10,8 +10,90 @@ import (
 	"strings"
 )
 
+const deleteEmbedding = `-- name: DeleteEmbedding :exec
+DELETE FROM embeddings where id = ?
+`
+
+func (q *Queries) DeleteEmbedding(ctx context.Context, id int) error {
+	_, err := q.db.ExecContext(ctx, deleteEmbedding, id)
+	return err
+}
+
+const deleteExpiredCompletions = `-- name: DeleteExpiredCompletions :execrows
+DELETE FROM completion_cache where created_at < ?
+`
+
+func (q *Queries) DeleteExpiredCompletions(ctx context.Context, createdAt int) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteExpiredCompletions, createdAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteExpiredSessions = `-- name: DeleteExpiredSessions :execrows
+DELETE FROM sessions where updated_at < ?
+`
+
+func (q *Queries) DeleteExpiredSessions(ctx context.Context, updatedAt int) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteExpiredSessions, updatedAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteNotifiedItems = `-- name: DeleteNotifiedItems :exec
+DELETE FROM notified_items where saved_search_id = ?
+`
+
+func (q *Queries) DeleteNotifiedItems(ctx context.Context, savedSearchID string) error {
+	_, err := q.db.ExecContext(ctx, deleteNotifiedItems, savedSearchID)
+	return err
+}
+
+const deleteSavedSearch = `-- name: DeleteSavedSearch :execrows
+DELETE FROM saved_searches where id = ? and principal = ?
+`
+
+type DeleteSavedSearchParams struct {
+	ID        string `json:"id"`
+	Principal string `json:"principal"`
+}
+
+func (q *Queries) DeleteSavedSearch(ctx context.Context, arg DeleteSavedSearchParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteSavedSearch, arg.ID, arg.Principal)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const getCachedCompletion = `-- name: GetCachedCompletion :one
+select key, provider, model, prompt_version, response, created_at from completion_cache where key = ? and created_at >= ?
+`
+
+type GetCachedCompletionParams struct {
+	Key       string `json:"key"`
+	CreatedAt int    `json:"created_at"`
+}
+
+func (q *Queries) GetCachedCompletion(ctx context.Context, arg GetCachedCompletionParams) (CompletionCache, error) {
+	row := q.db.QueryRowContext(ctx, getCachedCompletion, arg.Key, arg.CreatedAt)
+	var i CompletionCache
+	err := row.Scan(
+		&i.Key,
+		&i.Provider,
+		&i.Model,
+		&i.PromptVersion,
+		&i.Response,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
 const getEmbedding = `-- name: GetEmbedding :one
-select id, model, item_id, embedding, created_at, updated_at from embeddings where item_id = ? and model = ?
+select id, model, item_id, embedding, created_at, updated_at, content_hash from embeddings where item_id = ? and model = ?
 `
 
 type GetEmbeddingParams struct {
@@ -29,12 +111,37 @@ func (q *Queries) GetEmbedding(ctx context.Context, arg GetEmbeddingParams) (Emb
 		&i.Embedding,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.ContentHash,
+	)
+	return i, err
+}
+
+const getEmbeddingByContentHash = `-- name: GetEmbeddingByContentHash :one
+select id, model, item_id, embedding, created_at, updated_at, content_hash from embeddings where model = ? and content_hash = ? limit 1
+`
+
+type GetEmbeddingByContentHashParams struct {
+	Model       string `json:"model"`
+	ContentHash string `json:"content_hash"`
+}
+
+func (q *Queries) GetEmbeddingByContentHash(ctx context.Context, arg GetEmbeddingByContentHashParams) (Embedding, error) {
+	row := q.db.QueryRowContext(ctx, getEmbeddingByContentHash, arg.Model, arg.ContentHash)
+	var i Embedding
+	err := row.Scan(
+		&i.ID,
+		&i.Model,
+		&i.ItemID,
+		&i.Embedding,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.ContentHash,
 	)
 	return i, err
 }
 
 const getEmbeddings = `-- name: GetEmbeddings :many
-select id, model, item_id, embedding, created_at, updated_at from embeddings where model = ? and item_id in (/*SLICE:ids*/?)
+select id, model, item_id, embedding, created_at, updated_at, content_hash from embeddings where model = ? and item_id in (/*SLICE:ids*/?)
 `
 
 type GetEmbeddingsParams struct {
@@ -69,6 +176,7 @@ func (q *Queries) GetEmbeddings(ctx context.Context, arg GetEmbeddingsParams) ([
 			&i.Embedding,
 			&i.CreatedAt,
 			&i.UpdatedAt,
+			&i.ContentHash,
 		); err != nil {
 			return nil, err
 		}
@@ -84,7 +192,7 @@ func (q *Queries) GetEmbeddings(ctx context.Context, arg GetEmbeddingsParams) ([
 }
 
 const getEmbeddingsByParent = `-- name: GetEmbeddingsByParent :many
-select id, model, item_id, embedding, created_at, updated_at from embeddings where model = ? and item_id in (select id from items where parent = ?)
+select id, model, item_id, embedding, created_at, updated_at, content_hash from embeddings where model = ? and item_id in (select id from items where parent = ?)
 `
 
 type GetEmbeddingsByParentParams struct {
@@ -108,6 +216,7 @@ func (q *Queries) GetEmbeddingsByParent(ctx context.Context, arg GetEmbeddingsBy
 			&i.Embedding,
 			&i.CreatedAt,
 			&i.UpdatedAt,
+			&i.ContentHash,
 		); err != nil {
 			return nil, err
 		}
@@ -344,6 +453,60 @@ func (q *Queries) GetLinkedInScrape(ctx context.Context, url string) (LinkedinSc
 	return i, err
 }
 
+const getMaxItemID = `-- name: GetMaxItemID :one
+select CAST(coalesce(max(id), 0) AS INTEGER) from items
+`
+
+func (q *Queries) GetMaxItemID(ctx context.Context) (int64, error) {
+	row := q.db.QueryRowContext(ctx, getMaxItemID)
+	var column_1 int64
+	err := row.Scan(&column_1)
+	return column_1, err
+}
+
+const getNotifiedItems = `-- name: GetNotifiedItems :many
+select item_id from notified_items where saved_search_id = ? and item_id in (/*SLICE:ids*/?)
+`
+
+type GetNotifiedItemsParams struct {
+	SavedSearchID string `json:"saved_search_id"`
+	Ids           []int  `json:"ids"`
+}
+
+func (q *Queries) GetNotifiedItems(ctx context.Context, arg GetNotifiedItemsParams) ([]int, error) {
+	query := getNotifiedItems
+	var queryParams []interface{}
+	queryParams = append(queryParams, arg.SavedSearchID)
+	if len(arg.Ids) > 0 {
+		for _, v := range arg.Ids {
+			queryParams = append(queryParams, v)
+		}
+		query = strings.Replace(query, "/*SLICE:ids*/?", strings.Repeat(",?", len(arg.Ids))[1:], 1)
+	} else {
+		query = strings.Replace(query, "/*SLICE:ids*/?", "NULL", 1)
+	}
+	rows, err := q.db.QueryContext(ctx, query, queryParams...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []int
+	for rows.Next() {
+		var item_id int
+		if err := rows.Scan(&item_id); err != nil {
+			return nil, err
+		}
+		items = append(items, item_id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getPostCount = `-- name: GetPostCount :one
 select count(*) from items where parent = 0
 `
@@ -396,20 +559,223 @@ func (q *Queries) GetPosts(ctx context.Context) ([]Item, error) {
 	return items, nil
 }
 
+const getPrincipalSpending = `-- name: GetPrincipalSpending :one
+SELECT CAST(coalesce(sum(input_tokens + output_tokens), 0) AS INTEGER) AS tokens, CAST(coalesce(sum(cost), 0) AS REAL) AS cost
+FROM usage where principal = ? and endpoint = ? and created_at >= ?
+`
+
+type GetPrincipalSpendingParams struct {
+	Principal string `json:"principal"`
+	Endpoint  string `json:"endpoint"`
+	CreatedAt int    `json:"created_at"`
+}
+
+type GetPrincipalSpendingRow struct {
+	Tokens int64   `json:"tokens"`
+	Cost   float64 `json:"cost"`
+}
+
+func (q *Queries) GetPrincipalSpending(ctx context.Context, arg GetPrincipalSpendingParams) (GetPrincipalSpendingRow, error) {
+	row := q.db.QueryRowContext(ctx, getPrincipalSpending, arg.Principal, arg.Endpoint, arg.CreatedAt)
+	var i GetPrincipalSpendingRow
+	err := row.Scan(
+		&i.Tokens,
+		&i.Cost,
+	)
+	return i, err
+}
+
+const getSavedSearch = `-- name: GetSavedSearch :one
+select id, principal, state, created_at, updated_at from saved_searches where id = ?
+`
+
+func (q *Queries) GetSavedSearch(ctx context.Context, id string) (SavedSearch, error) {
+	row := q.db.QueryRowContext(ctx, getSavedSearch, id)
+	var i SavedSearch
+	err := row.Scan(
+		&i.ID,
+		&i.Principal,
+		&i.State,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const getSavedSearches = `-- name: GetSavedSearches :many
+select id, principal, state, created_at, updated_at from saved_searches order by created_at
+`
+
+func (q *Queries) GetSavedSearches(ctx context.Context) ([]SavedSearch, error) {
+	rows, err := q.db.QueryContext(ctx, getSavedSearches)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SavedSearch
+	for rows.Next() {
+		var i SavedSearch
+		if err := rows.Scan(
+			&i.ID,
+			&i.Principal,
+			&i.State,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getSavedSearchesByPrincipal = `-- name: GetSavedSearchesByPrincipal :many
+select id, principal, state, created_at, updated_at from saved_searches where principal = ? order by created_at
+`
+
+func (q *Queries) GetSavedSearchesByPrincipal(ctx context.Context, principal string) ([]SavedSearch, error) {
+	rows, err := q.db.QueryContext(ctx, getSavedSearchesByPrincipal, principal)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SavedSearch
+	for rows.Next() {
+		var i SavedSearch
+		if err := rows.Scan(
+			&i.ID,
+			&i.Principal,
+			&i.State,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getSession = `-- name: GetSession :one
+select id, principal, state, created_at, updated_at, version from sessions where id = ?
+`
+
+func (q *Queries) GetSession(ctx context.Context, id string) (Session, error) {
+	row := q.db.QueryRowContext(ctx, getSession, id)
+	var i Session
+	err := row.Scan(
+		&i.ID,
+		&i.Principal,
+		&i.State,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Version,
+	)
+	return i, err
+}
+
+const getSpending = `-- name: GetSpending :one
+SELECT CAST(coalesce(sum(input_tokens + output_tokens), 0) AS INTEGER) AS tokens, CAST(coalesce(sum(cost), 0) AS REAL) AS cost
+FROM usage where endpoint = ? and created_at >= ?
+`
+
+type GetSpendingParams struct {
+	Endpoint  string `json:"endpoint"`
+	CreatedAt int    `json:"created_at"`
+}
+
+type GetSpendingRow struct {
+	Tokens int64   `json:"tokens"`
+	Cost   float64 `json:"cost"`
+}
+
+func (q *Queries) GetSpending(ctx context.Context, arg GetSpendingParams) (GetSpendingRow, error) {
+	row := q.db.QueryRowContext(ctx, getSpending, arg.Endpoint, arg.CreatedAt)
+	var i GetSpendingRow
+	err := row.Scan(
+		&i.Tokens,
+		&i.Cost,
+	)
+	return i, err
+}
+
+const getUsageReport = `-- name: GetUsageReport :many
+SELECT CAST(date(created_at, 'unixepoch') AS TEXT) AS day, provider, endpoint, count(*) AS calls,
+       CAST(sum(input_tokens) AS INTEGER) AS input_tokens, CAST(sum(output_tokens) AS INTEGER) AS output_tokens,
+       CAST(sum(cost) AS REAL) AS cost
+FROM usage where created_at >= ?
+GROUP BY day, provider, endpoint
+ORDER BY day DESC, provider, endpoint
+`
+
+type GetUsageReportRow struct {
+	Day          string  `json:"day"`
+	Provider     string  `json:"provider"`
+	Endpoint     string  `json:"endpoint"`
+	Calls        int64   `json:"calls"`
+	InputTokens  int64   `json:"input_tokens"`
+	OutputTokens int64   `json:"output_tokens"`
+	Cost         float64 `json:"cost"`
+}
+
+func (q *Queries) GetUsageReport(ctx context.Context, createdAt int) ([]GetUsageReportRow, error) {
+	rows, err := q.db.QueryContext(ctx, getUsageReport, createdAt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetUsageReportRow
+	for rows.Next() {
+		var i GetUsageReportRow
+		if err := rows.Scan(
+			&i.Day,
+			&i.Provider,
+			&i.Endpoint,
+			&i.Calls,
+			&i.InputTokens,
+			&i.OutputTokens,
+			&i.Cost,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const insertEmbedding = `-- name: InsertEmbedding :exec
 INSERT INTO embeddings(
-    item_id, model, embedding, created_at, updated_at
+    item_id, model, embedding, content_hash, created_at, updated_at
 ) VALUES(
-    ?, ?, ?, ?, ?
+    ?, ?, ?, ?, ?, ?
 )
 `
 
 type InsertEmbeddingParams struct {
-	ItemID    int    `json:"item_id"`
-	Model     string `json:"model"`
-	Embedding []byte `json:"embedding"`
-	CreatedAt int    `json:"created_at"`
-	UpdatedAt int    `json:"updated_at"`
+	ItemID      int    `json:"item_id"`
+	Model       string `json:"model"`
+	Embedding   []byte `json:"embedding"`
+	ContentHash string `json:"content_hash"`
+	CreatedAt   int    `json:"created_at"`
+	UpdatedAt   int    `json:"updated_at"`
 }
 
 func (q *Queries) InsertEmbedding(ctx context.Context, arg InsertEmbeddingParams) error {
@@ -417,6 +783,7 @@ func (q *Queries) InsertEmbedding(ctx context.Context, arg InsertEmbeddingParams
 		arg.ItemID,
 		arg.Model,
 		arg.Embedding,
+		arg.ContentHash,
 		arg.CreatedAt,
 		arg.UpdatedAt,
 	)
@@ -515,6 +882,118 @@ func (q *Queries) InsertLinkedInScrape(ctx context.Context, arg InsertLinkedInSc
 	return err
 }
 
+const insertNotifiedItem = `-- name: InsertNotifiedItem :exec
+INSERT INTO notified_items (saved_search_id, item_id, created_at) VALUES (?, ?, ?)
+ON CONFLICT (saved_search_id, item_id) DO NOTHING
+`
+
+type InsertNotifiedItemParams struct {
+	SavedSearchID string `json:"saved_search_id"`
+	ItemID        int    `json:"item_id"`
+	CreatedAt     int    `json:"created_at"`
+}
+
+func (q *Queries) InsertNotifiedItem(ctx context.Context, arg InsertNotifiedItemParams) error {
+	_, err := q.db.ExecContext(ctx, insertNotifiedItem, arg.SavedSearchID, arg.ItemID, arg.CreatedAt)
+	return err
+}
+
+const insertSession = `-- name: InsertSession :exec
+INSERT INTO sessions (id, principal, state, created_at, updated_at, version) VALUES (?, ?, ?, ?, ?, ?)
+`
+
+type InsertSessionParams struct {
+	ID        string `json:"id"`
+	Principal string `json:"principal"`
+	State     string `json:"state"`
+	CreatedAt int    `json:"created_at"`
+	UpdatedAt int    `json:"updated_at"`
+	Version   int    `json:"version"`
+}
+
+func (q *Queries) InsertSession(ctx context.Context, arg InsertSessionParams) error {
+	_, err := q.db.ExecContext(ctx, insertSession,
+		arg.ID,
+		arg.Principal,
+		arg.State,
+		arg.CreatedAt,
+		arg.UpdatedAt,
+		arg.Version,
+	)
+	return err
+}
+
+const insertUsage = `-- name: InsertUsage :exec
+INSERT INTO usage (endpoint, provider, model, task, input_tokens, output_tokens, cost, created_at, principal) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+type InsertUsageParams struct {
+	Endpoint     string  `json:"endpoint"`
+	Provider     string  `json:"provider"`
+	Model        string  `json:"model"`
+	Task         string  `json:"task"`
+	InputTokens  int     `json:"input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+	Cost         float64 `json:"cost"`
+	CreatedAt    int     `json:"created_at"`
+	Principal    string  `json:"principal"`
+}
+
+func (q *Queries) InsertUsage(ctx context.Context, arg InsertUsageParams) error {
+	_, err := q.db.ExecContext(ctx, insertUsage,
+		arg.Endpoint,
+		arg.Provider,
+		arg.Model,
+		arg.Task,
+		arg.InputTokens,
+		arg.OutputTokens,
+		arg.Cost,
+		arg.CreatedAt,
+		arg.Principal,
+	)
+	return err
+}
+
+const paginateEmbeddings = `-- name: PaginateEmbeddings :many
+select id, model, item_id, embedding, created_at, updated_at, content_hash from embeddings where id > ? order by id limit ?
+`
+
+type PaginateEmbeddingsParams struct {
+	ID    int   `json:"id"`
+	Limit int64 `json:"limit"`
+}
+
+func (q *Queries) PaginateEmbeddings(ctx context.Context, arg PaginateEmbeddingsParams) ([]Embedding, error) {
+	rows, err := q.db.QueryContext(ctx, paginateEmbeddings, arg.ID, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Embedding
+	for rows.Next() {
+		var i Embedding
+		if err := rows.Scan(
+			&i.ID,
+			&i.Model,
+			&i.ItemID,
+			&i.Embedding,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.ContentHash,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const paginateItems = `-- name: PaginateItems :many
 SELECT id, deleted, type, "by", time, text, dead, parent, poll, url, score, title, descendants from items where id > ? order by id limit ?
 `
@@ -561,6 +1040,27 @@ func (q *Queries) PaginateItems(ctx context.Context, arg PaginateItemsParams) ([
 	return items, nil
 }
 
+const updateEmbedding = `-- name: UpdateEmbedding :exec
+UPDATE embeddings set embedding = ?, content_hash = ?, updated_at = ? where id = ?
+`
+
+type UpdateEmbeddingParams struct {
+	Embedding   []byte `json:"embedding"`
+	ContentHash string `json:"content_hash"`
+	UpdatedAt   int    `json:"updated_at"`
+	ID          int    `json:"id"`
+}
+
+func (q *Queries) UpdateEmbedding(ctx context.Context, arg UpdateEmbeddingParams) error {
+	_, err := q.db.ExecContext(ctx, updateEmbedding,
+		arg.Embedding,
+		arg.ContentHash,
+		arg.UpdatedAt,
+		arg.ID,
+	)
+	return err
+}
+
 const updateItem = `-- name: UpdateItem :exec
 UPDATE items set parent = ?, time = ?, type = ?, by = ? where id = ?
 `
@@ -583,3 +1083,101 @@ func (q *Queries) UpdateItem(ctx context.Context, arg UpdateItemParams) error {
 	)
 	return err
 }
+
+const updateSavedSearch = `-- name: UpdateSavedSearch :execrows
+UPDATE saved_searches set state = ?, updated_at = ? where id = ? and principal = ?
+`
+
+type UpdateSavedSearchParams struct {
+	State     string `json:"state"`
+	UpdatedAt int    `json:"updated_at"`
+	ID        string `json:"id"`
+	Principal string `json:"principal"`
+}
+
+func (q *Queries) UpdateSavedSearch(ctx context.Context, arg UpdateSavedSearchParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, updateSavedSearch,
+		arg.State,
+		arg.UpdatedAt,
+		arg.ID,
+		arg.Principal,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const updateSession = `-- name: UpdateSession :execrows
+UPDATE sessions set state = ?, updated_at = ?, version = version + 1 where id = ? and version = ?
+`
+
+type UpdateSessionParams struct {
+	State     string `json:"state"`
+	UpdatedAt int    `json:"updated_at"`
+	ID        string `json:"id"`
+	Version   int    `json:"version"`
+}
+
+func (q *Queries) UpdateSession(ctx context.Context, arg UpdateSessionParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, updateSession,
+		arg.State,
+		arg.UpdatedAt,
+		arg.ID,
+		arg.Version,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const upsertCachedCompletion = `-- name: UpsertCachedCompletion :exec
+INSERT INTO completion_cache (key, provider, model, prompt_version, response, created_at) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (key) DO UPDATE SET response = excluded.response, created_at = excluded.created_at
+`
+
+type UpsertCachedCompletionParams struct {
+	Key           string `json:"key"`
+	Provider      string `json:"provider"`
+	Model         string `json:"model"`
+	PromptVersion string `json:"prompt_version"`
+	Response      string `json:"response"`
+	CreatedAt     int    `json:"created_at"`
+}
+
+func (q *Queries) UpsertCachedCompletion(ctx context.Context, arg UpsertCachedCompletionParams) error {
+	_, err := q.db.ExecContext(ctx, upsertCachedCompletion,
+		arg.Key,
+		arg.Provider,
+		arg.Model,
+		arg.PromptVersion,
+		arg.Response,
+		arg.CreatedAt,
+	)
+	return err
+}
+
+const upsertSavedSearch = `-- name: UpsertSavedSearch :exec
+INSERT INTO saved_searches (id, principal, state, created_at, updated_at) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET state = excluded.state, updated_at = excluded.updated_at
+`
+
+type UpsertSavedSearchParams struct {
+	ID        string `json:"id"`
+	Principal string `json:"principal"`
+	State     string `json:"state"`
+	CreatedAt int    `json:"created_at"`
+	UpdatedAt int    `json:"updated_at"`
+}
+
+func (q *Queries) UpsertSavedSearch(ctx context.Context, arg UpsertSavedSearchParams) error {
+	_, err := q.db.ExecContext(ctx, upsertSavedSearch,
+		arg.ID,
+		arg.Principal,
+		arg.State,
+		arg.CreatedAt,
+		arg.UpdatedAt,
+	)
+	return err
+}
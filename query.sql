@@ -40,11 +40,23 @@ select * from embeddings where item_id = ? and model = ?;
 
 -- name: InsertEmbedding :exec
 INSERT INTO embeddings(
-    item_id, model, embedding, created_at, updated_at
+    item_id, model, embedding, content_hash, created_at, updated_at
 ) VALUES(
-    ?, ?, ?, ?, ?
+    ?, ?, ?, ?, ?, ?
 );
 
+-- name: UpdateEmbedding :exec
+UPDATE embeddings set embedding = ?, content_hash = ?, updated_at = ? where id = ?;
+
+-- name: GetEmbeddingByContentHash :one
+select * from embeddings where model = ? and content_hash = ? limit 1;
+
+-- name: PaginateEmbeddings :many
+select * from embeddings where id > ? order by id limit ?;
+
+-- name: DeleteEmbedding :exec
+DELETE FROM embeddings where id = ?;
+
 -- name: GetEmbeddingsByParent :many
 select * from embeddings where model = ? and item_id in (select id from items where parent = ?);
 
@@ -62,3 +74,76 @@ select * from linkedin_scrapes where url = ?;
 
 -- name: InsertLinkedInScrape :exec
 INSERT INTO linkedin_scrapes (url, json, created_at, updated_at) VALUES (?, ?, ?, ?);
+
+-- name: GetCachedCompletion :one
+select * from completion_cache where key = ? and created_at >= ?;
+
+-- name: UpsertCachedCompletion :exec
+INSERT INTO completion_cache (key, provider, model, prompt_version, response, created_at) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (key) DO UPDATE SET response = excluded.response, created_at = excluded.created_at;
+
+-- name: DeleteExpiredCompletions :execrows
+DELETE FROM completion_cache where created_at < ?;
+
+-- name: InsertUsage :exec
+INSERT INTO usage (endpoint, provider, model, task, input_tokens, output_tokens, cost, created_at, principal) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
+
+-- name: GetUsageReport :many
+SELECT CAST(date(created_at, 'unixepoch') AS TEXT) AS day, provider, endpoint, count(*) AS calls,
+       CAST(sum(input_tokens) AS INTEGER) AS input_tokens, CAST(sum(output_tokens) AS INTEGER) AS output_tokens,
+       CAST(sum(cost) AS REAL) AS cost
+FROM usage where created_at >= ?
+GROUP BY day, provider, endpoint
+ORDER BY day DESC, provider, endpoint;
+
+-- name: GetPrincipalSpending :one
+SELECT CAST(coalesce(sum(input_tokens + output_tokens), 0) AS INTEGER) AS tokens, CAST(coalesce(sum(cost), 0) AS REAL) AS cost
+FROM usage where principal = ? and endpoint = ? and created_at >= ?;
+
+-- name: GetSpending :one
+SELECT CAST(coalesce(sum(input_tokens + output_tokens), 0) AS INTEGER) AS tokens, CAST(coalesce(sum(cost), 0) AS REAL) AS cost
+FROM usage where endpoint = ? and created_at >= ?;
+
+-- name: GetSession :one
+select * from sessions where id = ?;
+
+-- name: InsertSession :exec
+INSERT INTO sessions (id, principal, state, created_at, updated_at, version) VALUES (?, ?, ?, ?, ?, ?);
+
+-- name: UpdateSession :execrows
+UPDATE sessions set state = ?, updated_at = ?, version = version + 1 where id = ? and version = ?;
+
+-- name: DeleteExpiredSessions :execrows
+DELETE FROM sessions where updated_at < ?;
+
+-- name: GetMaxItemID :one
+select CAST(coalesce(max(id), 0) AS INTEGER) from items;
+
+-- name: GetSavedSearch :one
+select * from saved_searches where id = ?;
+
+-- name: GetSavedSearches :many
+select * from saved_searches order by created_at;
+
+-- name: GetSavedSearchesByPrincipal :many
+select * from saved_searches where principal = ? order by created_at;
+
+-- name: UpsertSavedSearch :exec
+INSERT INTO saved_searches (id, principal, state, created_at, updated_at) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET state = excluded.state, updated_at = excluded.updated_at;
+
+-- name: UpdateSavedSearch :execrows
+UPDATE saved_searches set state = ?, updated_at = ? where id = ? and principal = ?;
+
+-- name: DeleteSavedSearch :execrows
+DELETE FROM saved_searches where id = ? and principal = ?;
+
+-- name: GetNotifiedItems :many
+select item_id from notified_items where saved_search_id = ? and item_id in (sqlc.slice(ids));
+
+-- name: InsertNotifiedItem :exec
+INSERT INTO notified_items (saved_search_id, item_id, created_at) VALUES (?, ?, ?)
+ON CONFLICT (saved_search_id, item_id) DO NOTHING;
+
+-- name: DeleteNotifiedItems :exec
+DELETE FROM notified_items where saved_search_id = ?;
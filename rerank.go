@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+	"golang.org/x/sync/errgroup"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCandidates is how many vector search results are reranked by default.
+	DefaultCandidates = 10
+	MaxCandidates     = 200
+	// DefaultTokenBudget is the default number of prompt tokens of a single reranking request.
+	DefaultTokenBudget = 8000
+	MinTokenBudget     = 1000
+
+	// picksPerRanking is how many jobs the job search prompt asks for.
+	picksPerRanking = 3
+	// minJobTokens is the least a description is truncated to, to fit a batch.
+	minJobTokens = 50
+	// jobOverheadTokens covers the <job> tag around each description.
+	jobOverheadTokens = 30
+)
+
+type jobDescription struct {
+	ID   int    `json:"id"`
+	Date string `json:"date"`
+	// Content is the untrusted text of the comment, escaped by untrustedText.
+	Content string `json:"content"`
+	// Suspicious is whether the comment was flagged by detectInjection.
+	Suspicious bool `json:"suspicious"`
+}
+
+var (
+	encodingOnce sync.Once
+	encoding     *tiktoken.Tiktoken
+	encodingErr  error
+)
+
+// tokenizer returns the cl100k_base encoding, which all the completion models are close enough to for
+// budgeting.
+func tokenizer() (*tiktoken.Tiktoken, error) {
+	encodingOnce.Do(func() {
+		tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+		encoding, encodingErr = tiktoken.GetEncoding("cl100k_base")
+		encodingErr = errors.WithStack(encodingErr)
+	})
+	return encoding, encodingErr
+}
+
+type candidate struct {
+	job    jobDescription
+	tokens int
+	// flags are why the comment looks like a prompt injection, see detectInjection.
+	flags []string
+}
+
+// rerank has the completion model pick the best of results for prompt. Results that don't fit in one
+// prompt of budget tokens are split into batches, and the best of each batch advance to the next round,
+// until the remaining candidates fit in a single prompt. Only the final round is streamed to delta.
+func rerank(ctx context.Context, l *slog.Logger, c *completer, t task, prompt string, prefs preferences, results []Result, budget int, emit func(Event), delta deltaFunc) ([]Pick, error) {
+	tke, err := tokenizer()
+	if err != nil {
+		return nil, err
+	}
+
+	sb := &strings.Builder{}
+	if err := c.prompts[t.prompt].Template.Execute(sb, jobSearchContext(prompt, prefs, nil)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	overhead := len(tke.Encode(systemPrompt+sb.String(), nil, nil))
+	// Every batch must hold more jobs than it advances, or the rounds wouldn't converge.
+	maxJobTokens := (budget-overhead)/(picksPerRanking+1) - jobOverheadTokens
+	if maxJobTokens < minJobTokens {
+		return nil, errors.Errorf("token budget %d is too small for the %d token prompt", budget, overhead)
+	}
+
+	var candidates []candidate
+	for _, result := range results {
+		flags := detectInjection(plainText(result.Item.Text))
+		if flags != nil {
+			l.Warn("comment looks like a prompt injection", slog.Int("id", result.ID), slog.Any("reasons", flags))
+		}
+		content := untrustedText(result.Item.Text)
+		tokens := tke.Encode(content, nil, nil)
+		if len(tokens) > maxJobTokens {
+			content = tke.Decode(tokens[:maxJobTokens])
+			tokens = tokens[:maxJobTokens]
+		}
+		candidates = append(candidates, candidate{
+			job: jobDescription{
+				ID:         result.ID,
+				Date:       time.Unix(int64(result.Item.Time), 0).String(),
+				Content:    content,
+				Suspicious: flags != nil,
+			},
+			tokens: len(tokens) + jobOverheadTokens,
+			flags:  flags,
+		})
+	}
+
+	for round := 1; ; round++ {
+		batches := batchCandidates(candidates, budget-overhead)
+		if len(batches) <= 1 {
+			picks, err := c.GetJobs(ctx, t, jobSearchContext(prompt, prefs, candidates), delta)
+			if err != nil {
+				return nil, err
+			}
+			return checkPicks(l, candidates, picks), nil
+		}
+
+		l.Info("reranking", slog.Int("round", round), slog.Int("candidates", len(candidates)), slog.Int("batches", len(batches)))
+		emit(Event{Name: "rerank", Data: map[string]any{"round": round, "candidates": len(candidates), "batches": len(batches)}})
+		winners := make([][]candidate, len(batches))
+		g, ctx := errgroup.WithContext(ctx)
+		g.SetLimit(4)
+		for i, batch := range batches {
+			g.Go(func() error {
+				picks, err := c.GetJobs(ctx, t, jobSearchContext(prompt, prefs, batch), nil)
+				if err != nil {
+					return err
+				}
+				winners[i] = advance(l, batch, picks)
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return nil, err
+		}
+
+		candidates = nil
+		for _, w := range winners {
+			candidates = append(candidates, w...)
+		}
+	}
+}
+
+func jobSearchContext(prompt string, prefs preferences, candidates []candidate) map[string]any {
+	jobs := make([]jobDescription, len(candidates))
+	for i, c := range candidates {
+		jobs[i] = c.job
+	}
+	return map[string]any{
+		"Prompt":     prompt,
+		"Exclusions": prefs.Exclusions,
+		"Dislikes":   prefs.Dislikes,
+		"Jobs":       jobs,
+	}
+}
+
+// batchCandidates splits candidates, keeping their order, into batches of at most budget tokens.
+func batchCandidates(candidates []candidate, budget int) [][]candidate {
+	var batches [][]candidate
+	var batch []candidate
+	tokens := 0
+	for _, c := range candidates {
+		if len(batch) > 0 && tokens+c.tokens > budget {
+			batches = append(batches, batch)
+			batch, tokens = nil, 0
+		}
+		batch = append(batch, c)
+		tokens += c.tokens
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// advance returns the candidates of batch that were picked, in the order of checkPicks. When the model
+// picks nothing valid, the batch's leading candidates advance, since they rank best by similarity.
+func advance(l *slog.Logger, batch []candidate, picks []Pick) []candidate {
+	var winners []candidate
+	for _, pick := range checkPicks(l, batch, picks) {
+		for _, c := range batch {
+			if c.job.ID == pick.ID {
+				winners = append(winners, c)
+				break
+			}
+		}
+	}
+	if len(winners) == 0 {
+		l.Warn("no valid picks in batch, advancing by similarity", slog.Int("batch", len(batch)))
+		winners = batch[:min(picksPerRanking, len(batch))]
+	}
+	return winners
+}
+
+// similarityPicks picks the results most similar to the search, for when the completion model can't
+// rank them.
+func similarityPicks(results []Result) []Pick {
+	var picks []Pick
+	for _, result := range results[:min(picksPerRanking, len(results))] {
+		picks = append(picks, Pick{
+			ID:                  result.ID,
+			Rationale:           fmt.Sprintf("Ranked by vector similarity (%.2f) only, the completion budget is exhausted.", result.Similarity),
+			MatchedRequirements: []string{},
+			Concerns:            []string{},
+		})
+	}
+	return picks
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/newhook/whoishiring/queries"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRerankInBudgetedBatches(t *testing.T) {
+	useTestModels(t)
+
+	var results []Result
+	for i := range 40 {
+		id := 5000 + i
+		results = append(results, Result{
+			ID: id,
+			Item: queries.Item{
+				ID:   id,
+				Time: 1719792000,
+				Text: fmt.Sprintf("Job %d. ", id) + strings.Repeat("Senior backend engineer building Go services. ", 30),
+			},
+		})
+	}
+
+	budget := 2000
+	var rounds int
+	picks, err := rerank(context.Background(), testLogger(), newCompleter(testPrompts(t), nil, nil), jobSearchTask, "remote Go backend engineer", preferences{}, results, budget, func(e Event) {
+		if e.Name == "rerank" {
+			rounds++
+		}
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int
+	for _, pick := range picks {
+		ids = append(ids, pick.ID)
+	}
+	if !slices.Equal(ids, []int{5000, 5001, 5002}) {
+		t.Errorf("expected the best ranked candidates, got %v", ids)
+	}
+	if rounds == 0 {
+		t.Error("expected the candidates to be reranked in batches")
+	}
+
+	tke, err := tokenizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testLLMClient.requests) < 3 {
+		t.Fatalf("expected several batches, got %d requests", len(testLLMClient.requests))
+	}
+	for _, req := range testLLMClient.requests {
+		tokens := len(tke.Encode(req.System+req.Messages[0].Content, nil, nil))
+		if tokens > budget {
+			t.Errorf("request of %d tokens exceeds the budget of %d", tokens, budget)
+		}
+	}
+}
+
+func TestRerankBudgetTooSmall(t *testing.T) {
+	useTestModels(t)
+	_, err := rerank(context.Background(), testLogger(), newCompleter(testPrompts(t), nil, nil), jobSearchTask, strings.Repeat("remote Go backend engineer ", 200), preferences{}, nil, MinTokenBudget, func(Event) {}, nil)
+	if err == nil || !strings.Contains(err.Error(), "too small") {
+		t.Errorf("expected a budget error, got %v", err)
+	}
+}
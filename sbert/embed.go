@@ -0,0 +1,54 @@
+package sbert
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const defaultModelsDir = "models"
+
+// Embedding returns a function that creates embeddings for a text using a
+// sentence-transformers model evaluated locally on the CPU, no network or
+// separate daemon required. dir is the directory holding the model files as
+// downloaded from the Hugging Face hub, for example
+// https://huggingface.co/sentence-transformers/all-MiniLM-L6-v2. If it's
+// empty, $SBERT_MODELS_DIR/<name> or models/<name> is used.
+//
+// The model is loaded on first use.
+func Embedding(name string, dir string) func(ctx context.Context, text string) ([]float32, error) {
+	if dir == "" {
+		modelsDir := os.Getenv("SBERT_MODELS_DIR")
+		if modelsDir == "" {
+			modelsDir = defaultModelsDir
+		}
+		dir = filepath.Join(modelsDir, name)
+	}
+
+	var (
+		once    sync.Once
+		m       *model
+		loadErr error
+	)
+	return func(ctx context.Context, text string) ([]float32, error) {
+		once.Do(func() {
+			start := time.Now()
+			m, loadErr = load(dir)
+			if loadErr == nil {
+				slog.Info("loaded local embedding model", slog.String("dir", dir), slog.Duration("elapsed", time.Since(start)))
+			}
+		})
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		// A forward pass can't be interrupted, but don't start one for a
+		// cancelled request.
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return m.Embed(text), nil
+	}
+}
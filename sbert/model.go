@@ -0,0 +1,358 @@
+package sbert
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+type config struct {
+	HiddenSize            int     `json:"hidden_size"`
+	NumAttentionHeads     int     `json:"num_attention_heads"`
+	NumHiddenLayers       int     `json:"num_hidden_layers"`
+	IntermediateSize      int     `json:"intermediate_size"`
+	LayerNormEps          float64 `json:"layer_norm_eps"`
+	MaxPositionEmbeddings int     `json:"max_position_embeddings"`
+}
+
+type linear struct {
+	in, out int
+	weight  []float32 // [out, in]
+	bias    []float32
+}
+
+type layerNorm struct {
+	weight []float32
+	bias   []float32
+}
+
+type layer struct {
+	query, key, value linear
+	attentionOutput   linear
+	attentionNorm     layerNorm
+	intermediate      linear
+	output            linear
+	outputNorm        layerNorm
+}
+
+// model is a BERT encoder with mean pooling, the architecture of
+// sentence-transformers models such as all-MiniLM-L6-v2.
+type model struct {
+	config    config
+	maxTokens int
+	tokenizer *tokenizer
+
+	wordEmbeddings      tensor
+	positionEmbeddings  tensor
+	tokenTypeEmbeddings tensor
+	embeddingsNorm      layerNorm
+	layers              []layer
+}
+
+// load reads a model directory as downloaded from the Hugging Face hub:
+// config.json, vocab.txt, model.safetensors and optionally
+// tokenizer_config.json and sentence_bert_config.json.
+func load(dir string) (*model, error) {
+	m := &model{
+		config: config{LayerNormEps: 1e-12},
+	}
+	if err := readJSON(filepath.Join(dir, "config.json"), &m.config); err != nil {
+		return nil, err
+	}
+	if m.config.HiddenSize == 0 || m.config.NumAttentionHeads == 0 || m.config.HiddenSize%m.config.NumAttentionHeads != 0 {
+		return nil, errors.Errorf("%s: invalid config", dir)
+	}
+
+	tokenizerConfig := struct {
+		DoLowerCase *bool `json:"do_lower_case"`
+	}{}
+	if err := readJSON(filepath.Join(dir, "tokenizer_config.json"), &tokenizerConfig); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	lowercase := tokenizerConfig.DoLowerCase == nil || *tokenizerConfig.DoLowerCase
+
+	sentenceConfig := struct {
+		MaxSeqLength int `json:"max_seq_length"`
+	}{}
+	if err := readJSON(filepath.Join(dir, "sentence_bert_config.json"), &sentenceConfig); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	m.maxTokens = m.config.MaxPositionEmbeddings
+	if sentenceConfig.MaxSeqLength > 0 && sentenceConfig.MaxSeqLength < m.maxTokens {
+		m.maxTokens = sentenceConfig.MaxSeqLength
+	}
+
+	var err error
+	m.tokenizer, err = loadTokenizer(filepath.Join(dir, "vocab.txt"), lowercase)
+	if err != nil {
+		return nil, err
+	}
+
+	tensors, err := readSafetensors(filepath.Join(dir, "model.safetensors"))
+	if err != nil {
+		return nil, err
+	}
+	hidden := m.config.HiddenSize
+	w := weights{tensors: tensors}
+	m.wordEmbeddings = w.embeddings("embeddings.word_embeddings.weight", hidden)
+	m.positionEmbeddings = w.embeddings("embeddings.position_embeddings.weight", hidden)
+	m.tokenTypeEmbeddings = w.embeddings("embeddings.token_type_embeddings.weight", hidden)
+	m.embeddingsNorm = w.layerNorm("embeddings.LayerNorm", hidden)
+	for i := 0; i < m.config.NumHiddenLayers; i++ {
+		prefix := "encoder.layer." + strconv.Itoa(i) + "."
+		m.layers = append(m.layers, layer{
+			query:           w.linear(prefix + "attention.self.query"),
+			key:             w.linear(prefix + "attention.self.key"),
+			value:           w.linear(prefix + "attention.self.value"),
+			attentionOutput: w.linear(prefix + "attention.output.dense"),
+			attentionNorm:   w.layerNorm(prefix+"attention.output.LayerNorm", hidden),
+			intermediate:    w.linear(prefix + "intermediate.dense"),
+			output:          w.linear(prefix + "output.dense"),
+			outputNorm:      w.layerNorm(prefix+"output.LayerNorm", hidden),
+		})
+	}
+	if w.err != nil {
+		return nil, errors.Wrapf(w.err, "%s", dir)
+	}
+	// Every token id indexes a row of the word embeddings.
+	if id := m.tokenizer.maxID(); id >= m.wordEmbeddings.shape[0] {
+		return nil, errors.Errorf("%s: vocabulary has token id %d, there are %d word embeddings", dir, id, m.wordEmbeddings.shape[0])
+	}
+	for i, l := range m.layers {
+		square := func(l linear) bool { return l.in == hidden && l.out == hidden }
+		if !square(l.query) || !square(l.key) || !square(l.value) || !square(l.attentionOutput) ||
+			l.intermediate.in != hidden || l.output.in != l.intermediate.out || l.output.out != hidden {
+			return nil, errors.Errorf("%s: layer %d doesn't match hidden size %d", dir, i, hidden)
+		}
+	}
+	if m.maxTokens <= 0 || m.positionEmbeddings.shape[0] < m.maxTokens {
+		m.maxTokens = m.positionEmbeddings.shape[0]
+	}
+	// Room for at least [CLS] and [SEP].
+	if m.maxTokens < 2 {
+		return nil, errors.Errorf("%s: %d position embeddings", dir, m.maxTokens)
+	}
+	return m, nil
+}
+
+// Embed returns the mean pooled, unit length embedding of text.
+func (m *model) Embed(text string) []float32 {
+	ids := m.tokenizer.Encode(text, m.maxTokens)
+	hidden := m.config.HiddenSize
+	n := len(ids)
+
+	x := make([]float32, n*hidden)
+	for i, id := range ids {
+		row := x[i*hidden : (i+1)*hidden]
+		word := m.wordEmbeddings.data[id*hidden : (id+1)*hidden]
+		position := m.positionEmbeddings.data[i*hidden : (i+1)*hidden]
+		tokenType := m.tokenTypeEmbeddings.data[:hidden]
+		for j := range row {
+			row[j] = word[j] + position[j] + tokenType[j]
+		}
+	}
+	m.norm(x, m.embeddingsNorm)
+
+	for _, l := range m.layers {
+		attention := m.attention(x, n, l)
+		add(attention, x)
+		m.norm(attention, l.attentionNorm)
+		x = attention
+
+		intermediate := l.intermediate.forward(x, n)
+		for i, v := range intermediate {
+			intermediate[i] = gelu(v)
+		}
+		output := l.output.forward(intermediate, n)
+		add(output, x)
+		m.norm(output, l.outputNorm)
+		x = output
+	}
+
+	// Mean pooling over all tokens, there's no padding within a single text.
+	pooled := make([]float32, hidden)
+	for i := 0; i < n; i++ {
+		add(pooled, x[i*hidden:(i+1)*hidden])
+	}
+	var norm float64
+	for j := range pooled {
+		pooled[j] /= float32(n)
+		norm += float64(pooled[j]) * float64(pooled[j])
+	}
+	norm = math.Sqrt(norm)
+	for j := range pooled {
+		pooled[j] = float32(float64(pooled[j]) / norm)
+	}
+	return pooled
+}
+
+func (m *model) attention(x []float32, n int, l layer) []float32 {
+	hidden := m.config.HiddenSize
+	heads := m.config.NumAttentionHeads
+	size := hidden / heads
+	scale := float32(1 / math.Sqrt(float64(size)))
+
+	q := l.query.forward(x, n)
+	k := l.key.forward(x, n)
+	v := l.value.forward(x, n)
+
+	context := make([]float32, n*hidden)
+	scores := make([]float32, n)
+	for h := 0; h < heads; h++ {
+		offset := h * size
+		for i := 0; i < n; i++ {
+			qi := q[i*hidden+offset : i*hidden+offset+size]
+			max := float32(math.Inf(-1))
+			for j := 0; j < n; j++ {
+				scores[j] = dot(qi, k[j*hidden+offset:j*hidden+offset+size]) * scale
+				if scores[j] > max {
+					max = scores[j]
+				}
+			}
+			var sum float32
+			for j := range scores {
+				scores[j] = float32(math.Exp(float64(scores[j] - max)))
+				sum += scores[j]
+			}
+			out := context[i*hidden+offset : i*hidden+offset+size]
+			for j := 0; j < n; j++ {
+				p := scores[j] / sum
+				vj := v[j*hidden+offset : j*hidden+offset+size]
+				for d := range out {
+					out[d] += p * vj[d]
+				}
+			}
+		}
+	}
+	return l.attentionOutput.forward(context, n)
+}
+
+// norm applies a layer norm to each row of x in place.
+func (m *model) norm(x []float32, ln layerNorm) {
+	hidden := m.config.HiddenSize
+	for i := 0; i < len(x); i += hidden {
+		row := x[i : i+hidden]
+		var mean float64
+		for _, v := range row {
+			mean += float64(v)
+		}
+		mean /= float64(hidden)
+		var variance float64
+		for _, v := range row {
+			d := float64(v) - mean
+			variance += d * d
+		}
+		variance /= float64(hidden)
+		inv := 1 / math.Sqrt(variance+m.config.LayerNormEps)
+		for j, v := range row {
+			row[j] = float32((float64(v)-mean)*inv)*ln.weight[j] + ln.bias[j]
+		}
+	}
+}
+
+// forward computes x·Wᵀ + b for n rows of x.
+func (l linear) forward(x []float32, n int) []float32 {
+	y := make([]float32, n*l.out)
+	for i := 0; i < n; i++ {
+		xi := x[i*l.in : (i+1)*l.in]
+		yi := y[i*l.out : (i+1)*l.out]
+		for o := range yi {
+			yi[o] = dot(xi, l.weight[o*l.in:(o+1)*l.in]) + l.bias[o]
+		}
+	}
+	return y
+}
+
+func dot(a, b []float32) float32 {
+	var sum float32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+func add(dst, src []float32) {
+	for i := range dst {
+		dst[i] += src[i]
+	}
+}
+
+func gelu(x float32) float32 {
+	return float32(0.5 * float64(x) * (1 + math.Erf(float64(x)/math.Sqrt2)))
+}
+
+// weights looks up tensors by name, remembering the first missing or
+// misshapen one so loading can be checked once at the end.
+type weights struct {
+	tensors map[string]tensor
+	err     error
+}
+
+func (w *weights) tensor(name string) tensor {
+	t, ok := w.tensors[name]
+	if !ok && w.err == nil {
+		w.err = errors.Errorf("missing tensor %s", name)
+	}
+	return t
+}
+
+func (w *weights) linear(name string) linear {
+	weight := w.tensor(name + ".weight")
+	bias := w.tensor(name + ".bias")
+	if w.err != nil {
+		return linear{}
+	}
+	if len(weight.shape) != 2 || len(bias.data) != weight.shape[0] {
+		w.err = errors.Errorf("tensor %s has an unexpected shape", name)
+		return linear{}
+	}
+	return linear{
+		out:    weight.shape[0],
+		in:     weight.shape[1],
+		weight: weight.data,
+		bias:   bias.data,
+	}
+}
+
+// embeddings looks up an embedding table of at least one row of size columns.
+func (w *weights) embeddings(name string, size int) tensor {
+	t := w.tensor(name)
+	if w.err != nil {
+		return tensor{}
+	}
+	if len(t.shape) != 2 || t.shape[0] == 0 || t.shape[1] != size {
+		w.err = errors.Errorf("tensor %s has an unexpected shape", name)
+		return tensor{}
+	}
+	return t
+}
+
+func (w *weights) layerNorm(name string, size int) layerNorm {
+	weight := w.tensor(name + ".weight")
+	bias := w.tensor(name + ".bias")
+	if w.err != nil {
+		return layerNorm{}
+	}
+	if len(weight.data) != size || len(bias.data) != size {
+		w.err = errors.Errorf("tensor %s doesn't match hidden size %d", name, size)
+		return layerNorm{}
+	}
+	return layerNorm{
+		weight: weight.data,
+		bias:   bias.data,
+	}
+}
+
+func readJSON(path string, v any) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.Wrapf(err, "%s", path)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package sbert
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// testdata/tiny is a BERT model with a hidden size of 4 and a single layer, generated along with
+// reference embeddings by testdata/tiny/generate.py.
+const tinyModel = "testdata/tiny"
+
+func TestEmbedMatchesReference(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join(tinyModel, "embeddings.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var references []struct {
+		Text      string    `json:"text"`
+		IDs       []int     `json:"ids"`
+		Embedding []float64 `json:"embedding"`
+	}
+	if err := json.Unmarshal(b, &references); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := load(tinyModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	embed := Embedding("tiny", tinyModel)
+	for _, r := range references {
+		if ids := m.tokenizer.Encode(r.Text, m.maxTokens); !slices.Equal(ids, r.IDs) {
+			t.Errorf("expected %v for %q, got %v", r.IDs, r.Text, ids)
+			continue
+		}
+		got, err := embed(context.Background(), r.Text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(r.Embedding) {
+			t.Fatalf("expected %d dimensions, got %d", len(r.Embedding), len(got))
+		}
+		for i := range got {
+			if math.Abs(float64(got[i])-r.Embedding[i]) > 1e-5 {
+				t.Errorf("expected %v for %q, got %v", r.Embedding, r.Text, got)
+				break
+			}
+		}
+	}
+}
+
+func TestEmbedTruncates(t *testing.T) {
+	m, err := load(tinyModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Longer than the 8 position embeddings.
+	v := m.Embed("hello world hello world hello world hello world hello world")
+	var norm float64
+	for _, f := range v {
+		norm += float64(f) * float64(f)
+	}
+	if math.Abs(norm-1) > 1e-5 {
+		t.Errorf("expected a unit length embedding, got %v", v)
+	}
+}
+
+// copyTinyModel copies the tiny model to a temporary directory, with its tensors changed by edit.
+func copyTinyModel(t *testing.T, edit func(tensors map[string]tensor)) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range []string{"config.json", "vocab.txt"} {
+		b, err := os.ReadFile(filepath.Join(tinyModel, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tensors, err := readSafetensors(filepath.Join(tinyModel, "model.safetensors"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit(tensors)
+	writeSafetensors(t, filepath.Join(dir, "model.safetensors"), tensors)
+	return dir
+}
+
+func TestLoadRejectsMalformed(t *testing.T) {
+	truncate := func(name string, n int) func(map[string]tensor) {
+		return func(tensors map[string]tensor) {
+			v := tensors[name]
+			tensors[name] = tensor{shape: []int{n}, data: v.data[:n]}
+		}
+	}
+	for name, edit := range map[string]func(map[string]tensor){
+		"missing tensor": func(tensors map[string]tensor) {
+			delete(tensors, "encoder.layer.0.attention.self.key.weight")
+		},
+		// Fewer word embeddings than tokens in the vocabulary.
+		"word embeddings": func(tensors map[string]tensor) {
+			v := tensors["embeddings.word_embeddings.weight"]
+			tensors["embeddings.word_embeddings.weight"] = tensor{shape: []int{10, 4}, data: v.data[:40]}
+		},
+		"position embeddings": func(tensors map[string]tensor) {
+			tensors["embeddings.position_embeddings.weight"] = tensor{shape: []int{0, 4}}
+		},
+		"token type embeddings": func(tensors map[string]tensor) {
+			v := tensors["embeddings.token_type_embeddings.weight"]
+			tensors["embeddings.token_type_embeddings.weight"] = tensor{shape: []int{8}, data: v.data}
+		},
+		"layer norm weight": truncate("embeddings.LayerNorm.weight", 3),
+		"layer norm bias":   truncate("encoder.layer.0.output.LayerNorm.bias", 2),
+		"value": func(tensors map[string]tensor) {
+			tensors["encoder.layer.0.attention.self.value.weight"] = tensor{shape: []int{2, 4}, data: make([]float32, 8)}
+			tensors["encoder.layer.0.attention.self.value.bias"] = tensor{shape: []int{2}, data: make([]float32, 2)}
+		},
+		"output": func(tensors map[string]tensor) {
+			tensors["encoder.layer.0.output.dense.weight"] = tensor{shape: []int{4, 4}, data: make([]float32, 16)}
+		},
+	} {
+		dir := copyTinyModel(t, edit)
+		if _, err := load(dir); err == nil {
+			t.Errorf("expected an error for the %s", name)
+		}
+	}
+
+	if _, err := load(copyTinyModel(t, func(map[string]tensor) {})); err != nil {
+		t.Errorf("expected the copy to load, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package sbert
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"math"
+	"os"
+	"strings"
+)
+
+type tensorInfo struct {
+	DType       string `json:"dtype"`
+	Shape       []int  `json:"shape"`
+	DataOffsets [2]int `json:"data_offsets"`
+}
+
+// tensor is a row-major float32 tensor loaded from a safetensors file.
+type tensor struct {
+	shape []int
+	data  []float32
+}
+
+// readSafetensors loads every tensor in a safetensors file, see
+// https://huggingface.co/docs/safetensors. Some checkpoints prefix the names
+// with the architecture ("bert."), that prefix is stripped.
+func readSafetensors(path string) (map[string]tensor, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(b) < 8 {
+		return nil, errors.Errorf("%s: file too short", path)
+	}
+	n := binary.LittleEndian.Uint64(b[:8])
+	if n > uint64(len(b)-8) {
+		return nil, errors.Errorf("%s: invalid header length %d", path, n)
+	}
+	var header map[string]json.RawMessage
+	if err := json.Unmarshal(b[8:8+n], &header); err != nil {
+		return nil, errors.Wrapf(err, "%s: invalid header", path)
+	}
+	data := b[8+n:]
+
+	tensors := map[string]tensor{}
+	for name, raw := range header {
+		if name == "__metadata__" {
+			continue
+		}
+		var info tensorInfo
+		if err := json.Unmarshal(raw, &info); err != nil {
+			return nil, errors.Wrapf(err, "%s: tensor %s", path, name)
+		}
+		begin, end := info.DataOffsets[0], info.DataOffsets[1]
+		if begin < 0 || end > len(data) || begin > end {
+			return nil, errors.Errorf("%s: tensor %s out of bounds", path, name)
+		}
+		values, err := decodeTensor(info.DType, data[begin:end])
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: tensor %s", path, name)
+		}
+		size := 1
+		for _, d := range info.Shape {
+			size *= d
+		}
+		if size != len(values) {
+			return nil, errors.Errorf("%s: tensor %s has %d values for shape %v", path, name, len(values), info.Shape)
+		}
+		tensors[strings.TrimPrefix(name, "bert.")] = tensor{shape: info.Shape, data: values}
+	}
+	return tensors, nil
+}
+
+func decodeTensor(dtype string, b []byte) ([]float32, error) {
+	switch dtype {
+	case "F32":
+		values := make([]float32, len(b)/4)
+		for i := range values {
+			values[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[i*4:]))
+		}
+		return values, nil
+	case "F16":
+		values := make([]float32, len(b)/2)
+		for i := range values {
+			values[i] = float16(binary.LittleEndian.Uint16(b[i*2:]))
+		}
+		return values, nil
+	case "BF16":
+		values := make([]float32, len(b)/2)
+		for i := range values {
+			values[i] = math.Float32frombits(uint32(binary.LittleEndian.Uint16(b[i*2:])) << 16)
+		}
+		return values, nil
+	}
+	return nil, errors.Errorf("unsupported dtype %s", dtype)
+}
+
+// float16 converts an IEEE 754 half precision value to float32.
+func float16(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	frac := uint32(h) & 0x3ff
+	switch {
+	case exp == 0 && frac == 0:
+		return math.Float32frombits(sign)
+	case exp == 0:
+		// Subnormal, renormalize.
+		for frac&0x400 == 0 {
+			frac <<= 1
+			exp--
+		}
+		exp++
+		frac &= 0x3ff
+	case exp == 0x1f:
+		return math.Float32frombits(sign | 0xff<<23 | frac<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | frac<<13)
+}
@@ -0,0 +1,130 @@
+package sbert
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// writeSafetensors writes tensors as F32 to path.
+func writeSafetensors(t *testing.T, path string, tensors map[string]tensor) {
+	t.Helper()
+	header := map[string]tensorInfo{}
+	var data []byte
+	for name, v := range tensors {
+		begin := len(data)
+		for _, f := range v.data {
+			data = binary.LittleEndian.AppendUint32(data, math.Float32bits(f))
+		}
+		header[name] = tensorInfo{DType: "F32", Shape: v.shape, DataOffsets: [2]int{begin, len(data)}}
+	}
+	writeRawSafetensors(t, path, header, data)
+}
+
+func writeRawSafetensors(t *testing.T, path string, header any, data []byte) {
+	t.Helper()
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := binary.LittleEndian.AppendUint64(nil, uint64(len(h)))
+	b = append(append(b, h...), data...)
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadSafetensors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "model.safetensors")
+	var data []byte
+	for _, f := range []float32{1, -2.5, 0.25, 3} {
+		data = binary.LittleEndian.AppendUint32(data, math.Float32bits(f))
+	}
+	// 1, -2 and 0.5 as half precision, then as bfloat16.
+	for _, h := range []uint16{0x3c00, 0xc000, 0x3800, 0x3f80, 0xc000, 0x3f00} {
+		data = binary.LittleEndian.AppendUint16(data, h)
+	}
+	writeRawSafetensors(t, path, map[string]any{
+		"__metadata__":    map[string]string{"format": "pt"},
+		"bert.pooler.w":   tensorInfo{DType: "F32", Shape: []int{2, 2}, DataOffsets: [2]int{0, 16}},
+		"embeddings.half": tensorInfo{DType: "F16", Shape: []int{3}, DataOffsets: [2]int{16, 22}},
+		"embeddings.bf16": tensorInfo{DType: "BF16", Shape: []int{3}, DataOffsets: [2]int{22, 28}},
+	}, data)
+
+	tensors, err := readSafetensors(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]tensor{
+		"pooler.w":        {shape: []int{2, 2}, data: []float32{1, -2.5, 0.25, 3}},
+		"embeddings.half": {shape: []int{3}, data: []float32{1, -2, 0.5}},
+		"embeddings.bf16": {shape: []int{3}, data: []float32{1, -2, 0.5}},
+	} {
+		got, ok := tensors[name]
+		if !ok {
+			t.Errorf("missing tensor %s in %v", name, tensors)
+			continue
+		}
+		if !slices.Equal(got.shape, want.shape) || !slices.Equal(got.data, want.data) {
+			t.Errorf("expected %s to be %v, got %v", name, want, got)
+		}
+	}
+	if len(tensors) != 3 {
+		t.Errorf("expected 3 tensors without the metadata, got %d", len(tensors))
+	}
+}
+
+func TestReadSafetensorsRejectsMalformed(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 16)
+	for name, header := range map[string]any{
+		"out of bounds":   map[string]tensorInfo{"w": {DType: "F32", Shape: []int{8}, DataOffsets: [2]int{0, 32}}},
+		"reversed":        map[string]tensorInfo{"w": {DType: "F32", Shape: []int{0}, DataOffsets: [2]int{8, 4}}},
+		"shape mismatch":  map[string]tensorInfo{"w": {DType: "F32", Shape: []int{3, 2}, DataOffsets: [2]int{0, 16}}},
+		"unsupported":     map[string]tensorInfo{"w": {DType: "I64", Shape: []int{2}, DataOffsets: [2]int{0, 16}}},
+		"invalid tensors": map[string]string{"w": "F32"},
+	} {
+		path := filepath.Join(dir, name)
+		writeRawSafetensors(t, path, header, data)
+		if _, err := readSafetensors(path); err == nil {
+			t.Errorf("expected an error for %s", name)
+		}
+	}
+
+	for name, b := range map[string][]byte{
+		"too short":      {1, 2, 3},
+		"header length":  binary.LittleEndian.AppendUint64(nil, 1<<40),
+		"invalid header": append(binary.LittleEndian.AppendUint64(nil, 2), "{x"...),
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readSafetensors(path); err == nil {
+			t.Errorf("expected an error for %s", name)
+		}
+	}
+}
+
+func TestFloat16(t *testing.T) {
+	for h, want := range map[uint16]float32{
+		0x0000: 0,
+		0x3c00: 1,
+		0xbc00: -1,
+		0x7bff: 65504,
+		0x0001: 5.9604645e-08,
+		0x0400: 6.1035156e-05,
+		0x7c00: float32(math.Inf(1)),
+	} {
+		if got := float16(h); got != want {
+			t.Errorf("expected %#04x to be %g, got %g", h, want, got)
+		}
+	}
+	if !math.IsNaN(float64(float16(0x7e00))) {
+		t.Error("expected NaN")
+	}
+}
@@ -0,0 +1,153 @@
+#!/usr/bin/env python3
+"""Generates the tiny BERT model in this directory and the reference embeddings of embeddings.json.
+
+The forward pass is a plain Python transcription of Hugging Face's BertModel followed by
+sentence-transformers' mean pooling and normalization, so it doesn't share any code with the Go
+implementation it checks. Run it from this directory: python3 generate.py
+"""
+
+import json
+import math
+import random
+import struct
+
+HIDDEN = 4
+HEADS = 2
+INTERMEDIATE = 8
+POSITIONS = 8
+EPS = 1e-12
+
+VOCAB = ["[PAD]", "[UNK]", "[CLS]", "[SEP]", "[MASK]", "hello", "world", "go", "##pher", "engineer",
+         "remote", ",", ".", "!", "un", "##aff", "##able", "cafe"]
+
+# The texts embedded, with the token ids the tokenizer must produce for them.
+TEXTS = [
+    ("Hello, world!", [2, 5, 11, 6, 13, 3]),
+    ("Remote Gopher engineer.", [2, 10, 7, 8, 9, 12, 3]),
+    ("unaffable CAFÉ", [2, 14, 15, 16, 17, 3]),
+    ("xyz hello", [2, 1, 5, 3]),
+]
+
+rng = random.Random(27)
+
+
+def f32(x):
+    return struct.unpack("<f", struct.pack("<f", x))[0]
+
+
+def matrix(rows, cols, scale=0.5):
+    return [[f32(rng.uniform(-scale, scale)) for _ in range(cols)] for _ in range(rows)]
+
+
+def vector(n, center=0.0, scale=0.1):
+    return [f32(center + rng.uniform(-scale, scale)) for _ in range(n)]
+
+
+tensors = {}
+
+
+def linear(name, out, inp):
+    tensors[name + ".weight"] = matrix(out, inp)
+    tensors[name + ".bias"] = [vector(out)]
+
+
+def layer_norm(name):
+    tensors[name + ".weight"] = [vector(HIDDEN, 1.0)]
+    tensors[name + ".bias"] = [vector(HIDDEN)]
+
+
+tensors["embeddings.word_embeddings.weight"] = matrix(len(VOCAB), HIDDEN, 1.0)
+tensors["embeddings.position_embeddings.weight"] = matrix(POSITIONS, HIDDEN, 0.2)
+tensors["embeddings.token_type_embeddings.weight"] = matrix(2, HIDDEN, 0.2)
+layer_norm("embeddings.LayerNorm")
+prefix = "encoder.layer.0."
+linear(prefix + "attention.self.query", HIDDEN, HIDDEN)
+linear(prefix + "attention.self.key", HIDDEN, HIDDEN)
+linear(prefix + "attention.self.value", HIDDEN, HIDDEN)
+linear(prefix + "attention.output.dense", HIDDEN, HIDDEN)
+layer_norm(prefix + "attention.output.LayerNorm")
+linear(prefix + "intermediate.dense", INTERMEDIATE, HIDDEN)
+linear(prefix + "output.dense", HIDDEN, INTERMEDIATE)
+layer_norm(prefix + "output.LayerNorm")
+
+
+def t(name):
+    return tensors[name]
+
+
+def apply_linear(name, x):
+    w, b = t(name + ".weight"), t(name + ".bias")[0]
+    return [[sum(row[i] * wo[i] for i in range(len(row))) + b[o] for o, wo in enumerate(w)] for row in x]
+
+
+def apply_layer_norm(name, x):
+    w, b = t(name + ".weight")[0], t(name + ".bias")[0]
+    out = []
+    for row in x:
+        mean = sum(row) / len(row)
+        var = sum((v - mean) ** 2 for v in row) / len(row)
+        out.append([(v - mean) / math.sqrt(var + EPS) * w[j] + b[j] for j, v in enumerate(row)])
+    return out
+
+
+def embed(ids):
+    words, positions, types = (t("embeddings.word_embeddings.weight"), t("embeddings.position_embeddings.weight"),
+                               t("embeddings.token_type_embeddings.weight"))
+    x = [[words[id][j] + positions[i][j] + types[0][j] for j in range(HIDDEN)] for i, id in enumerate(ids)]
+    x = apply_layer_norm("embeddings.LayerNorm", x)
+
+    q = apply_linear(prefix + "attention.self.query", x)
+    k = apply_linear(prefix + "attention.self.key", x)
+    v = apply_linear(prefix + "attention.self.value", x)
+    size = HIDDEN // HEADS
+    context = [[0.0] * HIDDEN for _ in ids]
+    for h in range(HEADS):
+        s = slice(h * size, (h + 1) * size)
+        for i in range(len(ids)):
+            scores = [sum(a * b for a, b in zip(q[i][s], k[j][s])) / math.sqrt(size) for j in range(len(ids))]
+            top = max(scores)
+            exps = [math.exp(score - top) for score in scores]
+            probs = [e / sum(exps) for e in exps]
+            for d in range(size):
+                context[i][h * size + d] = sum(probs[j] * v[j][h * size + d] for j in range(len(ids)))
+    attention = apply_linear(prefix + "attention.output.dense", context)
+    x = apply_layer_norm(prefix + "attention.output.LayerNorm",
+                         [[a + b for a, b in zip(ra, rx)] for ra, rx in zip(attention, x)])
+
+    intermediate = apply_linear(prefix + "intermediate.dense", x)
+    intermediate = [[0.5 * v * (1 + math.erf(v / math.sqrt(2))) for v in row] for row in intermediate]
+    output = apply_linear(prefix + "output.dense", intermediate)
+    x = apply_layer_norm(prefix + "output.LayerNorm", [[a + b for a, b in zip(ro, rx)] for ro, rx in zip(output, x)])
+
+    pooled = [sum(row[j] for row in x) / len(x) for j in range(HIDDEN)]
+    norm = math.sqrt(sum(v * v for v in pooled))
+    return [v / norm for v in pooled]
+
+
+def write_safetensors(path):
+    header, data = {}, b""
+    for name in sorted(tensors):
+        rows = tensors[name]
+        values = [v for row in rows for v in row]
+        shape = [len(values)] if name.endswith(("LayerNorm.weight", "LayerNorm.bias", ".bias")) else [len(rows), len(rows[0])]
+        # Checkpoints converted from BertModel prefix the names with the architecture.
+        header["bert." + name] = {"dtype": "F32", "shape": shape, "data_offsets": [len(data), len(data) + 4 * len(values)]}
+        data += struct.pack("<%df" % len(values), *values)
+    header["__metadata__"] = {"format": "pt"}
+    encoded = json.dumps(header, separators=(",", ":")).encode()
+    encoded += b" " * (-len(encoded) % 8)
+    with open(path, "wb") as f:
+        f.write(struct.pack("<Q", len(encoded)) + encoded + data)
+
+
+write_safetensors("model.safetensors")
+with open("vocab.txt", "w") as f:
+    f.write("\n".join(VOCAB) + "\n")
+with open("config.json", "w") as f:
+    json.dump({"hidden_size": HIDDEN, "num_attention_heads": HEADS, "num_hidden_layers": 1,
+               "intermediate_size": INTERMEDIATE, "layer_norm_eps": EPS, "max_position_embeddings": POSITIONS,
+               "vocab_size": len(VOCAB), "type_vocab_size": 2}, f, indent=2)
+    f.write("\n")
+with open("embeddings.json", "w") as f:
+    json.dump([{"text": text, "ids": ids, "embedding": embed(ids)} for text, ids in TEXTS], f, indent=2)
+    f.write("\n")
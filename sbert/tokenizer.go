@@ -0,0 +1,159 @@
+package sbert
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"golang.org/x/text/unicode/norm"
+	"os"
+	"strings"
+	"unicode"
+)
+
+const maxWordChars = 100
+
+// tokenizer is the BERT WordPiece tokenizer: basic whitespace and punctuation
+// splitting followed by greedy longest-match-first sub-word lookup.
+type tokenizer struct {
+	vocab     map[string]int
+	lowercase bool
+	unk       int
+	cls       int
+	sep       int
+}
+
+func loadTokenizer(path string, lowercase bool) (*tokenizer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	t := &tokenizer{
+		vocab:     map[string]int{},
+		lowercase: lowercase,
+	}
+	scanner := bufio.NewScanner(f)
+	for i := 0; scanner.Scan(); i++ {
+		t.vocab[strings.TrimRight(scanner.Text(), "\r")] = i
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for token, id := range map[string]*int{"[UNK]": &t.unk, "[CLS]": &t.cls, "[SEP]": &t.sep} {
+		v, ok := t.vocab[token]
+		if !ok {
+			return nil, errors.Errorf("%s: missing %s token", path, token)
+		}
+		*id = v
+	}
+	return t, nil
+}
+
+// maxID returns the largest token id in the vocabulary.
+func (t *tokenizer) maxID() int {
+	max := 0
+	for _, id := range t.vocab {
+		if id > max {
+			max = id
+		}
+	}
+	return max
+}
+
+// Encode returns the token ids for text wrapped in [CLS] and [SEP], truncated
+// to at most max tokens.
+func (t *tokenizer) Encode(text string, max int) []int {
+	ids := []int{t.cls}
+	for _, word := range t.basic(text) {
+		ids = append(ids, t.wordPiece(word)...)
+		if len(ids) >= max-1 {
+			ids = ids[:max-1]
+			break
+		}
+	}
+	return append(ids, t.sep)
+}
+
+func (t *tokenizer) basic(text string) []string {
+	if t.lowercase {
+		text = strings.ToLower(text)
+		// Strip accents.
+		var sb strings.Builder
+		for _, r := range norm.NFD.String(text) {
+			if !unicode.Is(unicode.Mn, r) {
+				sb.WriteRune(r)
+			}
+		}
+		text = sb.String()
+	}
+
+	var words []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			words = append(words, word.String())
+			word.Reset()
+		}
+	}
+	for _, r := range text {
+		switch {
+		case r == 0 || r == unicode.ReplacementChar || (unicode.IsControl(r) && !unicode.IsSpace(r)):
+		case unicode.IsSpace(r):
+			flush()
+		case isPunctuation(r) || isCJK(r):
+			flush()
+			words = append(words, string(r))
+		default:
+			word.WriteRune(r)
+		}
+	}
+	flush()
+	return words
+}
+
+func (t *tokenizer) wordPiece(word string) []int {
+	runes := []rune(word)
+	if len(runes) > maxWordChars {
+		return []int{t.unk}
+	}
+	var ids []int
+	for start := 0; start < len(runes); {
+		end := len(runes)
+		id := -1
+		for ; end > start; end-- {
+			piece := string(runes[start:end])
+			if start > 0 {
+				piece = "##" + piece
+			}
+			if v, ok := t.vocab[piece]; ok {
+				id = v
+				break
+			}
+		}
+		if id == -1 {
+			return []int{t.unk}
+		}
+		ids = append(ids, id)
+		start = end
+	}
+	return ids
+}
+
+func isPunctuation(r rune) bool {
+	// BERT treats all non-alphanumeric ASCII as punctuation, e.g. "$" and "^".
+	if (r >= 33 && r <= 47) || (r >= 58 && r <= 64) || (r >= 91 && r <= 96) || (r >= 123 && r <= 126) {
+		return true
+	}
+	return unicode.IsPunct(r)
+}
+
+func isCJK(r rune) bool {
+	return (r >= 0x4E00 && r <= 0x9FFF) ||
+		(r >= 0x3400 && r <= 0x4DBF) ||
+		(r >= 0x20000 && r <= 0x2A6DF) ||
+		(r >= 0x2A700 && r <= 0x2B73F) ||
+		(r >= 0x2B740 && r <= 0x2B81F) ||
+		(r >= 0x2B820 && r <= 0x2CEAF) ||
+		(r >= 0xF900 && r <= 0xFAFF) ||
+		(r >= 0x2F800 && r <= 0x2FA1F)
+}
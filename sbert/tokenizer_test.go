@@ -0,0 +1,78 @@
+package sbert
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testTokenizer(t *testing.T, lowercase bool, vocab ...string) *tokenizer {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "vocab.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(vocab, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := loadTokenizer(path, lowercase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+func TestTokenizer(t *testing.T) {
+	tok := testTokenizer(t, true,
+		"[PAD]", "[UNK]", "[CLS]", "[SEP]", "go", "##pher", "##s", "engineer", "$", "100", "k", ",", "cafe", "日", "本", "un", "##aff", "##able")
+	for _, c := range []struct {
+		text string
+		want []int
+	}{
+		{"", []int{2, 3}},
+		{"Go", []int{2, 4, 3}},
+		// Greedy longest match first.
+		{"Gophers", []int{2, 4, 5, 6, 3}},
+		{"unaffable", []int{2, 15, 16, 17, 3}},
+		// Punctuation is split into its own tokens, and whitespace collapsed.
+		{"  Go,engineer\t$100 k ", []int{2, 4, 11, 7, 8, 9, 10, 3}},
+		// There's no "##k".
+		{"100k", []int{2, 1, 3}},
+		// Accents are stripped when lowercasing.
+		{"CAFÉ", []int{2, 12, 3}},
+		// CJK characters are words of their own.
+		{"日本", []int{2, 13, 14, 3}},
+		// A word with any piece missing from the vocabulary is unknown as a whole.
+		{"gopherz", []int{2, 1, 3}},
+		{strings.Repeat("go", maxWordChars), []int{2, 1, 3}},
+		// Control characters are dropped.
+		{"go\x00pher�", []int{2, 4, 5, 3}},
+	} {
+		if got := tok.Encode(c.text, 16); !slices.Equal(got, c.want) {
+			t.Errorf("expected %v for %q, got %v", c.want, c.text, got)
+		}
+	}
+
+	if got := tok.Encode("go go go go", 4); !slices.Equal(got, []int{2, 4, 4, 3}) {
+		t.Errorf("expected truncation to 4 tokens, got %v", got)
+	}
+	if got := tok.Encode("Gophers", 4); !slices.Equal(got, []int{2, 4, 5, 3}) {
+		t.Errorf("expected truncation within a word, got %v", got)
+	}
+}
+
+func TestTokenizerCased(t *testing.T) {
+	tok := testTokenizer(t, false, "[UNK]", "[CLS]", "[SEP]", "Go", "go", "café")
+	if got := tok.Encode("Go go café", 16); !slices.Equal(got, []int{1, 3, 4, 5, 2}) {
+		t.Errorf("expected case and accents to be kept, got %v", got)
+	}
+}
+
+func TestTokenizerRequiresSpecialTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vocab.txt")
+	if err := os.WriteFile(path, []byte("[UNK]\n[CLS]\nhello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTokenizer(path, true); err == nil {
+		t.Error("expected an error without [SEP]")
+	}
+}
@@ -22,10 +22,12 @@ CREATE TABLE IF NOT EXISTS embeddings (
     item_id INTEGER NOT NULL,
     embedding BLOB NOT NULL,
     created_at INTEGER NOT NULL,
-    updated_at INTEGER NOT NULL
+    updated_at INTEGER NOT NULL,
+    content_hash TEXT NOT NULL DEFAULT ''
 );
 
 CREATE INDEX IF NOT EXISTS idx_embeddings_model_item_id ON embeddings(model, item_id);
+CREATE INDEX IF NOT EXISTS idx_embeddings_model_content_hash ON embeddings(model, content_hash);
 
 CREATE TABLE IF NOT EXISTS item_kids (
     item_id INT NOT NULL,
@@ -46,4 +48,55 @@ CREATE TABLE IF NOT EXISTS linkedin_scrapes (
     json text NOT NULL,
     created_at INTEGER NOT NULL,
     updated_at INTEGER NOT NULL
-);
\ No newline at end of file
+);
+CREATE TABLE IF NOT EXISTS completion_cache (
+    key TEXT PRIMARY KEY NOT NULL,
+    provider TEXT NOT NULL,
+    model TEXT NOT NULL,
+    prompt_version TEXT NOT NULL,
+    response TEXT NOT NULL,
+    created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS usage (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    endpoint TEXT NOT NULL,
+    provider TEXT NOT NULL,
+    model TEXT NOT NULL,
+    task TEXT NOT NULL,
+    input_tokens INTEGER NOT NULL,
+    output_tokens INTEGER NOT NULL,
+    cost REAL NOT NULL,
+    created_at INTEGER NOT NULL,
+    principal TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_usage_created_at ON usage(created_at);
+CREATE INDEX IF NOT EXISTS idx_usage_principal_created_at ON usage(principal, created_at);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id TEXT PRIMARY KEY NOT NULL,
+    principal TEXT NOT NULL,
+    state TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    updated_at INTEGER NOT NULL,
+    version INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_updated_at ON sessions(updated_at);
+
+CREATE TABLE IF NOT EXISTS saved_searches (
+    id TEXT PRIMARY KEY NOT NULL,
+    principal TEXT NOT NULL,
+    state TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    updated_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_saved_searches_principal ON saved_searches(principal);
+
+CREATE TABLE IF NOT EXISTS notified_items (
+    saved_search_id TEXT NOT NULL,
+    item_id INTEGER NOT NULL,
+    created_at INTEGER NOT NULL,
+    PRIMARY KEY (saved_search_id, item_id)
+);
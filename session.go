@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/newhook/whoishiring/queries"
+	"github.com/pkg/errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Session is the state of a job search, persisted so that it can be refined by follow-up instructions
+// without starting over.
+type Session struct {
+	ID string `json:"id"`
+	// Principal owns the session, see principal. Nobody else can see or refine it.
+	Principal string `json:"-"`
+
+	SearchType    SearchType `json:"search_type"`
+	Months        int        `json:"months"`
+	Candidates    int        `json:"candidates"`
+	TokenBudget   int        `json:"token_budget"`
+	PromptVariant string     `json:"prompt_variant"`
+
+	ResumeSummary string   `json:"resume_summary"`
+	JobPrompt     string   `json:"job_prompt"`
+	SearchTerms   []string `json:"search_terms"`
+	// EmbeddingModel created Vectors, which are only reused with the same model.
+	EmbeddingModel string `json:"embedding_model"`
+	// Vectors are the query embeddings of SearchTerms and Exclusions, reused by refinements that keep
+	// a term.
+	Vectors map[string][]float32 `json:"vectors,omitempty"`
+	// Results are the vector search results, best first, and Comments the picks among them.
+	Results  []int  `json:"results"`
+	Comments []int  `json:"comments"`
+	Picks    []Pick `json:"picks"`
+	// Exclude are the comments the user doesn't want to see again.
+	Exclude []int `json:"exclude"`
+	// Exclusions and Dislikes are the negative preferences of the search, see SearchTerms.
+	Exclusions []string `json:"exclusions"`
+	Dislikes   []int    `json:"dislikes"`
+
+	Turns     []Turn `json:"turns"`
+	CreatedAt int64  `json:"created_at"`
+	UpdatedAt int64  `json:"updated_at"`
+	// Version counts the saves of the session, so that concurrent refinements don't overwrite each other.
+	Version int `json:"version"`
+}
+
+// Turn is a search of a session, the first one or a refinement.
+type Turn struct {
+	Instruction string   `json:"instruction,omitempty"`
+	JobPrompt   string   `json:"job_prompt"`
+	SearchTerms []string `json:"search_terms"`
+	Like        []int    `json:"like,omitempty"`
+	Comments    []int    `json:"comments"`
+	CreatedAt   int64    `json:"created_at"`
+}
+
+// ErrSessionNotFound is returned for unknown and expired sessions, and for those of another principal.
+var ErrSessionNotFound = errors.New("session not found")
+
+// ErrSessionConflict is returned when saving a session that was saved by another request since it was read.
+var ErrSessionConflict = errors.New("session was changed by another request")
+
+func newSession(search SearchTerms) (*Session, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Session{
+		ID:             hex.EncodeToString(b),
+		Principal:      search.Principal,
+		SearchType:     search.SearchType,
+		Candidates:     search.Candidates,
+		TokenBudget:    search.TokenBudget,
+		PromptVariant:  search.PromptVariant,
+		Exclusions:     search.Exclusions,
+		Dislikes:       search.Dislikes,
+		EmbeddingModel: *embeddingModel,
+		Exclude:        []int{},
+		CreatedAt:      time.Now().Unix(),
+	}, nil
+}
+
+func GetSession(ctx context.Context, q *queries.Queries, id string, principal string) (*Session, error) {
+	row, err := q.GetSession(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if row.Principal != principal {
+		return nil, ErrSessionNotFound
+	}
+	// Not deleted yet.
+	if *sessionTTL > 0 && time.Since(time.Unix(int64(row.UpdatedAt), 0)) > *sessionTTL {
+		return nil, ErrSessionNotFound
+	}
+	s := &Session{}
+	if err := json.Unmarshal([]byte(row.State), s); err != nil {
+		return nil, errors.Wrapf(err, "session %s", id)
+	}
+	s.Principal = row.Principal
+	s.Version = row.Version
+	return s, nil
+}
+
+// SaveSession inserts a new session, or updates the session if nobody saved it since it was read,
+// returning ErrSessionConflict otherwise.
+func SaveSession(ctx context.Context, q *queries.Queries, s *Session) error {
+	s.UpdatedAt = time.Now().Unix()
+	// The state has the version it's saved as.
+	s.Version++
+	state, err := json.Marshal(s)
+	s.Version--
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if s.Version == 0 {
+		err = q.InsertSession(ctx, queries.InsertSessionParams{
+			ID:        s.ID,
+			Principal: s.Principal,
+			State:     string(state),
+			CreatedAt: int(s.CreatedAt),
+			UpdatedAt: int(s.UpdatedAt),
+			Version:   1,
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	} else {
+		n, err := q.UpdateSession(ctx, queries.UpdateSessionParams{
+			State:     string(state),
+			UpdatedAt: int(s.UpdatedAt),
+			ID:        s.ID,
+			Version:   s.Version,
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if n == 0 {
+			return ErrSessionConflict
+		}
+	}
+	s.Version++
+	return nil
+}
+
+// DeleteExpiredSessions deletes the sessions that weren't searched for longer than ttl, returning how
+// many were deleted.
+func DeleteExpiredSessions(ctx context.Context, q *queries.Queries, ttl time.Duration) (int64, error) {
+	n, err := q.DeleteExpiredSessions(ctx, int(time.Now().Add(-ttl).Unix()))
+	return n, errors.WithStack(err)
+}
+
+// Refinement returns the search refining the session with instruction, e.g. "more like #2 but remote".
+func (s *Session) Refinement(instruction string) SearchTerms {
+	return SearchTerms{
+		Months:        s.Months,
+		SearchType:    s.SearchType,
+		JobPrompt:     s.JobPrompt,
+		Candidates:    s.Candidates,
+		TokenBudget:   s.TokenBudget,
+		PromptVariant: s.PromptVariant,
+		Exclusions:    s.Exclusions,
+		Dislikes:      s.Dislikes,
+		Principal:     s.Principal,
+		Session:       s,
+		Instruction:   instruction,
+	}
+}
+
+// vectors returns the query embeddings that can be reused with the current embedding model.
+func (s *Session) vectors() map[string][]float32 {
+	if s.EmbeddingModel != *embeddingModel {
+		return nil
+	}
+	return s.Vectors
+}
+
+// addTurn records a search of the session.
+func (s *Session) addTurn(search SearchTerms, like []int, vectors map[string][]float32, results []Result, resp JobSearchResponse) {
+	if len(s.Turns) == 0 {
+		s.ResumeSummary = resp.ResumeSummary
+	}
+	s.Months = search.Months
+	s.JobPrompt = search.JobPrompt
+	s.SearchTerms = resp.SearchTerms
+	s.EmbeddingModel = *embeddingModel
+	s.Vectors = map[string][]float32{}
+	for term, v := range vectors {
+		// The embeddings of comments are stored anyway.
+		if !strings.HasPrefix(term, itemTermPrefix) {
+			s.Vectors[term] = v
+		}
+	}
+	s.Results = nil
+	for _, result := range results {
+		s.Results = append(s.Results, result.ID)
+	}
+	s.Comments = resp.Comments
+	s.Picks = resp.Picks
+	s.Turns = append(s.Turns, Turn{
+		Instruction: search.Instruction,
+		JobPrompt:   search.JobPrompt,
+		SearchTerms: resp.SearchTerms,
+		Like:        like,
+		Comments:    resp.Comments,
+		CreatedAt:   time.Now().Unix(),
+	})
+}
+
+// refinement is the completion model's revision of a session's search.
+type refinement struct {
+	// Prompt is the revised job search prompt.
+	Prompt string   `json:"prompt"`
+	Terms  []string `json:"terms"`
+	// Like are the previous picks to find more like, their embeddings are searched for as well.
+	Like []int `json:"like"`
+	// Exclude are the previous picks not to show again.
+	Exclude []int `json:"exclude"`
+	// Months is the number of months to search, 0 keeps the session's.
+	Months int `json:"months"`
+}
+
+// maxRefinePickChars is how much of each previous pick the refinement prompt shows.
+const maxRefinePickChars = 600
+
+// refine has the completion model revise the session's prompt, search terms and filters for
+// instruction. The previous picks are shown numbered, so the instruction can refer to them as "#2".
+func refine(ctx context.Context, q *queries.Queries, cr *completer, s *Session, instruction string) (refinement, error) {
+	items, err := q.GetItems(ctx, s.Comments)
+	if err != nil {
+		return refinement{}, errors.WithStack(err)
+	}
+	text := map[int]string{}
+	for _, item := range items {
+		text[item.ID] = item.Text
+	}
+	var picks []map[string]any
+	for i, id := range s.Comments {
+		content := []rune(untrustedText(text[id]))
+		if len(content) > maxRefinePickChars {
+			content = append(content[:maxRefinePickChars], []rune("...")...)
+		}
+		picks = append(picks, map[string]any{"Rank": i + 1, "ID": id, "Content": string(content)})
+	}
+
+	r, err := cr.Refine(ctx, refineTaskFor(s.SearchType), map[string]any{
+		"Prompt":      searchPrompt(s.SearchType, s.JobPrompt),
+		"Terms":       s.SearchTerms,
+		"Picks":       picks,
+		"Months":      s.Months,
+		"Instruction": instruction,
+	})
+	if err != nil {
+		return r, err
+	}
+	// Only the previous picks can be referred to.
+	r.Like = slices.DeleteFunc(r.Like, func(id int) bool { return !slices.Contains(s.Comments, id) })
+	r.Exclude = slices.DeleteFunc(r.Exclude, func(id int) bool { return !slices.Contains(s.Comments, id) })
+	if r.Months < 0 || r.Months > MaxWindow {
+		r.Months = 0
+	}
+	return r, nil
+}
+
+// Diff compares the picks of a refinement with the previous ones.
+type Diff struct {
+	Added   []int `json:"added"`
+	Removed []int `json:"removed"`
+	// Kept are the picks in both, with their previous and new ranks.
+	Kept []RankChange `json:"kept"`
+}
+
+// RankChange is a pick's rank, from 1, before and after a refinement.
+type RankChange struct {
+	ID     int `json:"id"`
+	Before int `json:"before"`
+	After  int `json:"after"`
+}
+
+func diffPicks(before, after []int) *Diff {
+	d := &Diff{Added: []int{}, Removed: []int{}, Kept: []RankChange{}}
+	for i, id := range after {
+		if j := slices.Index(before, id); j >= 0 {
+			d.Kept = append(d.Kept, RankChange{ID: id, Before: j + 1, After: i + 1})
+		} else {
+			d.Added = append(d.Added, id)
+		}
+	}
+	for _, id := range before {
+		if !slices.Contains(after, id) {
+			d.Removed = append(d.Removed, id)
+		}
+	}
+	return d
+}
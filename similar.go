@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/newhook/whoishiring/queries"
+	"github.com/pkg/errors"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// ErrItemNotFound is returned for items that aren't comments of a whoishiring post, or that have no
+// embedding yet.
+var ErrItemNotFound = errors.New("item not found")
+
+// SimilarItems returns the limit comments most similar to the comment id, in the last window posts of
+// the same kind, e.g. other "Who is hiring?" months. The comment's stored embedding is the query, so
+// nothing is embedded or completed. The comment itself, and those by the same poster too similar to it,
+// are left out.
+func SimilarItems(ctx context.Context, l *slog.Logger, q *queries.Queries, id int, window int, limit int) (queries.Item, VectorSearchResponse, error) {
+	item, err := q.GetItem(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return item, VectorSearchResponse{}, ErrItemNotFound
+	}
+	if err != nil {
+		return item, VectorSearchResponse{}, errors.WithStack(err)
+	}
+	clause, err := threadClause(ctx, q, item)
+	if err != nil {
+		return item, VectorSearchResponse{}, err
+	}
+	vectors := map[string][]float32{}
+	terms, err := itemVectors(ctx, q, []int{id}, vectors)
+	if err != nil {
+		return item, VectorSearchResponse{}, err
+	}
+	if len(terms) == 0 {
+		return item, VectorSearchResponse{}, errors.Wrapf(ErrItemNotFound, "no %s embedding of item %d", *embeddingModel, id)
+	}
+
+	// The comment is its own best match.
+	resp, err := VectorSearch(ctx, l, q, nil, window, *embeddingModel, clause, terms, nil, vectors, limit+1)
+	if err != nil {
+		return item, resp, err
+	}
+	resp.Results = slices.DeleteFunc(resp.Results, func(r Result) bool { return r.ID == id })
+	resp.Results = resp.Results[:min(limit, len(resp.Results))]
+	return item, resp, nil
+}
+
+// threadClause returns the title clause of the kind of post item is a comment of.
+func threadClause(ctx context.Context, q *queries.Queries, item queries.Item) (string, error) {
+	if item.Parent == 0 {
+		return "", errors.Wrapf(ErrItemNotFound, "item %d isn't a comment", item.ID)
+	}
+	parent, err := q.GetItem(ctx, item.Parent)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errors.Wrapf(ErrItemNotFound, "parent %d of item %d", item.Parent, item.ID)
+	}
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	for _, clause := range []string{whoIsHiring, whoWantsToBeHired} {
+		if strings.HasPrefix(parent.Title, strings.TrimSuffix(clause, "%")) {
+			return clause, nil
+		}
+	}
+	return "", errors.Wrapf(ErrItemNotFound, "item %d isn't a comment of a whoishiring post", item.ID)
+}
+
+// printSimilar prints the results of SimilarItems, for -similar.
+func printSimilar(w io.Writer, item queries.Item, resp VectorSearchResponse) {
+	fmt.Fprintf(w, "Similar to %d: %s\n\n", item.ID, firstLine(item.Text))
+	for _, result := range resp.Results {
+		fmt.Fprintf(w, "%.3f https://news.ycombinator.com/item?id=%d %s\n", result.Similarity, result.ID, firstLine(result.Item.Text))
+	}
+	fmt.Fprintf(w, "\n%d comments searched\n", resp.Searched)
+}
+
+// firstLine returns the first line of the text of a comment, typically its company, role and location.
+func firstLine(html string) string {
+	text := strings.TrimSpace(plainText(html))
+	line, _, _ := strings.Cut(text, "\n")
+	return line
+}
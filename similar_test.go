@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"strings"
+	"testing"
+)
+
+func TestSimilarItems(t *testing.T) {
+	useTestModels(t)
+	q := newFixtureDB(t)
+	ctx := context.Background()
+
+	item, resp, err := SimilarItems(ctx, testLogger(), q, 1001, MaxWindow, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.ID != 1001 {
+		t.Errorf("expected the seed item, got %d", item.ID)
+	}
+	if len(resp.Results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(resp.Results))
+	}
+	for _, result := range resp.Results {
+		if result.ID == 1001 {
+			t.Error("expected the seed to be left out")
+		}
+		if result.Item.Parent != 1000 {
+			t.Errorf("expected comments of hiring posts, got %d of %d", result.ID, result.Item.Parent)
+		}
+	}
+	// Go, Kubernetes and distributed systems.
+	if resp.Results[0].ID != 1005 {
+		t.Errorf("expected the Go SRE job first, got %d", resp.Results[0].ID)
+	}
+	if len(testLLMClient.requests) != 0 {
+		t.Errorf("expected no completions, got %d", len(testLLMClient.requests))
+	}
+
+	sb := &strings.Builder{}
+	printSimilar(sb, item, resp)
+	if !strings.Contains(sb.String(), "item?id=1005 Infra Cloud | Site Reliability Engineer") {
+		t.Errorf("unexpected output:\n%s", sb)
+	}
+
+	if _, _, err := SimilarItems(ctx, testLogger(), q, 1000, MaxWindow, 3); !errors.Is(err, ErrItemNotFound) {
+		t.Errorf("expected a post not to be a comment, got %v", err)
+	}
+}
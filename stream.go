@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/newhook/whoishiring/queries"
+	"github.com/pkg/errors"
+	"log/slog"
+	"net/http"
+)
+
+// streamJobSearch runs a job search, sending its events to the client as server-sent events as they
+// happen. The last event is "result" with the same body as /jobs, or "error".
+func streamJobSearch(c echo.Context, l *slog.Logger, q *queries.Queries, terms SearchTerms) error {
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	// Stop proxies such as nginx from buffering the events.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	var writeErr error
+	emit := func(e Event) {
+		if writeErr != nil {
+			return
+		}
+		writeErr = writeEvent(w, e)
+	}
+
+	resp, err := StreamJobSearch(c.Request().Context(), l, q, terms, emit)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrBudgetExceeded) {
+			status = http.StatusTooManyRequests
+		}
+		l.Error("job search failed", slog.String("error", err.Error()))
+		emit(Event{Name: "error", Data: map[string]any{"error": err.Error(), "status": status}})
+	} else {
+		emit(Event{Name: "result", Data: jobsResponse(resp)})
+	}
+	if writeErr != nil {
+		// The client is gone, there's nobody to tell.
+		l.Warn("couldn't stream job search", slog.String("error", writeErr.Error()))
+	}
+	return nil
+}
+
+func writeEvent(w *echo.Response, e Event) error {
+	b, err := json.Marshal(e.Data)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Name, b); err != nil {
+		return errors.WithStack(err)
+	}
+	w.Flush()
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"github.com/newhook/whoishiring/transport"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStreamJobSearch(t *testing.T) {
+	useTestModels(t, "remote Go backend engineer, distributed systems and Kubernetes")
+	q := newFixtureDB(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/jobs/stream", nil).WithContext(context.Background())
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	err := streamJobSearch(c, testLogger(), q, SearchTerms{
+		Months:     1,
+		SearchType: SearchType_WhoIsHiring,
+		JobPrompt:  "remote Go backend engineer, distributed systems and Kubernetes",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.Header().Get(echo.HeaderContentType); got != "text/event-stream" {
+		t.Errorf("unexpected content type %q", got)
+	}
+
+	var names []string
+	var picks strings.Builder
+	var result map[string]any
+	err = transport.ReadEvents(rec.Body, func(event, data string) error {
+		names = append(names, event)
+		switch event {
+		case "delta":
+			var delta struct {
+				Text string `json:"text"`
+			}
+			if err := json.Unmarshal([]byte(data), &delta); err != nil {
+				return err
+			}
+			picks.WriteString(delta.Text)
+		case "result":
+			return json.Unmarshal([]byte(data), &result)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"progress", "search_terms", "progress", "candidates", "delta", "progress", "result"}
+	if !slices.Equal(names, expected) {
+		t.Errorf("expected events %v, got %v", expected, names)
+	}
+	if !strings.Contains(picks.String(), "1001") {
+		t.Errorf("expected the picks to be streamed, got %q", picks.String())
+	}
+	if comments, _ := result["comments"].([]any); len(comments) == 0 || comments[0] != float64(1001) {
+		t.Errorf("expected the Go backend job first, got %v", result["comments"])
+	}
+}
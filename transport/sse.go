@@ -0,0 +1,51 @@
+package transport
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+)
+
+// ReadEvents reads a server-sent events stream from r, calling fn with the event name and data of
+// each event. The event name is empty for streams that don't name their events. Reading stops at
+// the end of the stream or when fn returns an error.
+func ReadEvents(r io.Reader, fn func(event, data string) error) error {
+	scanner := bufio.NewScanner(r)
+	// A single event can hold a large chunk of a completion.
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+
+	var event string
+	var data []string
+	dispatch := func() error {
+		if len(data) == 0 {
+			event = ""
+			return nil
+		}
+		err := fn(event, strings.Join(data, "\n"))
+		event, data = "", nil
+		return err
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if err := dispatch(); err != nil {
+				return err
+			}
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			data = append(data, value)
+		}
+		// Comments (lines starting with ':'), ids and retries aren't used by the providers.
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "couldn't read event stream")
+	}
+	return dispatch()
+}
@@ -0,0 +1,309 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxRetries = 4
+	baseBackoff       = 500 * time.Millisecond
+	maxBackoff        = 30 * time.Second
+	// Don't wait when a provider asks for longer than this, e.g. a daily quota.
+	maxRetryAfter = time.Minute
+)
+
+// Limits throttles the calls made to a provider. Zero values are unlimited.
+type Limits struct {
+	RequestsPerSecond float64
+	TokensPerMinute   int
+}
+
+// String and Set make Limits usable as a flag, formatted as "rps=4,tpm=100000".
+func (l *Limits) String() string {
+	if l == nil {
+		return ""
+	}
+	var parts []string
+	if l.RequestsPerSecond > 0 {
+		parts = append(parts, "rps="+strconv.FormatFloat(l.RequestsPerSecond, 'g', -1, 64))
+	}
+	if l.TokensPerMinute > 0 {
+		parts = append(parts, "tpm="+strconv.Itoa(l.TokensPerMinute))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *Limits) Set(s string) error {
+	var limits Limits
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return errors.Errorf("invalid limit %q, expected key=value", part)
+		}
+		var err error
+		switch key {
+		case "rps":
+			limits.RequestsPerSecond, err = strconv.ParseFloat(value, 64)
+		case "tpm":
+			limits.TokensPerMinute, err = strconv.Atoi(value)
+		default:
+			return errors.Errorf("unknown limit %q, expected rps or tpm", key)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "invalid limit %q", part)
+		}
+	}
+	*l = limits
+	return nil
+}
+
+// Error is an error response from a provider API.
+type Error struct {
+	Provider   string
+	StatusCode int
+	// Type is the provider's error type or code, e.g. "rate_limit_error" or "insufficient_quota".
+	Type       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s: %d", e.Provider, e.StatusCode)
+	if text := http.StatusText(e.StatusCode); text != "" {
+		msg += " " + text
+	}
+	if e.Type != "" {
+		msg += " (" + e.Type + ")"
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// QuotaExceeded reports whether the account is out of credits, which waiting won't fix.
+func (e *Error) QuotaExceeded() bool {
+	return e.Type == "insufficient_quota" || e.StatusCode == http.StatusPaymentRequired
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *Error) Temporary() bool {
+	if e.QuotaExceeded() {
+		return false
+	}
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout, 529: // 529 is Anthropic's overloaded.
+		return true
+	}
+	return false
+}
+
+// ErrorParser extracts the error type and message from a provider's error response body.
+type ErrorParser func(body []byte) (typ string, message string)
+
+// Client sends requests to a provider API, waiting for the configured limits,
+// retrying rate limited and failed requests with exponential backoff, and
+// turning error responses into an *Error.
+type Client struct {
+	provider   string
+	parseError ErrorParser
+	client     *http.Client
+	maxRetries int
+
+	mutex    sync.Mutex
+	requests *rate.Limiter
+	tokens   *rate.Limiter
+}
+
+func New(provider string, limits Limits, parseError ErrorParser) *Client {
+	c := &Client{
+		provider:   provider,
+		parseError: parseError,
+		client:     http.DefaultClient,
+		maxRetries: defaultMaxRetries,
+	}
+	c.SetLimits(limits)
+	return c
+}
+
+func (c *Client) SetLimits(limits Limits) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.requests, c.tokens = nil, nil
+	if limits.RequestsPerSecond > 0 {
+		c.requests = rate.NewLimiter(rate.Limit(limits.RequestsPerSecond), 1)
+	}
+	if limits.TokensPerMinute > 0 {
+		c.tokens = rate.NewLimiter(rate.Limit(float64(limits.TokensPerMinute)/60), limits.TokensPerMinute)
+	}
+}
+
+func (c *Client) wait(ctx context.Context, tokens int) error {
+	c.mutex.Lock()
+	requests, tokenLimiter := c.requests, c.tokens
+	c.mutex.Unlock()
+	if requests != nil {
+		if err := requests.Wait(ctx); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if tokenLimiter != nil && tokens > 0 {
+		if tokens > tokenLimiter.Burst() {
+			tokens = tokenLimiter.Burst()
+		}
+		if err := tokenLimiter.WaitN(ctx, tokens); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// Do sends req and returns the response if it has a 2xx status. tokens is
+// the estimated number of tokens the request consumes, used for the tokens
+// per minute limit. The request body must be replayable (see
+// http.Request.GetBody) for retries.
+func (c *Client) Do(req *http.Request, tokens int) (*http.Response, error) {
+	ctx := req.Context()
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	for attempt := 0; ; attempt++ {
+		if err := c.wait(ctx, tokens); err != nil {
+			return nil, err
+		}
+
+		attemptReq := req
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			attemptReq = req.Clone(ctx)
+			attemptReq.Body = body
+		}
+
+		var retryAfter time.Duration
+		resp, err := c.client.Do(attemptReq)
+		switch {
+		case err != nil:
+			if ctx.Err() != nil || !replayable || attempt >= c.maxRetries {
+				return nil, errors.Wrapf(err, "%s: couldn't send request", c.provider)
+			}
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return resp, nil
+		default:
+			apiErr := c.readError(resp)
+			if !apiErr.Temporary() || !replayable || attempt >= c.maxRetries || apiErr.RetryAfter > maxRetryAfter {
+				return nil, apiErr
+			}
+			retryAfter = apiErr.RetryAfter
+		}
+
+		delay := backoff(attempt)
+		if retryAfter > 0 {
+			delay = retryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.WithStack(ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
+
+// PostJSON marshals body, posts it to url and unmarshals the response into out.
+func (c *Client) PostJSON(ctx context.Context, url string, header http.Header, body any, tokens int, out any) error {
+	resp, err := c.PostStream(ctx, url, header, body, tokens)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "couldn't read response body")
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return errors.Wrap(err, "couldn't unmarshal response body")
+	}
+	return nil
+}
+
+// PostStream marshals body and posts it to url, returning the response for the caller to read
+// as it arrives, e.g. with ReadEvents. The caller must close the response body.
+func (c *Client) PostStream(ctx context.Context, url string, header http.Header, body any, tokens int) (*http.Response, error) {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't marshal request body")
+	}
+	// Creating the request with context is important for a timeout to be
+	// possible, because the client is configured without a timeout.
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create request")
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.Do(req, tokens)
+}
+
+func (c *Client) readError(resp *http.Response) *Error {
+	defer resp.Body.Close()
+	apiErr := &Error{
+		Provider:   c.provider,
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if c.parseError != nil {
+		apiErr.Type, apiErr.Message = c.parseError(body)
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	return apiErr
+}
+
+func parseRetryAfter(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func backoff(attempt int) time.Duration {
+	d := baseBackoff << attempt
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	// Full jitter so concurrent callers don't retry in lock step.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// EstimateTokens roughly estimates the tokens in text for the tokens per minute limit.
+func EstimateTokens(text string) int {
+	return len(text)/4 + 1
+}
@@ -0,0 +1,266 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// response is what the stub server responds to an attempt.
+type response struct {
+	status     int
+	retryAfter string
+	body       string
+}
+
+// newStubServer responds to the nth request with responses[n], and with the last response after
+// that. It records the request bodies.
+func newStubServer(t *testing.T, responses ...response) (*httptest.Server, *[]string) {
+	t.Helper()
+	var bodies []string
+	var n atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		i := int(n.Add(1)) - 1
+		if i >= len(responses) {
+			i = len(responses) - 1
+		}
+		resp := responses[i]
+		if resp.retryAfter != "" {
+			w.Header().Set("Retry-After", resp.retryAfter)
+		}
+		w.WriteHeader(resp.status)
+		_, _ = w.Write([]byte(resp.body))
+	}))
+	t.Cleanup(s.Close)
+	return s, &bodies
+}
+
+// parseTestError parses errors formatted like {"error": {"type": "...", "message": "..."}}.
+func parseTestError(body []byte) (string, string) {
+	var resp struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) != nil {
+		return "", ""
+	}
+	return resp.Error.Type, resp.Error.Message
+}
+
+func TestPostJSONRetries(t *testing.T) {
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, 529} {
+		s, bodies := newStubServer(t,
+			response{status: status, retryAfter: "0.01"},
+			response{status: status, retryAfter: "0.01"},
+			response{status: http.StatusOK, body: `{"ok": true}`},
+		)
+		c := New("stub", Limits{}, parseTestError)
+		var out struct{ OK bool }
+		if err := c.PostJSON(context.Background(), s.URL, nil, map[string]string{"prompt": "go"}, 1, &out); err != nil {
+			t.Fatalf("expected %d to be retried, got %v", status, err)
+		}
+		if !out.OK {
+			t.Error("expected the response to be unmarshalled")
+		}
+		if len(*bodies) != 3 {
+			t.Fatalf("expected 3 attempts for %d, got %d", status, len(*bodies))
+		}
+		for _, b := range *bodies {
+			if b != `{"prompt":"go"}` {
+				t.Errorf("expected the body to be replayed, got %q", b)
+			}
+		}
+	}
+}
+
+func TestDoHonorsRetryAfter(t *testing.T) {
+	s, bodies := newStubServer(t,
+		response{status: http.StatusTooManyRequests, retryAfter: "0.2"},
+		response{status: http.StatusOK},
+	)
+	start := time.Now()
+	if err := New("stub", Limits{}, nil).PostJSON(context.Background(), s.URL, nil, "", 1, new(any)); err == nil {
+		t.Fatal("expected an error unmarshalling the empty body")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected to wait for the Retry-After, retried after %s", elapsed)
+	}
+	if len(*bodies) != 2 {
+		t.Errorf("expected 2 attempts, got %d", len(*bodies))
+	}
+
+	// Asked to wait longer than it's worth.
+	s, bodies = newStubServer(t, response{status: http.StatusTooManyRequests, retryAfter: "3600"})
+	err := New("stub", Limits{}, nil).PostJSON(context.Background(), s.URL, nil, "", 1, new(any))
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.RetryAfter != time.Hour || !apiErr.Temporary() {
+		t.Errorf("expected the rate limit error, got %v", err)
+	}
+	if len(*bodies) != 1 {
+		t.Errorf("expected a single attempt, got %d", len(*bodies))
+	}
+}
+
+func TestDoDoesntRetryPermanentErrors(t *testing.T) {
+	for _, c := range []struct {
+		resp          response
+		typ, message  string
+		quotaExceeded bool
+	}{
+		{response{status: http.StatusBadRequest, body: `{"error": {"type": "invalid_request_error", "message": "bad model"}}`}, "invalid_request_error", "bad model", false},
+		{response{status: http.StatusUnauthorized, body: `{"error": {"type": "authentication_error", "message": "bad key"}}`}, "authentication_error", "bad key", false},
+		{response{status: http.StatusNotFound, body: "  not found\n"}, "", "not found", false},
+		{response{status: http.StatusTooManyRequests, retryAfter: "0.01", body: `{"error": {"type": "insufficient_quota", "message": "out of credits"}}`}, "insufficient_quota", "out of credits", true},
+		{response{status: http.StatusPaymentRequired}, "", "", true},
+	} {
+		s, bodies := newStubServer(t, c.resp, response{status: http.StatusOK})
+		err := New("stub", Limits{}, parseTestError).PostJSON(context.Background(), s.URL, nil, "", 1, new(any))
+		var apiErr *Error
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("expected an *Error for %d, got %v", c.resp.status, err)
+		}
+		if apiErr.Provider != "stub" || apiErr.StatusCode != c.resp.status || apiErr.Type != c.typ || apiErr.Message != c.message {
+			t.Errorf("unexpected error %+v", apiErr)
+		}
+		if apiErr.Temporary() || apiErr.QuotaExceeded() != c.quotaExceeded {
+			t.Errorf("unexpected classification of %v", apiErr)
+		}
+		if len(*bodies) != 1 {
+			t.Errorf("expected a single attempt for %v, got %d", apiErr, len(*bodies))
+		}
+	}
+}
+
+func TestDoGivesUp(t *testing.T) {
+	s, bodies := newStubServer(t, response{status: http.StatusServiceUnavailable, retryAfter: "0.001", body: "overloaded"})
+	c := New("stub", Limits{}, nil)
+	c.maxRetries = 2
+	err := c.PostJSON(context.Background(), s.URL, nil, "", 1, new(any))
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the last error, got %v", err)
+	}
+	if len(*bodies) != 3 {
+		t.Errorf("expected 3 attempts, got %d", len(*bodies))
+	}
+
+	// A body that can't be replayed isn't retried.
+	*bodies = nil
+	req, err := http.NewRequest(http.MethodPost, s.URL, io.NopCloser(strings.NewReader("{}")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Do(req, 1); !errors.As(err, &apiErr) {
+		t.Fatalf("expected an *Error, got %v", err)
+	}
+	if len(*bodies) != 1 {
+		t.Errorf("expected a single attempt, got %d", len(*bodies))
+	}
+}
+
+func TestDoStopsWhenCancelled(t *testing.T) {
+	s, _ := newStubServer(t, response{status: http.StatusServiceUnavailable, retryAfter: "30"})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := New("stub", Limits{}, nil).PostJSON(ctx, s.URL, nil, "", 1, new(any))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected to stop waiting when cancelled, took %s", elapsed)
+	}
+}
+
+func TestErrorString(t *testing.T) {
+	err := &Error{Provider: "anthropic", StatusCode: 529, Type: "overloaded_error", Message: "Overloaded"}
+	if got := err.Error(); got != "anthropic: 529 (overloaded_error): Overloaded" {
+		t.Errorf("unexpected error %q", got)
+	}
+	err = &Error{Provider: "openai", StatusCode: http.StatusBadRequest}
+	if got := err.Error(); got != "openai: 400 Bad Request" {
+		t.Errorf("unexpected error %q", got)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"":        0,
+		"2":       2 * time.Second,
+		"0.5":     500 * time.Millisecond,
+		"invalid": 0,
+	} {
+		if got := parseRetryAfter(s); got != want {
+			t.Errorf("expected %s for %q, got %s", want, s, got)
+		}
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got < 58*time.Second || got > time.Minute {
+		t.Errorf("expected about a minute for %q, got %s", date, got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 100; attempt++ {
+		max := baseBackoff << attempt
+		if max > maxBackoff || max <= 0 {
+			max = maxBackoff
+		}
+		if d := backoff(attempt); d < max/2 || d > max {
+			t.Errorf("expected the backoff of attempt %d within [%s, %s], got %s", attempt, max/2, max, d)
+		}
+	}
+}
+
+func TestLimitsFlag(t *testing.T) {
+	var l Limits
+	if err := l.Set("rps=2.5,tpm=100000"); err != nil {
+		t.Fatal(err)
+	}
+	if l != (Limits{RequestsPerSecond: 2.5, TokensPerMinute: 100000}) {
+		t.Errorf("unexpected limits %+v", l)
+	}
+	if l.String() != "rps=2.5,tpm=100000" {
+		t.Errorf("unexpected string %q", l.String())
+	}
+	if err := l.Set("tpm=10,"); err != nil || l != (Limits{TokensPerMinute: 10}) {
+		t.Errorf("expected the limits to be replaced, got %+v, %v", l, err)
+	}
+	if err := l.Set(""); err != nil || l != (Limits{}) || l.String() != "" {
+		t.Errorf("expected no limits, got %+v, %v", l, err)
+	}
+	for _, s := range []string{"rps", "rps=fast", "tpm=1.5", "rpm=10"} {
+		if err := l.Set(s); err == nil {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestLimitsThrottle(t *testing.T) {
+	s, bodies := newStubServer(t, response{status: http.StatusOK, body: "{}"})
+	c := New("stub", Limits{RequestsPerSecond: 10}, nil)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := c.PostJSON(context.Background(), s.URL, nil, "", 1, new(any)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first request is sent immediately, the next two 100ms apart.
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected the requests to be throttled, took %s", elapsed)
+	}
+	if len(*bodies) != 3 {
+		t.Errorf("expected 3 requests, got %d", len(*bodies))
+	}
+}
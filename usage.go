@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"github.com/newhook/whoishiring/llm"
+	"github.com/newhook/whoishiring/queries"
+	"github.com/pkg/errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CompletionEndpoint = "completion"
+	EmbeddingEndpoint  = "embedding"
+	LinkedInEndpoint   = "linkedin"
+)
+
+// Price is the cost of a model in US dollars per million tokens, plus a fee per call.
+type Price struct {
+	Input   float64 `json:"input"`
+	Output  float64 `json:"output"`
+	PerCall float64 `json:"per_call"`
+}
+
+// prices are the list prices of the hosted models. Models without a price, e.g. those run locally,
+// are free.
+var prices = map[string]Price{
+	"claude-3-5-sonnet":      {Input: 3, Output: 15},
+	"claude-3-opus":          {Input: 15, Output: 75},
+	"claude-3-haiku":         {Input: 0.25, Output: 1.25},
+	"gpt-4o":                 {Input: 2.5, Output: 10},
+	"gpt-4o-2024-05-13":      {Input: 5, Output: 15},
+	"gpt-4o-mini":            {Input: 0.15, Output: 0.6},
+	"text-embedding-3-small": {Input: 0.02},
+	"text-embedding-3-large": {Input: 0.13},
+	"text-embedding-ada-002": {Input: 0.1},
+	"voyage-2":               {Input: 0.1},
+	"voyage-large-2":         {Input: 0.12},
+	"voyage-code-2":          {Input: 0.12},
+	// A person profile is a Proxycurl credit.
+	proxycurlPerson: {PerCall: 0.01},
+}
+
+const proxycurlPerson = "proxycurl-person"
+
+// priceOf returns the price of model. Dated versions, e.g. "gpt-4o-2024-08-06", have the price of
+// the longest priced prefix.
+func priceOf(model string) Price {
+	if p, ok := prices[model]; ok {
+		return p
+	}
+	var price Price
+	longest := 0
+	for name, p := range prices {
+		if len(name) > longest && strings.HasPrefix(model, name+"-") {
+			price, longest = p, len(name)
+		}
+	}
+	return price
+}
+
+// Cost returns the cost of usage of model in US dollars.
+func Cost(model string, usage llm.Usage) float64 {
+	p := priceOf(model)
+	return p.PerCall + (float64(usage.InputTokens)*p.Input+float64(usage.OutputTokens)*p.Output)/1e6
+}
+
+// Usage totals the calls of a job search.
+type Usage struct {
+	Calls        int     `json:"calls"`
+	InputTokens  int     `json:"input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+	Cost         float64 `json:"cost"`
+}
+
+// Meter records the tokens and cost of paid calls in the usage table, and totals them. A nil Meter
+// records nothing.
+type Meter struct {
+	q *queries.Queries
+	// principal is who the calls are made for, see principal. It's empty for the server's own calls,
+	// which skip the per-principal budget but are still limited by the global budget.
+	principal string
+
+	mutex  sync.Mutex
+	totals Usage
+}
+
+func NewMeter(q *queries.Queries, principal string) *Meter {
+	return &Meter{q: q, principal: principal}
+}
+
+// Record records a call of endpoint, for task, to the provider's model.
+func (m *Meter) Record(ctx context.Context, endpoint, provider, model, task string, usage llm.Usage) error {
+	if m == nil {
+		return nil
+	}
+	cost := Cost(model, usage)
+	m.mutex.Lock()
+	m.totals.Calls++
+	m.totals.InputTokens += usage.InputTokens
+	m.totals.OutputTokens += usage.OutputTokens
+	m.totals.Cost += cost
+	m.mutex.Unlock()
+
+	err := m.q.InsertUsage(ctx, queries.InsertUsageParams{
+		Endpoint:     endpoint,
+		Provider:     provider,
+		Model:        model,
+		Task:         task,
+		InputTokens:  usage.InputTokens,
+		OutputTokens: usage.OutputTokens,
+		Cost:         cost,
+		CreatedAt:    int(time.Now().Unix()),
+		Principal:    m.principal,
+	})
+	return errors.WithStack(err)
+}
+
+// Totals returns the usage recorded so far.
+func (m *Meter) Totals() Usage {
+	if m == nil {
+		return Usage{}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.totals
+}
+
+// UsageReport is the usage of each day, provider and endpoint since a day, newest first.
+type UsageReport struct {
+	Since string                      `json:"since"`
+	Rows  []queries.GetUsageReportRow `json:"usage"`
+	Total Usage                       `json:"total"`
+}
+
+func GetUsageReport(ctx context.Context, q *queries.Queries, days int) (UsageReport, error) {
+	y, mo, d := time.Now().UTC().AddDate(0, 0, 1-days).Date()
+	since := time.Date(y, mo, d, 0, 0, 0, 0, time.UTC)
+	rows, err := q.GetUsageReport(ctx, int(since.Unix()))
+	if err != nil {
+		return UsageReport{}, errors.WithStack(err)
+	}
+	report := UsageReport{
+		Since: since.Format(time.DateOnly),
+		Rows:  rows,
+	}
+	for _, r := range rows {
+		report.Total.Calls += int(r.Calls)
+		report.Total.InputTokens += int(r.InputTokens)
+		report.Total.OutputTokens += int(r.OutputTokens)
+		report.Total.Cost += r.Cost
+	}
+	return report, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestPriceOf(t *testing.T) {
+	for model, want := range map[string]Price{
+		"gpt-4o":                     prices["gpt-4o"],
+		"gpt-4o-2024-08-06":          prices["gpt-4o"],
+		"gpt-4o-2024-05-13":          prices["gpt-4o-2024-05-13"],
+		"gpt-4o-mini-2024-07-18":     prices["gpt-4o-mini"],
+		"claude-3-5-sonnet-20240620": prices["claude-3-5-sonnet"],
+		"llama3.1":                   {},
+	} {
+		if got := priceOf(model); got != want {
+			t.Errorf("%s: expected %+v, got %+v", model, want, got)
+		}
+	}
+}
+
+func TestJobSearchRecordsUsage(t *testing.T) {
+	useTestModels(t, "remote Go backend engineer")
+	prices[testCompletion] = Price{Input: 3, Output: 15}
+	t.Cleanup(func() { delete(prices, testCompletion) })
+	q := newFixtureDB(t)
+	ctx := context.Background()
+
+	resp, err := JobSearch(ctx, testLogger(), q, SearchTerms{
+		Months:     1,
+		SearchType: SearchType_WhoIsHiring,
+		JobPrompt:  "remote Go backend engineer",
+		NoCache:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The terms and job search completions, and the embedding of the single term.
+	want := Usage{Calls: 3, InputTokens: 200, OutputTokens: 20, Cost: 2 * (100*3 + 10*15) / 1e6}
+	if resp.Usage.Calls != want.Calls || resp.Usage.InputTokens != want.InputTokens ||
+		resp.Usage.OutputTokens != want.OutputTokens || math.Abs(resp.Usage.Cost-want.Cost) > 1e-12 {
+		t.Errorf("expected usage %+v, got %+v", want, resp.Usage)
+	}
+
+	report, err := GetUsageReport(ctx, q, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var completions, embeddings int64
+	for _, row := range report.Rows {
+		switch {
+		case row.Endpoint == CompletionEndpoint && row.Provider == testCompletion:
+			completions += row.Calls
+			if row.InputTokens != 200 || row.OutputTokens != 20 {
+				t.Errorf("unexpected completion usage %+v", row)
+			}
+		case row.Endpoint == EmbeddingEndpoint && row.Provider == "hashing":
+			embeddings += row.Calls
+		}
+	}
+	if completions != 2 || embeddings == 0 {
+		t.Errorf("expected the calls in the report, got %+v", report.Rows)
+	}
+	if math.Abs(report.Total.Cost-want.Cost) > 1e-12 {
+		t.Errorf("expected a total cost of %f, got %f", want.Cost, report.Total.Cost)
+	}
+}
@@ -1,15 +1,14 @@
 package voyageai
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"github.com/newhook/whoishiring/transport"
 	"github.com/pkg/errors"
-	"golang.org/x/time/rate"
-	"io"
 	"math"
 	"net/http"
 	"os"
+	"sync"
 )
 
 const voyageURL = "https://api.voyageai.com/v1/embeddings"
@@ -40,77 +39,59 @@ type ApiResponse struct {
 	} `json:"usage"`
 }
 
-type RateLimitedClient struct {
-	client  *http.Client
-	limiter *rate.Limiter
-}
+// 5 per second is 300 per minute, we'll go slightly lower.
+var client = transport.New("voyageai", transport.Limits{RequestsPerSecond: 4}, parseError)
 
-func NewRateLimitedClient(requestsPerSecond float64) *RateLimitedClient {
-	return &RateLimitedClient{
-		client:  http.DefaultClient,
-		limiter: rate.NewLimiter(rate.Limit(requestsPerSecond), 1),
-	}
+// SetLimits configures the rate limits shared by all calls to the Voyage AI API.
+func SetLimits(limits transport.Limits) {
+	client.SetLimits(limits)
 }
 
-func (c *RateLimitedClient) Do(req *http.Request) (*http.Response, error) {
-	err := c.limiter.Wait(req.Context())
-	if err != nil {
-		return nil, err
+func parseError(body []byte) (string, string) {
+	var resp struct {
+		Detail string `json:"detail"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", ""
 	}
-	return c.client.Do(req)
+	return "", resp.Detail
 }
 
-var client = NewRateLimitedClient(4) // 5 per second is 300 per minute, we'll go slightly lower.
+// Embedding creates embeddings with Voyage AI's API, returning the vector and the tokens billed.
+func Embedding(model EmbeddingModel) func(ctx context.Context, text string) ([]float32, int, error) {
+	var checkedNormalized bool
+	checkNormalized := sync.Once{}
 
-func Embedding(model EmbeddingModel) func(ctx context.Context, text string) ([]float32, error) {
-	return func(ctx context.Context, text string) ([]float32, error) {
-		// Prepare the request body.
-		reqBody, err := json.Marshal(map[string]any{
+	return func(ctx context.Context, text string) ([]float32, int, error) {
+		header := http.Header{}
+		header.Set("Authorization", "Bearer "+apiKey)
+		var embeddingResponse ApiResponse
+		err := client.PostJSON(ctx, voyageURL, header, map[string]any{
 			"model": model,
 			"input": []string{text},
-		})
-		if err != nil {
-			return nil, errors.Errorf("couldn't marshal request body: %w", err)
-		}
-
-		// Create the request. Creating it with context is important for a timeout
-		// to be possible, because the client is configured without a timeout.
-		req, err := http.NewRequestWithContext(ctx, "POST", voyageURL, bytes.NewBuffer(reqBody))
-		if err != nil {
-			return nil, errors.Errorf("couldn't create request: %w", err)
-		}
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer "+apiKey)
-
-		// Send the request.
-		resp, err := client.Do(req)
+		}, transport.EstimateTokens(text), &embeddingResponse)
 		if err != nil {
-			return nil, errors.Errorf("couldn't send request: %w", err)
-		}
-		defer resp.Body.Close()
-
-		// Check the response status.
-		if resp.StatusCode != http.StatusOK {
-			return nil, errors.New("error response from the embedding API: " + resp.Status)
-		}
-
-		// Read and decode the response body.
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, errors.Errorf("couldn't read response body: %w", err)
-		}
-		var embeddingResponse ApiResponse
-		err = json.Unmarshal(body, &embeddingResponse)
-		if err != nil {
-			return nil, errors.Errorf("couldn't unmarshal response body: %w", err)
+			return nil, 0, err
 		}
 
 		// Check if the response contains embeddings.
 		if len(embeddingResponse.Data) == 0 {
-			return nil, errors.New("no embeddings found in the response")
+			return nil, 0, errors.New("no embeddings found in the response")
+		}
+
+		v := embeddingResponse.Data[0].Embedding
+		checkNormalized.Do(func() {
+			if isNormalized(v) {
+				checkedNormalized = true
+			} else {
+				checkedNormalized = false
+			}
+		})
+		if !checkedNormalized {
+			v = normalizeVector(v)
 		}
 
-		return embeddingResponse.Data[0].Embedding, nil
+		return v, embeddingResponse.Usage.TotalTokens, nil
 	}
 }
 
@@ -7,7 +7,10 @@ import (
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
 	"log/slog"
+	"math"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -22,6 +25,10 @@ type Result struct {
 
 type VectorSearchResponse struct {
 	Results []Result
+	// EmbeddingModels created the query embeddings, the fallbacks when the embedding model failed.
+	EmbeddingModels []string
+	// Vectors are the query embeddings by term.
+	Vectors map[string][]float32
 
 	TotalPosts int
 	TotalItems int
@@ -29,7 +36,27 @@ type VectorSearchResponse struct {
 	Searched   int
 }
 
-func VectorSearch(ctx context.Context, l *slog.Logger, q *queries.Queries, window int, model string, clause string, terms []string, limit int) (VectorSearchResponse, error) {
+// negativeWeight is how much of a comment's similarity to the most similar negative term is subtracted
+// from its similarity to a query term.
+const negativeWeight = 0.5
+
+// negative is the embedding of a negative term. Comments more similar to an exclusion than to the query
+// term are left out, while disliked comments only rank those like them lower, since comments are more
+// similar to each other than to any query.
+type negative struct {
+	vector  []float32
+	exclude bool
+}
+
+// VectorSearch returns the limit comments of the last window posts matching clause most similar to any
+// of terms, and least similar to the negative terms. The query embeddings in vectors are reused, the
+// other terms are embedded.
+func VectorSearch(ctx context.Context, l *slog.Logger, q *queries.Queries, m *Meter, window int, model string, clause string, terms []string, negatives []string, vectors map[string][]float32, limit int) (VectorSearchResponse, error) {
+	return vectorSearch(ctx, l, q, m, window, model, clause, terms, negatives, vectors, limit, 0)
+}
+
+// vectorSearch is VectorSearch of the comments after the comment ID after only, which are newer.
+func vectorSearch(ctx context.Context, l *slog.Logger, q *queries.Queries, m *Meter, window int, model string, clause string, terms []string, negatives []string, vectors map[string][]float32, limit int, after int) (VectorSearchResponse, error) {
 	var resp VectorSearchResponse
 	if window > MaxWindow {
 		window = MaxWindow
@@ -40,6 +67,9 @@ func VectorSearch(ctx context.Context, l *slog.Logger, q *queries.Queries, windo
 		return resp, errors.WithStack(err)
 	}
 	resp.Posts = len(posts)
+	if window > len(posts) {
+		window = len(posts)
+	}
 
 	totalPosts, err := q.GetPostCount(ctx)
 	if err != nil {
@@ -52,16 +82,42 @@ func VectorSearch(ctx context.Context, l *slog.Logger, q *queries.Queries, windo
 	resp.TotalPosts = int(totalPosts)
 	resp.TotalItems = int(totalItems)
 
-	termVectors := make([][]float32, len(terms))
-	for i, term := range terms {
-		termVectors[i], err = GetEmbedding(ctx, term)
-		if err != nil {
-			return resp, errors.Wrapf(err, "couldn't create embedding of query")
+	resp.Vectors = map[string][]float32{}
+	used := NewSet[string]()
+	embed := func(terms []string) ([][]float32, error) {
+		termVectors := make([][]float32, len(terms))
+		for i, term := range terms {
+			if v, ok := vectors[term]; ok {
+				termVectors[i] = v
+			} else {
+				var model string
+				termVectors[i], model, err = GetEmbedding(ctx, m, term)
+				if err != nil {
+					return nil, errors.Wrapf(err, "couldn't create embedding of query")
+				}
+				used.Add(model)
+			}
+			resp.Vectors[term] = termVectors[i]
 		}
+		return termVectors, nil
+	}
+	termVectors, err := embed(terms)
+	if err != nil {
+		return resp, err
+	}
+	negativeVectors, err := embed(negatives)
+	if err != nil {
+		return resp, err
+	}
+	negs := make([]negative, len(negatives))
+	for i, term := range negatives {
+		negs[i] = negative{vector: negativeVectors[i], exclude: !strings.HasPrefix(term, itemTermPrefix)}
 	}
+	resp.EmbeddingModels = used.Values()
+	sort.Strings(resp.EmbeddingModels)
 
 	start := time.Now()
-	results, searched, err := searchPosts(ctx, q, limit, termVectors, posts[:window], model, terms)
+	results, searched, err := searchPosts(ctx, q, limit, termVectors, negs, posts[:window], model, terms, after)
 	if err != nil {
 		return resp, err
 	}
@@ -88,7 +144,7 @@ func VectorSearch(ctx context.Context, l *slog.Logger, q *queries.Queries, windo
 	return resp, nil
 }
 
-func searchPosts(ctx context.Context, q *queries.Queries, limit int, termVectors [][]float32, posts []queries.Item, model string, terms []string) ([]Result, int, error) {
+func searchPosts(ctx context.Context, q *queries.Queries, limit int, termVectors [][]float32, negatives []negative, posts []queries.Item, model string, terms []string, after int) ([]Result, int, error) {
 	var mutex sync.Mutex
 	h := binheap.EmptyTopNHeap[Result](limit*len(termVectors), func(i, j Result) bool {
 		return i.Similarity > j.Similarity
@@ -107,7 +163,7 @@ func searchPosts(ctx context.Context, q *queries.Queries, limit int, termVectors
 				return errors.WithStack(err)
 			}
 			for _, embedding := range embeddings {
-				if embedding.Embedding == nil {
+				if embedding.Embedding == nil || embedding.ItemID <= after {
 					continue
 				}
 				atomic.AddInt64(&searched, 1)
@@ -116,11 +172,29 @@ func searchPosts(ctx context.Context, q *queries.Queries, limit int, termVectors
 					return errors.WithStack(err)
 				}
 
+				// penalty is the similarity to the most similar negative term, and excluded the
+				// similarity to the most similar exclusion.
+				var penalty float32
+				excluded := float32(math.Inf(-1))
+				for _, n := range negatives {
+					sim, err := dotProduct(n.vector, ev)
+					if err != nil {
+						return errors.Wrapf(err, "item %d, run with -repair", embedding.ItemID)
+					}
+					penalty = max(penalty, sim)
+					if n.exclude {
+						excluded = max(excluded, sim)
+					}
+				}
 				for i, termVector := range termVectors {
 					sim, err := dotProduct(termVector, ev)
 					if err != nil {
-						return errors.WithStack(err)
+						return errors.Wrapf(err, "item %d, run with -repair", embedding.ItemID)
+					}
+					if excluded > sim {
+						continue
 					}
+					sim -= negativeWeight * penalty
 					mutex.Lock()
 					h.Push(Result{
 						ID:         embedding.ItemID,
@@ -245,3 +319,30 @@ func deduplicateResults(results []Result) []Result {
 	}
 	return results
 }
+
+// itemTermPrefix names the query terms of comments, e.g. "item:123", searched for with their stored
+// embeddings.
+const itemTermPrefix = "item:"
+
+// itemVectors adds the stored embeddings of the comments in ids to vectors, and returns the terms
+// naming them. Comments without an embedding are skipped.
+func itemVectors(ctx context.Context, q *queries.Queries, ids []int, vectors map[string][]float32) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	embeddings, err := q.GetEmbeddings(ctx, queries.GetEmbeddingsParams{Model: *embeddingModel, Ids: ids})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var terms []string
+	for _, e := range embeddings {
+		v, err := UnmarshalFloat32ArrayWithLength(e.Embedding)
+		if err != nil {
+			return nil, errors.Wrapf(err, "item %d, run with -repair", e.ItemID)
+		}
+		term := itemTermPrefix + strconv.Itoa(e.ItemID)
+		terms = append(terms, term)
+		vectors[term] = v
+	}
+	return terms, nil
+}